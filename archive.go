@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"carmalink.com/replaystream/stream"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// Test archives are gzip compressed NDJSON, one record per line:
+//
+//	{"kind":"manifest","manifest":{"format":"replaystream-test","version":1,"test":"...",...}}
+//	{"kind":"test","path":"","fields":{...}}                          the Tests/{name} document
+//	{"kind":"doc","path":"report_data/abc","fields":{...}}           every document below it
+//	{"kind":"end","documents":1234}
+//
+// Paths are relative to the test document. Field values are typed the same way Firestore's REST API
+// does it ex: {"timestampValue":"2021-03-05T13:40:00.123456Z"}, {"geoPointValue":{"latitude":1,"longitude":2}}
+// so timestamps, lat/lngs, integers vs doubles and references survive a round trip.
+const (
+	archiveFormat  = "replaystream-test"
+	archiveVersion = 1
+)
+
+// kinds of archive records
+const (
+	recManifest = "manifest"
+	recTest     = "test"
+	recDoc      = "doc"
+	recEnd      = "end"
+)
+
+type archiveManifest struct {
+	Format        string    `json:"format"`
+	Version       int       `json:"version"`
+	Test          string    `json:"test"`
+	SourceProject string    `json:"sourceProject,omitempty"`
+	ExportedAt    time.Time `json:"exportedAt"`
+	Tool          string    `json:"tool"`
+}
+
+// a single line of an archive, fields depend on Kind
+type archiveRecord struct {
+	Kind      string                 `json:"kind"`
+	Manifest  *archiveManifest       `json:"manifest,omitempty"`
+	Path      string                 `json:"path,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+	Documents int                    `json:"documents,omitempty"`
+}
+
+// archiveWriter streams a test out to an archive
+type archiveWriter struct {
+	gz   *gzip.Writer
+	enc  *json.Encoder
+	docs int
+}
+
+// start an archive on w by writing out its manifest
+func newArchiveWriter(w io.Writer, m archiveManifest) (*archiveWriter, error) {
+	gz := gzip.NewWriter(w)
+	aw := &archiveWriter{gz: gz, enc: json.NewEncoder(gz)}
+	m.Format = archiveFormat
+	m.Version = archiveVersion
+	m.Tool = "replaystream"
+	err := aw.enc.Encode(archiveRecord{Kind: recManifest, Manifest: &m})
+	return aw, err
+}
+
+// write the test document itself, must come before any writeDoc
+func (aw *archiveWriter) writeTest(data map[string]interface{}) error {
+	fields, err := stream.EncodeFields(data)
+	if err != nil {
+		return err
+	}
+	return aw.enc.Encode(archiveRecord{Kind: recTest, Fields: fields})
+}
+
+// write a document found at rel, a path relative to the test document
+func (aw *archiveWriter) writeDoc(rel string, data map[string]interface{}) error {
+	fields, err := stream.EncodeFields(data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", rel, err)
+	}
+	aw.docs++
+	return aw.enc.Encode(archiveRecord{Kind: recDoc, Path: rel, Fields: fields})
+}
+
+// finish our archive with a trailer holding the document count, doesn't close the underlying writer
+func (aw *archiveWriter) close() error {
+	err := aw.enc.Encode(archiveRecord{Kind: recEnd, Documents: aw.docs})
+	if err != nil {
+		return err
+	}
+	return aw.gz.Close()
+}
+
+// archiveReader streams records back out of an archive
+type archiveReader struct {
+	gz       *gzip.Reader
+	dec      *json.Decoder
+	Manifest archiveManifest
+	docs     int
+	done     bool
+}
+
+// open an archive and read its manifest
+func newArchiveReader(r io.Reader) (*archiveReader, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("not a gzip archive: %s", err)
+	}
+	ar := &archiveReader{gz: gz, dec: json.NewDecoder(gz)}
+	ar.dec.UseNumber()
+	var rec archiveRecord
+	err = ar.dec.Decode(&rec)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %s", err)
+	}
+	if rec.Kind != recManifest || rec.Manifest == nil || rec.Manifest.Format != archiveFormat {
+		return nil, errors.New("not a replaystream test archive, manifest missing")
+	}
+	if rec.Manifest.Version > archiveVersion {
+		return nil, fmt.Errorf("archive version %d is newer than this tool supports (%d)", rec.Manifest.Version, archiveVersion)
+	}
+	ar.Manifest = *rec.Manifest
+	return ar, nil
+}
+
+// next returns the next test or doc record, io.EOF once the end trailer has been read and verified
+// decoded field values use Go types Firestore accepts for writes, references are left as stream.DocPath
+// relative paths until stream.ResolveRefs swaps them for a client's DocumentRefs
+func (ar *archiveReader) next() (kind, rel string, data map[string]interface{}, err error) {
+	if ar.done {
+		return "", "", nil, io.EOF
+	}
+	var rec archiveRecord
+	err = ar.dec.Decode(&rec)
+	if err == io.EOF {
+		return "", "", nil, errors.New("archive is truncated, end record missing")
+	}
+	if err != nil {
+		return "", "", nil, err
+	}
+	switch rec.Kind {
+	case recEnd:
+		ar.done = true
+		if rec.Documents != ar.docs {
+			return "", "", nil, fmt.Errorf("archive claims %d documents but holds %d", rec.Documents, ar.docs)
+		}
+		return "", "", nil, io.EOF
+	case recDoc:
+		ar.docs++
+		if rec.Path == "" || strings.Count(rec.Path, "/")%2 != 1 {
+			return "", "", nil, fmt.Errorf("invalid document path %q", rec.Path)
+		}
+	case recTest:
+	default:
+		return "", "", nil, fmt.Errorf("unknown archive record kind %q", rec.Kind)
+	}
+	data, err = stream.DecodeFields(rec.Fields)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("%s: %s", rec.Path, err)
+	}
+	return rec.Kind, rec.Path, data, nil
+}
+
+var (
+	timeType   = reflect.TypeOf(time.Time{})
+	latLngType = reflect.TypeOf(&latlng.LatLng{})
+)
+
+// mapToStruct fills the struct dst points to from decoded archive data, matching fields the way DataTo does:
+// by firestore tag name, falling back to the Go field name. Unknown fields are ignored.
+func mapToStruct(data map[string]interface{}, dst interface{}) error {
+	return setFromValue(reflect.ValueOf(dst).Elem(), data)
+}
+
+func setFromValue(v reflect.Value, src interface{}) error {
+	if src == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	switch v.Type() {
+	case timeType:
+		t, ok := src.(time.Time)
+		if !ok {
+			return fmt.Errorf("cannot use %T as a timestamp", src)
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	case latLngType:
+		ll, ok := src.(*latlng.LatLng)
+		if !ok {
+			return fmt.Errorf("cannot use %T as a lat/lng", src)
+		}
+		v.Set(reflect.ValueOf(ll))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		elem := reflect.New(v.Type().Elem())
+		if err := setFromValue(elem.Elem(), src); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Struct:
+		m, ok := src.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("cannot use %T as %s", src, v.Type())
+		}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" { // unexported
+				continue
+			}
+			name := strings.Split(f.Tag.Get("firestore"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			val, ok := m[name]
+			if !ok {
+				continue
+			}
+			if err := setFromValue(v.Field(i), val); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		switch n := src.(type) {
+		case int64:
+			v.SetInt(n)
+		case float64:
+			v.SetInt(int64(n))
+		default:
+			return fmt.Errorf("cannot use %T as an integer", src)
+		}
+	case reflect.Float64, reflect.Float32:
+		switch n := src.(type) {
+		case float64:
+			v.SetFloat(n)
+		case int64:
+			v.SetFloat(float64(n))
+		default:
+			return fmt.Errorf("cannot use %T as a number", src)
+		}
+	case reflect.String:
+		s, ok := src.(string)
+		if !ok {
+			return fmt.Errorf("cannot use %T as a string", src)
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return fmt.Errorf("cannot use %T as a bool", src)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if b, ok := src.([]byte); ok && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(b)
+			return nil
+		}
+		vals, ok := src.([]interface{})
+		if !ok {
+			return fmt.Errorf("cannot use %T as an array", src)
+		}
+		s := reflect.MakeSlice(v.Type(), len(vals), len(vals))
+		for i, e := range vals {
+			if err := setFromValue(s.Index(i), e); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Map:
+		m, ok := src.(map[string]interface{})
+		if !ok || v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("cannot use %T as %s", src, v.Type())
+		}
+		out := reflect.MakeMapWithSize(v.Type(), len(m))
+		for k, e := range m {
+			ev := reflect.New(v.Type().Elem()).Elem()
+			if err := setFromValue(ev, e); err != nil {
+				return fmt.Errorf("%s: %s", k, err)
+			}
+			out.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), ev)
+		}
+		v.Set(out)
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// structToMap is the reverse of mapToStruct, turning a struct into the same kind of data DocumentSnapshot.Data()
+// returns. omitempty fields are dropped when empty and zero serverTimestamp fields are set to now, like a write would.
+func structToMap(src interface{}) map[string]interface{} {
+	m, _ := valueOf(reflect.ValueOf(src)).(map[string]interface{})
+	return m
+}
+
+func valueOf(v reflect.Value) interface{} {
+	switch v.Type() {
+	case timeType, latLngType:
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return valueOf(v.Elem())
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" { // unexported
+				continue
+			}
+			opts := strings.Split(f.Tag.Get("firestore"), ",")
+			name := opts[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			fv := v.Field(i)
+			var omitEmpty, serverTime bool
+			for _, o := range opts[1:] {
+				omitEmpty = omitEmpty || o == "omitempty"
+				serverTime = serverTime || o == "serverTimestamp"
+			}
+			if serverTime && fv.IsZero() {
+				m[name] = now()
+				continue
+			}
+			if omitEmpty && (fv.IsZero() || ((fv.Kind() == reflect.Slice || fv.Kind() == reflect.Map) && fv.Len() == 0)) {
+				continue
+			}
+			m[name] = valueOf(fv)
+		}
+		return m
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Bytes()
+		}
+		vals := make([]interface{}, v.Len())
+		for i := range vals {
+			vals[i] = valueOf(v.Index(i))
+		}
+		return vals
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = valueOf(iter.Value())
+		}
+		return m
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"carmalink.com/replaystream/stream"
+)
+
+// outcome of a single assertion, emitted for each one in structured output modes
+type assertionResult stream.AssertionResult
+
+func (r assertionResult) csvHeader() []string {
+	return []string{"event", "name", "path", "where", "want", "found", "passed", "waitedSec", "error"}
+}
+
+func (r assertionResult) csvRow() []string {
+	return []string{r.Event, r.Name, r.Path, strings.Join(r.Where, "; "), strconv.Itoa(r.Want), strconv.Itoa(r.Found),
+		strconv.FormatBool(r.Passed), csvFloat(r.WaitedSec), r.Error}
+}
+
+// print assertion outcomes for humans
+func printAssertionResults(results []stream.AssertionResult) {
+	for _, r := range results {
+		status := green("PASS")
+		if !r.Passed {
+			status = red("FAIL")
+		}
+		fmt.Fprintf(msgOut, "%s %s found %d/%d after %.1fs", status, blue(r.Name), r.Found, r.Want, r.WaitedSec)
+		if r.Error != "" {
+			fmt.Fprintf(msgOut, " (%s)", r.Error)
+		}
+		fmt.Fprintln(msgOut)
+	}
+}
+
+// collect --expect flags and --scenario assertions
+func (o *optsReplay) assertions() ([]stream.Assertion, error) {
+	var as []stream.Assertion
+	if o.Scenario != "" {
+		s, err := stream.LoadScenario(o.Scenario)
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, s.Assertions...)
+	}
+	for _, e := range o.Expect {
+		a, err := stream.ParseExpect(e)
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	for _, a := range as {
+		if err := a.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return as, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"cloud.google.com/go/firestore"
+	"github.com/jessevdk/go-flags"
+)
+
+// copy a test document and all of its reports to a new name, optionally into another Firestore db
+func clone(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsClone
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse clone args")
+	}
+	// create our clients based on usr provided opts, target defaults to our source
+	conf := fsClientConfig{c: opts.Source}
+	sc, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
+	tc := sc
+	if opts.Target != "" {
+		conf = fsClientConfig{c: opts.Target}
+		tc, err = createFirestoreClient(ctx, conf)
+		if err != nil {
+			return err
+		}
+	}
+
+	src := sc.Collection("Tests").Doc(opts.Name)
+	dst := tc.Collection("Tests").Doc(opts.To)
+	t, err := readTest(ctx, src)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s reading test document: %s\n", red("ERROR"), blue(opts.Name))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	err = ensureNoTest(ctx, dst)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	n, err := copyDocTree(ctx, src, tc, dst, opts.Shallow, func(data map[string]interface{}) {
+		data["Name"] = opts.To
+		data["Created"] = firestore.ServerTimestamp
+	})
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s cloning test %s, %s documents written so far\n", red("ERROR"), blue(opts.Name), blue(strconv.Itoa(n)))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	err = adjustTagIndex(ctx, tc, t.Tag, 1)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s updating tag index\n", red("ERROR"))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	fmt.Fprintf(msgOut, "%s cloned %s to %s, %s documents written\n", green("success"), blue(opts.Name), blue(opts.To), blue(strconv.Itoa(n)))
+	return nil
+}
+
+// read a test document, failing if it doesn't exist
+func readTest(ctx context.Context, ref *firestore.DocumentRef) (*optsCopy, error) {
+	snap, err := ref.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var t optsCopy
+	err = snap.DataTo(&t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// fail if a test document already exists at ref
+func ensureNoTest(ctx context.Context, ref *firestore.DocumentRef) error {
+	_, err := ref.Get(ctx)
+	if err == nil {
+		return fmt.Errorf("test %s already exists", ref.ID)
+	}
+	if !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Methods //
+
+// convert and set user-provided values into opts struct
+func (o *optsClone) set(p *flags.Parser) (ok bool) {
+	o.Source, ok = p.Active.FindOptionByLongName("source").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Target, ok = p.Active.FindOptionByLongName("target").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Name, ok = p.Active.FindOptionByLongName("name").Value().(string)
+	if !ok {
+		return false
+	}
+	o.To, ok = p.Active.FindOptionByLongName("to").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Shallow, ok = p.Active.FindOptionByLongName("shallow").Value().(bool)
+	if !ok {
+		return false
+	}
+	return true
+}
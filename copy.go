@@ -2,14 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
+	"carmalink.com/replaystream/stream"
 	"github.com/jessevdk/go-flags"
 	progressbar "github.com/schollz/progressbar/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// Firestore allows at most 10 values in an 'in' filter
+const maxTypeFilters = 10
+
 // copy documents from a source firestore db to target firestore "cloud tests" db
 func copy(ctx context.Context, p *flags.Parser) error {
 	// collect args provided by user
@@ -17,87 +25,190 @@ func copy(ctx context.Context, p *flags.Parser) error {
 	// populate our opts
 	ok := opts.set(p)
 	if !ok {
-		fmt.Printf("%s cmd line args cannot be parsed!\n", red("ERROR"))
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse copy args")
+	}
+	// resolve and validate our time range before we go anywhere near Firestore
+	err := opts.resolveTimeRange(now())
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	if len(opts.Transponders) == 0 && !opts.AllVehicles {
+		err = errors.New("provide at least one --transponderId or use --allVehicles")
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	if len(opts.Transponders) > 0 && opts.AllVehicles {
+		err = errors.New("--transponderId and --allVehicles cannot be used together")
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	if len(opts.Type) > maxTypeFilters {
+		err = fmt.Errorf("at most %d --type filters can be used in a single copy", maxTypeFilters)
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
 	}
-	//fmt.Printf("DEBUG: Opts struct:: %v\n", opts)
 	// create our source firestore client
 	conf := fsClientConfig{c: opts.Source}
-	sc := createFirestoreClient(ctx, conf)
+	sc, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
 	// create our target firestore client
 	conf = fsClientConfig{c: opts.Target}
-	tc := createFirestoreClient(ctx, conf)
+	tc, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	// figure out which vehicles we're copying
+	if opts.AllVehicles {
+		opts.Transponders, err = accountVehicles(ctx, sc, opts.Account)
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s listing vehicles for account %s\n", red("ERROR"), blue(strconv.Itoa(opts.Account)))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+		if len(opts.Transponders) == 0 {
+			err = fmt.Errorf("no vehicles found under account %d", opts.Account)
+			fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+			return err
+		}
+	}
+	opts.Transponder = opts.Transponders[0]
+	opts.MultiVehicle = opts.AllVehicles || len(opts.Transponders) > 1
 
-	// create our base test document in target db using user-provided params
-	testDoc := tc.Collection("Tests")
-	ref := testDoc.Doc(opts.Name) // ref is used to store our report data in further on, use test "name" as document id
-	testDocRef := ref             // keep track of original test document ref if we need to delete it later
-	_, err := ref.Set(ctx, opts)
+	src, dst := stream.NewFirestoreStore(sc), stream.NewFirestoreStore(tc)
+	// overwriting an existing test drops its tags from our tag index
+	old, err := dst.Test(ctx, opts.Name)
+	if err == nil {
+		fmt.Fprintf(msgOut, "%s overwriting existing test %s\n", yellow("WARN"), blue(opts.Name))
+	}
+	docsCopied, stats, err := copyTest(ctx, src, dst, &opts)
 	if err != nil {
-		fmt.Printf("%s setting our test document up\n", red("ERROR"))
-		fmt.Println(err)
 		return err
 	}
+	// see if we copied anything at all w/ given parameters
+	if docsCopied == 0 {
+		fmt.Fprintf(msgOut, "%s no reports were found for given parameters, no test was written\n", yellow("WARN"))
+		return nil
+	}
+	var oldTags []string
+	if old != nil {
+		oldTags = old.Tag
+	}
+	err = replaceTagIndex(ctx, tc, oldTags, opts.Tag)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s updating tag index\n", red("ERROR"))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	if structuredOutput() {
+		rw := newRecordWriter(args.Output)
+		if err := rw.write(copySummary{Event: "summary", Test: opts.Name, Vehicles: opts.Transponders, Docs: docsCopied, Stats: stats}); err != nil {
+			return err
+		}
+		return rw.close()
+	}
+	return nil
+}
+
+// final record emitted by copy in structured output modes
+type copySummary struct {
+	Event    string // always "summary"
+	Test     string
+	Vehicles []int
+	Docs     int
+	Stats    testStats
+}
 
-	// build source query //
-	// iterate through each supported Report collection for a transponder
-	for _, reportCollection := range SupportedTransponderReports {
-		// build query
-		// ex: account/18/vehicle/83/report_data
-		sq := fmt.Sprintf("account/" + strconv.Itoa(opts.Account) + "/vehicle/" + strconv.Itoa(opts.Transponder) + "/" + reportCollection)
-		//fmt.Printf("DEBUG: assembled query string:: %s\n", sq)
-		stests := sc.Collection(sq).Where("reportTimestamp", ">", opts.StartTime).Where("reportTimestamp", "<", opts.EndTime)
-		//fmt.Printf("DEBUG: firestore.Query:: %v\n", stests)
+func (s copySummary) csvHeader() []string {
+	return []string{"event", "test", "vehicles", "docs", "firstReport", "lastReport"}
+}
 
-		// get all docs that match
-		iter1, err := stests.Documents(ctx).GetAll()
+func (s copySummary) csvRow() []string {
+	xs := make([]string, len(s.Vehicles))
+	for i, x := range s.Vehicles {
+		xs[i] = strconv.Itoa(x)
+	}
+	return []string{s.Event, s.Test, strings.Join(xs, ";"), strconv.Itoa(s.Docs), csvTime(s.Stats.FirstReport), csvTime(s.Stats.LastReport)}
+}
+
+// copy each vehicle's reports out of src into our test on dst, returns number of reports copied and their statistics
+// reports are copied as is (their raw Data when the store has it), nothing is written to dst when no reports are found
+func copyTest(ctx context.Context, src, dst stream.Store, opts *optsCopy) (int, testStats, error) {
+	q := opts.reportQuery()
+	sb := newStatsBuilder()
+	reports := make(map[int][]stream.VehicleReport, len(opts.Transponders))
+	var docsTotal int
+	for _, x := range opts.Transponders {
+		if opts.MultiVehicle {
+			fmt.Fprintf(msgOut, "reading vehicle %s\n", blue(strconv.Itoa(x)))
+		}
+		srs, err := src.Reports(ctx, opts.Account, x, q)
 		if err != nil {
-			fmt.Printf("%s querying source collection: %s\n", red("ERROR"), blue(reportCollection))
-			fmt.Println(err)
-			return err
+			fmt.Fprintf(msgOut, "%s querying source collection: %s\n", red("ERROR"), blue(stream.ReportCollection))
+			fmt.Fprintln(msgOut, err)
+			if len(opts.Type) > 0 && status.Code(err) == codes.FailedPrecondition {
+				fmt.Fprintf(msgOut, "%s --type filters need a composite index on collection %s: %s Ascending, %s Ascending\n",
+					yellow("HINT"), blue(stream.ReportCollection), blue("type"), blue("reportTimestamp"))
+			}
+			return 0, testStats{}, err
 		}
-		// basic copy operation metrics
-		var docsAdded int
-		docsTotal := len(iter1)
-		bar := progressbar.Default(int64(docsTotal))
-		// see if we have any results to copy w/ given parameters
-		if docsTotal == 0 {
-			// warn user
-			fmt.Printf("%s no reports were found for given parameters. Cleaning up parent reference document...\n", yellow("WARN"))
-			// delete testDocRef
-			_, err = testDocRef.Delete(ctx)
-			if err != nil {
-				fmt.Printf("%s deleting test reference doc...\n", red("ERROR"))
+		for i := range srs {
+			if srs[i].Err != nil {
+				fmt.Fprintf(msgOut, "%s unable to read report %s for test statistics\n", yellow("WARN"), blue(srs[i].Path))
 			}
+			sb.add(stream.ReportCollection, x, &srs[i].Report)
+			reports[x] = append(reports[x], stream.VehicleReport{Vehicle: x, Report: srs[i].Report, Data: srs[i].Data})
 		}
+		if opts.MultiVehicle && len(reports[x]) == 0 { // empty vehicles are simply left out of our test
+			fmt.Fprintf(msgOut, "%s no reports were found for vehicle %s\n", yellow("WARN"), blue(strconv.Itoa(x)))
+		}
+		docsTotal += len(reports[x])
+	}
+	if docsTotal == 0 {
+		return 0, testStats{}, nil
+	}
 
-		dtest := ref.Collection(reportCollection) // use our test doc ref + reportCollection type
-		// run through returned documents and copy them to target
-		for _, doc := range iter1 { // iterate through all docs received and set in destination firestore
-			_, err := dtest.NewDoc().Set(ctx, doc.Data())
-			//fmt.Printf("DEBUG: %s : %v\n", green("copied"), doc.Data())
+	// create our test document in target db using user-provided params along with a summary of what we're copying
+	stats := sb.result()
+	t := opts.testDoc()
+	t.Stats = &stats
+	err := dst.PutTest(ctx, t)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s setting our test document up\n", red("ERROR"))
+		fmt.Fprintln(msgOut, err)
+		return 0, stats, err
+	}
+	var docsCopied int
+	bar := progressbar.Default(int64(docsTotal))
+	for _, x := range opts.Transponders {
+		for _, vr := range reports[x] {
+			err := dst.AddTestReport(ctx, t, vr)
 			if err != nil {
-				fmt.Printf("%s setting new documents in target collection: %s\n", red("ERROR"), blue(reportCollection))
-				fmt.Println(err)
-				return err
+				fmt.Fprintf(msgOut, "%s setting new documents in target collection: %s\n", red("ERROR"), blue(stream.ReportCollection))
+				fmt.Fprintln(msgOut, err)
+				return docsCopied, stats, err
 			}
-			// metrics
-			docsAdded++
+			docsCopied++
 			bar.Add(1)
-			// if DEBUG disable bar and use colored count?
-			//fmt.Printf("%s/%s  ", green(strconv.Itoa(docsAdded)), blue(strconv.Itoa(docsTotal)))
-		}
-		if docsTotal != 0 {
-			fmt.Printf("\n%s\n", green("success"))
 		}
 	}
-	return nil
+	fmt.Fprintf(msgOut, "\n%s\n", green("success"))
+	return docsCopied, stats, nil
 }
 
 // Methods //
 
 // convert and set user-provided values into opts struct
 func (o *optsCopy) set(p *flags.Parser) (ok bool) {
-	o.Transponder, ok = p.Active.FindOptionByLongName("transponderId").Value().(int)
+	o.Transponders, ok = p.Active.FindOptionByLongName("transponderId").Value().([]int)
+	if !ok {
+		return false
+	}
+	o.AllVehicles, ok = p.Active.FindOptionByLongName("allVehicles").Value().(bool)
 	if !ok {
 		return false
 	}
@@ -109,17 +220,33 @@ func (o *optsCopy) set(p *flags.Parser) (ok bool) {
 	if !ok {
 		return false
 	}
-	o.Stime, ok = p.Active.FindOptionByLongName("startTime").Value().(int64)
+	o.Type, ok = p.Active.FindOptionByLongName("type").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.IncStart, ok = p.Active.FindOptionByLongName("includeStart").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.IncEnd, ok = p.Active.FindOptionByLongName("includeEnd").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.Start, ok = p.Active.FindOptionByLongName("startTime").Value().(string)
+	if !ok {
+		return false
+	}
+	o.End, ok = p.Active.FindOptionByLongName("endTime").Value().(string)
 	if !ok {
 		return false
-	} else { // convert epoch millis to time.Time
-		o.StartTime = time.Unix(0, o.Stime*int64(time.Millisecond)).UTC()
 	}
-	o.Etime, ok = p.Active.FindOptionByLongName("endTime").Value().(int64)
+	o.Duration, ok = p.Active.FindOptionByLongName("duration").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Timezone, ok = p.Active.FindOptionByLongName("timezone").Value().(string)
 	if !ok {
 		return false
-	} else { // convert epoch millis to time.Time
-		o.EndTime = time.Unix(0, o.Etime*int64(time.Millisecond)).UTC()
 	}
 	o.Description, ok = p.Active.FindOptionByLongName("description").Value().(string)
 	if !ok {
@@ -139,3 +266,71 @@ func (o *optsCopy) set(p *flags.Parser) (ok bool) {
 	}
 	return true
 }
+
+// our source report query from the requested time range boundaries and type filters
+func (o *optsCopy) reportQuery() stream.ReportQuery {
+	return stream.ReportQuery{Start: o.StartTime, End: o.EndTime, IncStart: o.IncStart, IncEnd: o.IncEnd, Types: o.Type}
+}
+
+// the test document we store for a copy
+func (o *optsCopy) testDoc() *stream.TestDoc {
+	return &stream.TestDoc{
+		Name:         o.Name,
+		Description:  o.Description,
+		Tag:          o.Tag,
+		Account:      o.Account,
+		Transponders: o.Transponders,
+		AllVehicles:  o.AllVehicles,
+		Transponder:  o.Transponder,
+		MultiVehicle: o.MultiVehicle,
+		Type:         o.Type,
+		IncStart:     o.IncStart,
+		IncEnd:       o.IncEnd,
+		Stime:        o.Stime,
+		Etime:        o.Etime,
+		StartTime:    o.StartTime,
+		EndTime:      o.EndTime,
+		Source:       o.Source,
+		Target:       o.Target,
+		Stats:        o.Stats,
+	}
+}
+
+// resolve user-provided time strings into StartTime/EndTime (UTC) and validate the range
+// ref is the time relative expressions like 'now-30m' are based on
+func (o *optsCopy) resolveTimeRange(ref time.Time) error {
+	loc, err := time.LoadLocation(o.Timezone)
+	if err != nil {
+		return fmt.Errorf("unknown timezone %q: %s", o.Timezone, err)
+	}
+	o.StartTime, err = parseTimeSpec(o.Start, loc, ref)
+	if err != nil {
+		return fmt.Errorf("--startTime: %s", err)
+	}
+	switch {
+	case o.End != "" && o.Duration != "":
+		return errors.New("use either --endTime or --duration, not both")
+	case o.End != "":
+		o.EndTime, err = parseTimeSpec(o.End, loc, ref)
+		if err != nil {
+			return fmt.Errorf("--endTime: %s", err)
+		}
+	case o.Duration != "":
+		d, err := parseSpecDuration(o.Duration)
+		if err != nil {
+			return fmt.Errorf("--duration: %s", err)
+		}
+		o.EndTime = o.StartTime.Add(d)
+	default:
+		return errors.New("one of --endTime or --duration is required")
+	}
+	if o.StartTime.After(o.EndTime) {
+		return fmt.Errorf("start time %s is after end time %s", o.StartTime.Format(time.RFC3339), o.EndTime.Format(time.RFC3339))
+	}
+	if o.StartTime.Equal(o.EndTime) && !(o.IncStart && o.IncEnd) { // a single instant is fine when both ends are inclusive
+		return fmt.Errorf("empty time range, start and end are both %s", o.StartTime.Format(time.RFC3339))
+	}
+	o.Stime = millis(o.StartTime)
+	o.Etime = millis(o.EndTime)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"carmalink.com/replaystream/stream"
+)
+
+var t0 = time.Date(2021, 3, 5, 13, 40, 0, 0, time.UTC)
+
+// a source store handing out raw data along with its reports, like Firestore does
+type rawStore struct {
+	*stream.MemoryStore
+}
+
+func (s rawStore) Reports(ctx context.Context, account, transponder int, q stream.ReportQuery) ([]stream.StoredReport, error) {
+	srs, err := s.MemoryStore.Reports(ctx, account, transponder, q)
+	for i := range srs {
+		srs[i].Data = map[string]interface{}{
+			"type":            srs[i].Report.Type,
+			"reportTimestamp": srs[i].Report.ReportTimestamp,
+			"unknownField":    int64(transponder),
+		}
+	}
+	return srs, err
+}
+
+// source vehicles 83 and 84 of account 18, a report a minute from t0 on, 84 only reports speeding
+func copySource(t *testing.T) rawStore {
+	src := rawStore{stream.NewMemoryStore()}
+	for i := 0; i < 5; i++ {
+		for _, r := range []struct {
+			vehicle int
+			typ     string
+		}{{83, "status"}, {84, "speeding"}} {
+			_, err := src.WriteReport(context.Background(), 18, r.vehicle, stream.Report{
+				Type: r.typ, ReportTimestamp: t0.Add(time.Duration(i) * time.Minute), Speed: float64(10 * i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return src
+}
+
+func TestCopyTest(t *testing.T) {
+	msgOut = ioutil.Discard
+	tests := []struct {
+		name         string
+		opts         optsCopy
+		wantDocs     int
+		wantVehicles map[int]int // reports per original vehicle
+	}{
+		{
+			name:         "single vehicle, exclusive range",
+			opts:         optsCopy{Transponders: []int{83}, StartTime: t0, EndTime: t0.Add(4 * time.Minute)},
+			wantDocs:     3,
+			wantVehicles: map[int]int{83: 3},
+		},
+		{
+			name:         "single vehicle, inclusive range",
+			opts:         optsCopy{Transponders: []int{83}, StartTime: t0, EndTime: t0.Add(4 * time.Minute), IncStart: true, IncEnd: true},
+			wantDocs:     5,
+			wantVehicles: map[int]int{83: 5},
+		},
+		{
+			name:         "multi vehicle",
+			opts:         optsCopy{Transponders: []int{83, 84}, StartTime: t0, EndTime: t0.Add(time.Hour), IncStart: true, MultiVehicle: true},
+			wantDocs:     10,
+			wantVehicles: map[int]int{83: 5, 84: 5},
+		},
+		{
+			name:         "multi vehicle, type filter leaves a vehicle empty",
+			opts:         optsCopy{Transponders: []int{83, 84}, StartTime: t0, EndTime: t0.Add(time.Hour), IncStart: true, MultiVehicle: true, Type: []string{"speeding"}},
+			wantDocs:     5,
+			wantVehicles: map[int]int{84: 5},
+		},
+		{
+			name: "nothing in range",
+			opts: optsCopy{Transponders: []int{83}, StartTime: t0.Add(time.Hour), EndTime: t0.Add(2 * time.Hour)},
+		},
+	}
+	for _, tc := range tests {
+		for name, dst := range map[string]stream.Store{"memory": stream.NewMemoryStore(), "dir": stream.NewDirStore(t.TempDir())} {
+			t.Run(tc.name+"/"+name, func(t *testing.T) {
+				ctx := context.Background()
+				opts := tc.opts
+				opts.Name, opts.Account, opts.Tag = "copied", 18, []string{"e2e"}
+				opts.Transponder = opts.Transponders[0]
+				n, stats, err := copyTest(ctx, copySource(t), dst, &opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != tc.wantDocs || stats.Docs != tc.wantDocs {
+					t.Errorf("copied %d with stats of %d, want %d", n, stats.Docs, tc.wantDocs)
+				}
+				td, err := dst.Test(ctx, "copied")
+				if tc.wantDocs == 0 {
+					if err != stream.ErrNotFound {
+						t.Errorf("test written without any reports: %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if td.Stats == nil || td.Stats.Docs != tc.wantDocs || !reflect.DeepEqual(td.Tag, []string{"e2e"}) {
+					t.Errorf("test document %+v", td)
+				}
+				reports, err := dst.TestReports(ctx, td)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := make(map[int]int)
+				for _, vr := range reports {
+					got[vr.Vehicle]++
+					// copied as is, including fields our report struct doesn't know about
+					if vr.Data["unknownField"] != int64(vr.Vehicle) {
+						t.Errorf("raw data lost: %#v", vr.Data)
+					}
+				}
+				if !reflect.DeepEqual(got, tc.wantVehicles) {
+					t.Errorf("reports per vehicle %v, want %v", got, tc.wantVehicles)
+				}
+			})
+		}
+	}
+}
+
+func TestCopyTestOverwrite(t *testing.T) {
+	msgOut = ioutil.Discard
+	ctx := context.Background()
+	dst := stream.NewMemoryStore()
+	opts := optsCopy{Name: "copied", Account: 18, Tag: []string{"e2e"}, Transponders: []int{83}, Transponder: 83,
+		StartTime: t0, EndTime: t0.Add(time.Hour), IncStart: true}
+	for i := 0; i < 2; i++ {
+		if _, _, err := copyTest(ctx, copySource(t), dst, &opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reports, err := dst.TestReports(ctx, opts.testDoc())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 5 {
+		t.Errorf("copying twice left %d reports, want 5", len(reports))
+	}
+}
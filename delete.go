@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// delete a test document along with every report (sub)collection below it
+func deleteTest(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsDelete
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse delete args")
+	}
+	// create our client based on usr provided opts
+	conf := fsClientConfig{c: opts.Source}
+	c, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	ref := c.Collection("Tests").Doc(opts.Name)
+	t, err := readTest(ctx, ref)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s reading test document: %s\n", red("ERROR"), blue(opts.Name))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	if !opts.Yes && !confirm(fmt.Sprintf("delete test %s and all of its reports?", blue(opts.Name))) {
+		fmt.Fprintf(msgOut, "%s nothing deleted\n", yellow("WARN"))
+		return nil
+	}
+	n, err := deleteDocTree(ctx, c, ref, opts.Shallow)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s deleting test %s, %s documents deleted so far\n", red("ERROR"), blue(opts.Name), blue(strconv.Itoa(n)))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	err = adjustTagIndex(ctx, c, t.Tag, -1)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s updating tag index\n", red("ERROR"))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	fmt.Fprintf(msgOut, "%s deleted %s documents\n", green("success"), blue(strconv.Itoa(n)))
+	return nil
+}
+
+// Methods //
+
+// convert and set user-provided values into opts struct
+func (o *optsDelete) set(p *flags.Parser) (ok bool) {
+	o.Source, ok = p.Active.FindOptionByLongName("source").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Name, ok = p.Active.FindOptionByLongName("name").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Yes, ok = p.Active.FindOptionByLongName("yes").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.Shallow, ok = p.Active.FindOptionByLongName("shallow").Value().(bool)
+	if !ok {
+		return false
+	}
+	return true
+}
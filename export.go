@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+
+	"cloud.google.com/go/firestore"
+	"github.com/jessevdk/go-flags"
+)
+
+// export a test document and everything below it into a portable archive file, see archive.go for the format
+// or just its routes and events as GeoJSON, KML or GPX for a look at them on a map
+func export(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsExport
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse export args")
+	}
+	if opts.File == "" {
+		opts.File = exportFileName(opts.Name, opts.Format)
+	}
+	// create our client based on usr provided opts
+	conf := fsClientConfig{c: opts.Source}
+	c, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
+	project, _ := projectIdInServiceAcctFile(opts.Source)
+
+	ref := c.Collection("Tests").Doc(opts.Name)
+	snap, err := ref.Get(ctx)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s finding test document: %s\n", red("ERROR"), blue(opts.Name))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	f, err := createExportFile(opts.File, opts.Force)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s creating export file %s\n", red("ERROR"), blue(opts.File))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	var n int
+	if opts.Format == formatArchive {
+		n, err = writeArchive(ctx, f, snap, archiveManifest{Test: opts.Name, SourceProject: project, ExportedAt: now()}, opts.Shallow)
+	} else {
+		// maps only need the reports themselves
+		var tr *testRoutes
+		tr, err = loadRoutes(ctx, c, opts.Name)
+		if err == nil {
+			for _, rs := range tr.Reports {
+				n += len(rs)
+			}
+			err = writeRoutes(f, tr, opts.Format)
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s exporting test %s, removing partial file\n", red("ERROR"), blue(opts.Name))
+		fmt.Fprintln(msgOut, err)
+		os.Remove(opts.File)
+		return err
+	}
+	fmt.Fprintf(msgOut, "%s exported %s documents to %s\n", green("success"), blue(strconv.Itoa(n)), blue(opts.File))
+	return nil
+}
+
+// stream a test document and every document below it into an archive on f, returns the number of documents below the test
+// shallow is as in deleteDocTree
+func writeArchive(ctx context.Context, f *os.File, test *firestore.DocumentSnapshot, m archiveManifest, shallow bool) (int, error) {
+	aw, err := newArchiveWriter(f, m)
+	if err != nil {
+		return 0, err
+	}
+	err = aw.writeTest(test.Data())
+	if err != nil {
+		return 0, err
+	}
+	err = walkBelow(ctx, test.Ref, "", shallow, func(rel string, snap *firestore.DocumentSnapshot) error {
+		return aw.writeDoc(rel, snap.Data())
+	})
+	if err != nil {
+		return aw.docs, err
+	}
+	return aw.docs, aw.close()
+}
+
+// create a new export file, an existing one is only overwritten if force is set
+func createExportFile(file string, force bool) (*os.File, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	return os.OpenFile(file, flag, 0644)
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// default export file name for a test ex: 'truckster 5 min trip' -> truckster_5_min_trip.ndjson.gz
+func exportFileName(test, format string) string {
+	ext := ".ndjson.gz"
+	if format != formatArchive {
+		ext = "." + format
+	}
+	return unsafeFileChars.ReplaceAllString(test, "_") + ext
+}
+
+// Methods //
+
+// convert and set user-provided values into opts struct
+func (o *optsExport) set(p *flags.Parser) (ok bool) {
+	o.Source, ok = p.Active.FindOptionByLongName("source").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Name, ok = p.Active.FindOptionByLongName("name").Value().(string)
+	if !ok {
+		return false
+	}
+	o.File, ok = p.Active.FindOptionByLongName("file").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Force, ok = p.Active.FindOptionByLongName("force").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.Format, ok = p.Active.FindOptionByLongName("format").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Shallow, ok = p.Active.FindOptionByLongName("shallow").Value().(bool)
+	if !ok {
+		return false
+	}
+	return true
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"os"
+	"strings"
 
 	"cloud.google.com/go/firestore"
 	"github.com/Jeffail/gabs/v2"
@@ -28,7 +29,7 @@ func projectIdInServiceAcctFile(p string) (id string, err error) {
 	id, ok := j.Path("project_id").Data().(string)
 	if !ok {
 		log.Printf("FATAL: Unable to find project_id key in service account JSON file: %s", p)
-		return id, err
+		return id, errors.New("no project_id in service account file")
 	} else {
 		return id, nil
 	}
@@ -41,33 +42,50 @@ type fsClientConfig struct {
 	l bool   // is this an emulator conn?
 }
 
+// true if a Firestore target looks like a local emulator 'host:port' string rather than a service account file
+func isEmulatorAddr(s string) bool {
+	return strings.Contains(s, "localhost:") || strings.Contains(s, "127.0.0.1:")
+}
+
+// client config for a target that may be a service account file or a local emulator, projectId is only used for the latter
+func targetClientConfig(target, projectId string) fsClientConfig {
+	if isEmulatorAddr(target) {
+		return fsClientConfig{c: target, e: projectId, l: true}
+	}
+	return fsClientConfig{c: target}
+}
+
 // create a new Firestore client using a projectId
-func createFirestoreClient(ctx context.Context, conf fsClientConfig) *firestore.Client {
+// errors are printed out for the user here, callers only need to pass them on
+func createFirestoreClient(ctx context.Context, conf fsClientConfig) (*firestore.Client, error) {
 	if !conf.l && conf.e == "" { // traditional service account file
 		// projId comes from within our credentials file...
 		projId, err := projectIdInServiceAcctFile(conf.c)
-		if err != nil { // printed out warnings to user already, just bail out
-			os.Exit(1)
+		if err != nil { // printed out warnings to user already
+			return nil, err
 		}
 		o := option.WithCredentialsFile(conf.c)
 		client, err := firestore.NewClient(ctx, projId, o)
 		if err != nil {
-			log.Printf("%s %s", red("ERROR"), err)
+			fmt.Fprintf(msgOut, "%s connecting to Firestore: %s\n", red("ERROR"), err)
+			return nil, err
 		}
-		return client
+		return client, nil
 	} else if conf.l && conf.e != "" && conf.c != "" { // firebase projectId provided, ze emulator
 		grpcConn, err := grpc.Dial(conf.c, grpc.WithInsecure(), grpc.WithPerRPCCredentials(emulatorCreds{}))
 		if err != nil {
-			fmt.Printf("ERROR: dialing emulator firestore address")
-			os.Exit(1)
+			fmt.Fprintf(msgOut, "%s dialing emulator firestore address %s: %s\n", red("ERROR"), conf.c, err)
+			return nil, err
 		}
 		tc, err := firestore.NewClient(ctx, conf.e, option.WithGRPCConn(grpcConn))
-		return tc
-	} else {
-		fmt.Printf("%s invalid configuration passed to createFirestoreClient()\n", red("FATAL"))
-		os.Exit(1)
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s connecting to emulator %s: %s\n", red("ERROR"), conf.c, err)
+			return nil, err
+		}
+		return tc, nil
 	}
-	return &firestore.Client{} // meh, this should never happen
+	fmt.Fprintf(msgOut, "%s invalid configuration passed to createFirestoreClient()\n", red("FATAL"))
+	return nil, errors.New("invalid Firestore client configuration")
 }
 
 // emulatorCreds is an instance of grpc.PerRPCCredentials that will configure a
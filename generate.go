@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// vehicle model constants
+const (
+	simStep         = time.Second // resolution of our vehicle simulation
+	alternatorVolts = 14.2        // battery voltage while the engine runs
+	lowBatteryVolts = 11.8        // below this reports flag isLowBatteryVoltage
+	minSignal       = -113.0      // cell signal strength bounds in dBm
+	maxSignal       = -51.0
+	startSignal     = -75.0
+	minCrawlSpeed   = 2.0 // m/s, never brake below this before reaching a waypoint
+	cruiseChange    = 30  // seconds between changes of cruising speed
+)
+
+// build a plausible trip from nothing but a route and a vehicle model, for load tests and demos
+func generate(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsGenerate
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse generate args")
+	}
+	err := opts.validate()
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	start := now()
+	if opts.Start != "" {
+		loc, err := time.LoadLocation(opts.Timezone)
+		if err != nil {
+			err = fmt.Errorf("unknown timezone %q: %s", opts.Timezone, err)
+			fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+			return err
+		}
+		start, err = parseTimeSpec(opts.Start, loc, now())
+		if err != nil {
+			err = fmt.Errorf("--startTime: %s", err)
+			fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+			return err
+		}
+	}
+	if opts.Seed == 0 {
+		opts.Seed = now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	route, err := opts.route(rng)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	fmt.Fprintf(msgOut, "generating %s legs with seed %s\n", blue(strconv.Itoa(len(route)-1)), blue(strconv.FormatInt(opts.Seed, 10)))
+	reports := simulateTrip(route, start, &opts, rng)
+
+	test := optsCopy{
+		Transponders: []int{opts.Transponder},
+		Transponder:  opts.Transponder,
+		Account:      opts.Account,
+		Name:         opts.Name,
+		Description:  opts.Description,
+		Tag:          opts.Tag,
+		Source:       "generate",
+		Target:       opts.Target,
+		StartTime:    reports[0].ReportTimestamp,
+		EndTime:      reports[len(reports)-1].ReportTimestamp,
+	}
+	test.Stime = millis(test.StartTime)
+	test.Etime = millis(test.EndTime)
+
+	var n int
+	if opts.File != "" {
+		n, err = writeSyntheticArchive(opts.File, opts.Force, &test, reports)
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s writing archive %s\n", red("ERROR"), blue(opts.File))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+	} else {
+		conf := targetClientConfig(opts.Target, opts.EmulatorProjectId)
+		c, err := createFirestoreClient(ctx, conf)
+		if err != nil {
+			return err
+		}
+		err = ensureNoTest(ctx, c.Collection("Tests").Doc(opts.Name))
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+			return err
+		}
+		n, err = saveSyntheticTest(ctx, c, &test, reports)
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s saving test %s, %s documents written so far\n", red("ERROR"), blue(opts.Name), blue(strconv.Itoa(n)))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+	}
+	fmt.Fprintf(msgOut, "%s generated %s with %s reports over %s covering %s km\n", green("success"), blue(opts.Name), blue(strconv.Itoa(n)),
+		blue(test.EndTime.Sub(test.StartTime).String()), blue(strconv.FormatFloat(test.Stats.Distance, 'f', 2, 64)))
+	return nil
+}
+
+// check our route and output options make sense together
+func (o *optsGenerate) validate() error {
+	switch {
+	case o.Target == "" && o.File == "":
+		return errors.New("provide a --target to write to or a --file to write an archive")
+	case o.Target != "" && o.File != "":
+		return errors.New("--target and --file cannot be used together")
+	case isEmulatorAddr(o.Target) && o.EmulatorProjectId == "":
+		return errors.New("writing into an emulator needs its --projectId")
+	case len(o.Waypoint) > 0 && o.BBox != "":
+		return errors.New("use either --waypoint or --bbox, not both")
+	case len(o.Waypoint) == 0 && o.BBox == "":
+		return errors.New("provide --waypoint(s) to drive through or a --bbox to wander around")
+	case o.From == "" && o.BBox == "" && len(o.Waypoint) < 2:
+		return errors.New("a route needs a --from point or at least two --waypoints")
+	case o.Interval <= 0:
+		return errors.New("--interval must be positive")
+	case o.Speed <= 0:
+		return errors.New("--speed must be positive")
+	case o.Accel <= 0:
+		return errors.New("--accel must be positive")
+	case o.BBox != "" && o.Legs < 1:
+		return errors.New("--legs must be at least 1")
+	}
+	return nil
+}
+
+// the points our trip drives through in order, starting point first
+func (o *optsGenerate) route(rng *rand.Rand) ([]trackPoint, error) {
+	var route []trackPoint
+	if o.From != "" {
+		p, err := parseLatLng(o.From)
+		if err != nil {
+			return nil, fmt.Errorf("--from: %s", err)
+		}
+		route = append(route, p)
+	}
+	for _, w := range o.Waypoint {
+		p, err := parseLatLng(w)
+		if err != nil {
+			return nil, fmt.Errorf("--waypoint: %s", err)
+		}
+		route = append(route, p)
+	}
+	if o.BBox != "" {
+		parts := strings.Split(o.BBox, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("--bbox needs 'minLat,minLng,maxLat,maxLng', got %q", o.BBox)
+		}
+		var b [4]float64
+		for i, part := range parts {
+			v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, fmt.Errorf("--bbox: %s", err)
+			}
+			b[i] = v
+		}
+		if b[0] >= b[2] || b[1] >= b[3] {
+			return nil, errors.New("--bbox minimums must be below its maximums")
+		}
+		random := func() trackPoint {
+			return trackPoint{Lat: b[0] + rng.Float64()*(b[2]-b[0]), Lng: b[1] + rng.Float64()*(b[3]-b[1])}
+		}
+		if len(route) == 0 {
+			route = append(route, random())
+		}
+		for i := 0; i < o.Legs; i++ {
+			route = append(route, random())
+		}
+	}
+	return route, nil
+}
+
+// parse a 'lat,lng' string
+func parseLatLng(s string) (trackPoint, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return trackPoint{}, fmt.Errorf("expected 'lat,lng', got %q", s)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return trackPoint{}, err
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return trackPoint{}, err
+	}
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return trackPoint{}, fmt.Errorf("%q is out of range", s)
+	}
+	return trackPoint{Lat: lat, Lng: lng}, nil
+}
+
+// vehicleSim drives a single vehicle one simStep at a time, collecting the reports it would send
+type vehicleSim struct {
+	o   *optsGenerate
+	so  synthOptions
+	rng *rand.Rand
+
+	t        time.Time
+	pos      trackPoint
+	heading  float64
+	speed    float64 // km/h
+	cruise   float64 // km/h we're currently aiming for
+	odometer float64
+	battery  float64 // volts
+	resting  float64 // volts the battery settles at with the engine off
+	signal   float64 // dBm
+
+	nextReport    time.Time
+	sinceCruise   int       // seconds since our cruising speed last changed
+	speedingSince time.Time // zero unless we're currently speeding
+	reports       []FirestoreTransponderReportV1
+}
+
+// drive a whole route starting at start, stopping at every waypoint, returns every report sent in time order
+func simulateTrip(route []trackPoint, start time.Time, o *optsGenerate, rng *rand.Rand) []FirestoreTransponderReportV1 {
+	s := &vehicleSim{
+		o: o,
+		so: synthOptions{
+			Type:       "status",
+			Serial:     o.Transponder,
+			Interval:   o.Interval,
+			SpeedLimit: o.SpeedLimit,
+			Delay:      o.Delay,
+		},
+		rng:      rng,
+		t:        start,
+		pos:      route[0],
+		odometer: o.Odometer,
+		battery:  o.Battery,
+		resting:  o.Battery,
+		signal:   startSignal,
+	}
+	s.status()
+	s.nextReport = start.Add(o.Interval)
+	for i, p := range route[1:] {
+		s.drive(p)
+		if i < len(route)-2 { // no need to wait around at our destination
+			s.park(o.Stop)
+		}
+	}
+	s.speed = 0
+	s.checkSpeeding()
+	if last := s.reports[len(s.reports)-1]; !last.ReportTimestamp.Equal(s.t) {
+		s.status()
+	}
+	return s.reports
+}
+
+// drive in a straight line to p, speeding up to our cruising speed and braking in time to stop there
+func (s *vehicleSim) drive(p trackPoint) {
+	from := s.pos
+	total := distanceKm(from, p) * 1000 // m
+	if total == 0 {
+		return
+	}
+	s.heading = bearing(from, p)
+	accel := s.o.Accel * simStep.Seconds()
+	done := 0.0
+	for done < total {
+		if s.sinceCruise%cruiseChange == 0 {
+			s.cruise = math.Max(5, s.o.Speed+(s.rng.Float64()*2-1)*s.o.SpeedJitter)
+		}
+		s.sinceCruise++
+		v := s.speed / 3.6 // m/s
+		target := s.cruise / 3.6
+		remaining := total - done
+		switch {
+		case remaining <= v*v/(2*s.o.Accel)+v*simStep.Seconds(): // time to brake
+			v = math.Max(minCrawlSpeed, v-accel)
+		case v < target:
+			v = math.Min(target, v+accel)
+		case v > target:
+			v = math.Max(target, v-accel)
+		}
+		step := math.Min(v*simStep.Seconds(), remaining)
+		done += step
+		s.speed = v * 3.6
+		s.odometer += step / 1000
+		frac := done / total
+		s.pos = trackPoint{Lat: from.Lat + (p.Lat-from.Lat)*frac, Lng: from.Lng + (p.Lng-from.Lng)*frac}
+		s.tick(true)
+	}
+	s.pos = p
+	s.speed = 0
+}
+
+// sit still with the engine off for d
+func (s *vehicleSim) park(d time.Duration) {
+	s.sinceCruise = 0
+	for end := s.t.Add(d); s.t.Before(end); {
+		s.tick(false)
+	}
+}
+
+// advance time by a single simStep: battery, signal and speeding behavior, reporting when our interval is up
+func (s *vehicleSim) tick(engineOn bool) {
+	s.t = s.t.Add(simStep)
+	hours := simStep.Hours()
+	if engineOn {
+		// the alternator charges us up, and tops our resting voltage back up too
+		s.battery += (alternatorVolts - s.battery) * 0.05
+		s.resting = math.Min(s.o.Battery, s.resting+s.o.BatteryDrain*hours)
+	} else {
+		// settle back to resting voltage, which sags the longer we sit
+		s.resting -= s.o.BatteryDrain * hours
+		s.battery += (s.resting - s.battery) * 0.05
+	}
+	s.signal = math.Max(minSignal, math.Min(maxSignal, s.signal+s.rng.NormFloat64()))
+	s.checkSpeeding()
+	if !s.t.Before(s.nextReport) {
+		s.status()
+		s.nextReport = s.nextReport.Add(s.o.Interval)
+	}
+}
+
+// open or close a speeding event as our speed crosses the speed limit
+func (s *vehicleSim) checkSpeeding() {
+	if s.o.SpeedLimit <= 0 {
+		return
+	}
+	over := s.speed > s.o.SpeedLimit
+	switch {
+	case over && s.speedingSince.IsZero():
+		s.speedingSince = s.t
+		r := s.current("speeding")
+		r.EventStart = s.t
+		r.InProgress = true
+		s.reports = append(s.reports, r)
+	case !over && !s.speedingSince.IsZero():
+		r := s.current("speeding")
+		r.EventStart = s.speedingSince
+		r.Duration = s.t.Sub(s.speedingSince).Seconds()
+		s.reports = append(s.reports, r)
+		s.speedingSince = time.Time{}
+	}
+}
+
+// send a regular status report
+func (s *vehicleSim) status() {
+	s.reports = append(s.reports, s.current("status"))
+}
+
+// a report of type typ carrying our current state
+func (s *vehicleSim) current(typ string) FirestoreTransponderReportV1 {
+	p := s.pos
+	p.Time = s.t
+	r := s.so.report(p, s.heading, s.speed, s.odometer)
+	r.Type = typ
+	r.BatteryVoltage = math.Round(s.battery*100) / 100
+	r.IsLowBattery = s.battery < lowBatteryVolts
+	r.CellSignalStrength = math.Round(s.signal)
+	return r
+}
+
+// Methods //
+
+// convert and set user-provided values into opts struct
+func (o *optsGenerate) set(p *flags.Parser) (ok bool) {
+	o.Name, ok = p.Active.FindOptionByLongName("name").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Description, ok = p.Active.FindOptionByLongName("description").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Tag, ok = p.Active.FindOptionByLongName("tag").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.Target, ok = p.Active.FindOptionByLongName("target").Value().(string)
+	if !ok {
+		return false
+	}
+	o.EmulatorProjectId, ok = p.Active.FindOptionByLongName("projectId").Value().(string)
+	if !ok {
+		return false
+	}
+	o.File, ok = p.Active.FindOptionByLongName("file").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Force, ok = p.Active.FindOptionByLongName("force").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.Account, ok = p.Active.FindOptionByLongName("accountId").Value().(int)
+	if !ok {
+		return false
+	}
+	o.Transponder, ok = p.Active.FindOptionByLongName("transponderId").Value().(int)
+	if !ok {
+		return false
+	}
+	o.From, ok = p.Active.FindOptionByLongName("from").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Waypoint, ok = p.Active.FindOptionByLongName("waypoint").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.BBox, ok = p.Active.FindOptionByLongName("bbox").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Legs, ok = p.Active.FindOptionByLongName("legs").Value().(int)
+	if !ok {
+		return false
+	}
+	o.Seed, ok = p.Active.FindOptionByLongName("seed").Value().(int64)
+	if !ok {
+		return false
+	}
+	o.Start, ok = p.Active.FindOptionByLongName("startTime").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Timezone, ok = p.Active.FindOptionByLongName("timezone").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Interval, ok = p.Active.FindOptionByLongName("interval").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	o.Speed, ok = p.Active.FindOptionByLongName("speed").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.SpeedJitter, ok = p.Active.FindOptionByLongName("speedJitter").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.Accel, ok = p.Active.FindOptionByLongName("accel").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.SpeedLimit, ok = p.Active.FindOptionByLongName("speedLimit").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.Stop, ok = p.Active.FindOptionByLongName("stop").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	o.Battery, ok = p.Active.FindOptionByLongName("battery").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.BatteryDrain, ok = p.Active.FindOptionByLongName("batteryDrain").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.Odometer, ok = p.Active.FindOptionByLongName("odometer").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.Delay, ok = p.Active.FindOptionByLongName("delay").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"carmalink.com/replaystream/stream"
+	"cloud.google.com/go/firestore"
+)
+
+// supported export --format values besides our own archive
+const (
+	formatArchive = "archive"
+	formatGeoJSON = "geojson"
+	formatKML     = "kml"
+	formatGPX     = "gpx"
+)
+
+// regular position reports, every other type shows up as an event on our maps
+const statusReport = "status"
+
+// a test's reports split up by vehicle, each in reportTimestamp order
+type testRoutes struct {
+	Test     string
+	Vehicles []int
+	Reports  map[int][]FirestoreTransponderReportV1
+}
+
+// read every report_data report of a test for drawing it on a map
+func loadRoutes(ctx context.Context, c *firestore.Client, name string) (*testRoutes, error) {
+	t, err := stream.StoredTest{Store: stream.NewFirestoreStore(c), Name: name}.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newTestRoutes(name, t.Vehicles, t.Reports), nil
+}
+
+// read every report_data report of an archived test for drawing it on a map
+func archiveRoutes(file string) (*testRoutes, error) {
+	vehicles, reports, err := archiveReports(file, SupportedTransponderReports[0])
+	if err != nil {
+		return nil, err
+	}
+	return newTestRoutes("", vehicles, reports), nil
+}
+
+func newTestRoutes(name string, vehicles []int, reports []stream.VehicleReport) *testRoutes {
+	tr := &testRoutes{Test: name, Vehicles: vehicles, Reports: make(map[int][]FirestoreTransponderReportV1)}
+	for _, r := range reports {
+		tr.Reports[r.Vehicle] = append(tr.Reports[r.Vehicle], r.Report)
+	}
+	for _, rs := range tr.Reports {
+		sort.SliceStable(rs, func(i, j int) bool { return rs[i].ReportTimestamp.Before(rs[j].ReportTimestamp) })
+	}
+	return tr
+}
+
+// write routes out in one of our map formats
+func writeRoutes(w io.Writer, tr *testRoutes, format string) error {
+	switch format {
+	case formatGeoJSON:
+		return writeGeoJSON(w, tr)
+	case formatKML:
+		return writeKML(w, tr)
+	case formatGPX:
+		return writeGPX(w, tr)
+	}
+	return fmt.Errorf("unsupported map format %s", format)
+}
+
+// properties carried by every event point
+func eventProperties(vehicle int, r *FirestoreTransponderReportV1) map[string]interface{} {
+	props := map[string]interface{}{
+		"transponder":     vehicle,
+		"type":            r.Type,
+		"speed":           r.Speed,
+		"reportTimestamp": r.ReportTimestamp.Format(time.RFC3339Nano),
+	}
+	if r.Address != "" {
+		props["address"] = r.Address
+	}
+	if len(r.GeoTags) > 0 {
+		props["geoTags"] = r.GeoTags
+	}
+	return props
+}
+
+// a FeatureCollection holding a LineString per vehicle, with coordTimes so track can read it back in,
+// and a Point for every event
+func writeGeoJSON(w io.Writer, tr *testRoutes) error {
+	var features []interface{}
+	for _, v := range tr.Vehicles {
+		var coords [][]float64
+		var times []string
+		var events []interface{}
+		for i := range tr.Reports[v] {
+			r := &tr.Reports[v][i]
+			if r.LatLng == nil {
+				continue
+			}
+			pos := []float64{r.LatLng.GetLongitude(), r.LatLng.GetLatitude()}
+			coords = append(coords, pos)
+			times = append(times, r.ReportTimestamp.Format(time.RFC3339Nano))
+			if r.Type != statusReport {
+				events = append(events, map[string]interface{}{
+					"type":       "Feature",
+					"properties": eventProperties(v, r),
+					"geometry":   map[string]interface{}{"type": "Point", "coordinates": pos},
+				})
+			}
+		}
+		if len(coords) > 0 {
+			features = append(features, map[string]interface{}{
+				"type":       "Feature",
+				"properties": map[string]interface{}{"test": tr.Test, "transponder": v, "coordTimes": times},
+				"geometry":   map[string]interface{}{"type": "LineString", "coordinates": coords},
+			})
+		}
+		features = append(features, events...)
+	}
+	if features == nil {
+		features = []interface{}{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{"type": "FeatureCollection", "features": features})
+}
+
+type kmlDoc struct {
+	XMLName    xml.Name       `xml:"kml"`
+	NS         string         `xml:"xmlns,attr"`
+	Name       string         `xml:"Document>name"`
+	Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name         string       `xml:"name"`
+	TimeStamp    *kmlTime     `xml:"TimeStamp"`
+	ExtendedData *kmlExtended `xml:"ExtendedData"`
+	Point        *kmlCoords   `xml:"Point"`
+	LineString   *kmlCoords   `xml:"LineString"`
+}
+
+type kmlTime struct {
+	When string `xml:"when"`
+}
+
+type kmlExtended struct {
+	Data []kmlData `xml:"Data"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlCoords struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+// a Placemark per vehicle route and one per event, event properties go into ExtendedData
+func writeKML(w io.Writer, tr *testRoutes) error {
+	doc := kmlDoc{NS: "http://www.opengis.net/kml/2.2", Name: tr.Test}
+	for _, v := range tr.Vehicles {
+		var line []string
+		var events []kmlPlacemark
+		for i := range tr.Reports[v] {
+			r := &tr.Reports[v][i]
+			if r.LatLng == nil {
+				continue
+			}
+			coord := csvFloat(r.LatLng.GetLongitude()) + "," + csvFloat(r.LatLng.GetLatitude())
+			line = append(line, coord)
+			if r.Type == statusReport {
+				continue
+			}
+			pm := kmlPlacemark{
+				Name:         r.Type,
+				TimeStamp:    &kmlTime{When: r.ReportTimestamp.Format(time.RFC3339Nano)},
+				ExtendedData: &kmlExtended{},
+				Point:        &kmlCoords{Coordinates: coord},
+			}
+			for _, d := range eventData(v, r) {
+				pm.ExtendedData.Data = append(pm.ExtendedData.Data, kmlData{Name: d[0], Value: d[1]})
+			}
+			events = append(events, pm)
+		}
+		if len(line) > 0 {
+			doc.Placemarks = append(doc.Placemarks, kmlPlacemark{Name: "vehicle " + strconv.Itoa(v), LineString: &kmlCoords{Coordinates: strings.Join(line, " ")}})
+		}
+		doc.Placemarks = append(doc.Placemarks, events...)
+	}
+	return writeXML(w, doc)
+}
+
+type gpxDoc struct {
+	XMLName   xml.Name   `xml:"gpx"`
+	NS        string     `xml:"xmlns,attr"`
+	Version   string     `xml:"version,attr"`
+	Creator   string     `xml:"creator,attr"`
+	Name      string     `xml:"metadata>name"`
+	Waypoints []gpxPoint `xml:"wpt"`
+	Tracks    []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name   string     `xml:"name"`
+	Points []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxPoint struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Time string  `xml:"time,omitempty"`
+	Name string  `xml:"name,omitempty"`
+	Desc string  `xml:"desc,omitempty"`
+	Type string  `xml:"type,omitempty"`
+}
+
+// a track per vehicle and a waypoint per event, event properties go into the waypoint description
+func writeGPX(w io.Writer, tr *testRoutes) error {
+	doc := gpxDoc{NS: "http://www.topografix.com/GPX/1/1", Version: "1.1", Creator: "replaystream", Name: tr.Test}
+	for _, v := range tr.Vehicles {
+		trk := gpxTrack{Name: "vehicle " + strconv.Itoa(v)}
+		for i := range tr.Reports[v] {
+			r := &tr.Reports[v][i]
+			if r.LatLng == nil {
+				continue
+			}
+			pt := gpxPoint{Lat: r.LatLng.GetLatitude(), Lon: r.LatLng.GetLongitude(), Time: r.ReportTimestamp.Format(time.RFC3339Nano)}
+			trk.Points = append(trk.Points, pt)
+			if r.Type == statusReport {
+				continue
+			}
+			var desc []string
+			for _, d := range eventData(v, r) {
+				desc = append(desc, d[0]+": "+d[1])
+			}
+			pt.Name, pt.Type, pt.Desc = r.Type, r.Type, strings.Join(desc, "\n")
+			doc.Waypoints = append(doc.Waypoints, pt)
+		}
+		if len(trk.Points) > 0 {
+			doc.Tracks = append(doc.Tracks, trk)
+		}
+	}
+	return writeXML(w, doc)
+}
+
+// event properties as name/value string pairs for our XML formats
+func eventData(vehicle int, r *FirestoreTransponderReportV1) [][2]string {
+	data := [][2]string{
+		{"transponder", strconv.Itoa(vehicle)},
+		{"type", r.Type},
+		{"speed", csvFloat(r.Speed)},
+		{"reportTimestamp", r.ReportTimestamp.Format(time.RFC3339Nano)},
+	}
+	if r.Address != "" {
+		data = append(data, [2]string{"address", r.Address})
+	}
+	if len(r.GeoTags) > 0 {
+		data = append(data, [2]string{"geoTags", strings.Join(r.GeoTags, ",")})
+	}
+	return data
+}
+
+func writeXML(w io.Writer, doc interface{}) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(doc)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"carmalink.com/replaystream/stream"
+	"cloud.google.com/go/firestore"
+	"github.com/jessevdk/go-flags"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// recreate a test from an archive file (see archive.go) in any Firestore db or emulator
+// the whole archive is validated before anything is written
+func importTest(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsImport
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse import args")
+	}
+	if isEmulatorAddr(opts.Target) && opts.EmulatorProjectId == "" {
+		err := errors.New("importing into an emulator needs its --projectId")
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+
+	// first pass: validate everything, no client needed for that
+	name, docs, err := validateArchive(opts.File)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s archive %s failed validation\n", red("ERROR"), blue(opts.File))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	if opts.As != "" {
+		name = opts.As
+	}
+	fmt.Fprintf(msgOut, "%s archive holds test %s with %s documents\n", green("valid"), blue(name), blue(strconv.Itoa(docs)))
+
+	conf := targetClientConfig(opts.Target, opts.EmulatorProjectId)
+	c, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
+	ref := c.Collection("Tests").Doc(name)
+
+	// deal with an existing test of the same name
+	existing, err := readTest(ctx, ref)
+	if err != nil && !isNotFound(err) {
+		fmt.Fprintf(msgOut, "%s checking for an existing test %s\n", red("ERROR"), blue(name))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	var oldTags []string // tags of the test we're overwriting, swapped out of our tag index once we're done
+	var replaced bool    // the existing test is already gone
+	if existing != nil {
+		switch opts.Conflict {
+		case "skip":
+			fmt.Fprintf(msgOut, "%s test %s already exists, skipping import\n", yellow("WARN"), blue(name))
+			return nil
+		case "overwrite":
+			fmt.Fprintf(msgOut, "%s test %s already exists, overwriting documents\n", yellow("WARN"), blue(name))
+		case "replace":
+			fmt.Fprintf(msgOut, "%s test %s already exists, deleting it first\n", yellow("WARN"), blue(name))
+			_, err = deleteDocTree(ctx, c, ref, false)
+			if err != nil {
+				fmt.Fprintf(msgOut, "%s deleting existing test %s\n", red("ERROR"), blue(name))
+				fmt.Fprintln(msgOut, err)
+				return err
+			}
+			replaced = true
+		default:
+			err = fmt.Errorf("test %s already exists, use --conflict skip|overwrite|replace or --as to import under another name", name)
+			fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+			return err
+		}
+		oldTags = existing.Tag
+	}
+
+	// second pass: write it all out
+	tags, n, err := writeArchiveTest(ctx, c, opts.File, ref)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s importing test %s, %s documents written so far\n", red("ERROR"), blue(name), blue(strconv.Itoa(n)))
+		fmt.Fprintln(msgOut, err)
+		if replaced {
+			// the original test is gone, so are its tags
+			fmt.Fprintf(msgOut, "%s the original test %s was deleted before the import failed\n", red("ERROR"), blue(name))
+			if ierr := adjustTagIndex(ctx, c, oldTags, -1); ierr != nil {
+				fmt.Fprintf(msgOut, "%s updating tag index\n", red("ERROR"))
+				fmt.Fprintln(msgOut, ierr)
+			}
+			return fmt.Errorf("original test %s was deleted: %w", name, err)
+		}
+		return err
+	}
+	err = replaceTagIndex(ctx, c, oldTags, tags)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s updating tag index\n", red("ERROR"))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	fmt.Fprintf(msgOut, "%s imported %s with %s documents\n", green("success"), blue(name), blue(strconv.Itoa(n)))
+	return nil
+}
+
+// read through an entire archive checking its structure and every report against our report schema
+// returns the archived test name and number of documents below it
+func validateArchive(file string) (string, int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	ar, err := newArchiveReader(f)
+	if err != nil {
+		return "", 0, err
+	}
+	var sawTest bool
+	var docs int
+	for {
+		kind, rel, data, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", docs, err
+		}
+		switch kind {
+		case recTest:
+			if sawTest {
+				return "", docs, errors.New("archive holds more than one test document")
+			}
+			sawTest = true
+			if tags, _ := data["Tag"].([]interface{}); len(tags) == 0 {
+				return "", docs, errors.New("test document has no tags")
+			}
+		case recDoc:
+			if !sawTest {
+				return "", docs, errors.New("report documents come before the test document")
+			}
+			docs++
+			if isReportPath(rel) {
+				if err := validateReport(data); err != nil {
+					return "", docs, fmt.Errorf("%s: %s", rel, err)
+				}
+			}
+		}
+	}
+	if !sawTest {
+		return "", docs, errors.New("archive holds no test document")
+	}
+	return ar.Manifest.Test, docs, nil
+}
+
+// stream an archive's test into ref, returns the test's tags and the number of documents written below it so far
+func writeArchiveTest(ctx context.Context, c *firestore.Client, file string, ref *firestore.DocumentRef) ([]string, int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	ar, err := newArchiveReader(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	w := newBatcher(c)
+	var tags []string
+	// documents below the test that made it in, our test document always comes first
+	written := func() int {
+		if w.committed == 0 {
+			return 0
+		}
+		return w.committed - 1
+	}
+	for {
+		kind, rel, data, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return tags, written(), err
+		}
+		stream.ResolveRefs(c, data)
+		dst := ref
+		if kind == recTest {
+			data["Name"] = ref.ID
+			archived, _ := data["Tag"].([]interface{})
+			for _, tag := range archived {
+				if tv, ok := tag.(string); ok {
+					tags = append(tags, tv)
+				}
+			}
+		} else {
+			dst = relDoc(ref, rel)
+		}
+		err = w.set(ctx, dst, data)
+		if err != nil {
+			return tags, written(), err
+		}
+	}
+	err = w.flush(ctx)
+	return tags, written(), err
+}
+
+// true if a path relative to a test document is within one of our report collections
+// ex: report_data/abc or vehicle/83/report_data/abc
+func isReportPath(rel string) bool {
+	parts := strings.Split(rel, "/")
+	if len(parts) < 2 {
+		return false
+	}
+	col := parts[len(parts)-2]
+	for _, r := range SupportedTransponderReports {
+		if col == r {
+			return true
+		}
+	}
+	return false
+}
+
+// check a decoded report against FirestoreTransponderReportV1, every field present must have a compatible type
+// and type/reportTimestamp are required
+func validateReport(data map[string]interface{}) error {
+	if t, ok := data["type"].(string); !ok || t == "" {
+		return errors.New("missing report type")
+	}
+	if _, ok := data["reportTimestamp"].(time.Time); !ok {
+		return errors.New("missing reportTimestamp")
+	}
+	rt := reflect.TypeOf(FirestoreTransponderReportV1{})
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		name := strings.Split(f.Tag.Get("firestore"), ",")[0]
+		v, ok := data[name]
+		if !ok || v == nil {
+			continue
+		}
+		if !reportValueFits(f.Type, v) {
+			return fmt.Errorf("field %s holds a %T, expected %s", name, v, f.Type)
+		}
+	}
+	return nil
+}
+
+func reportValueFits(t reflect.Type, v interface{}) bool {
+	switch {
+	case t == timeType:
+		_, ok := v.(time.Time)
+		return ok
+	case t == latLngType:
+		_, ok := v.(*latlng.LatLng)
+		return ok
+	}
+	switch t.Kind() {
+	case reflect.Float64:
+		switch v.(type) {
+		case float64, int64:
+			return true
+		}
+		return false
+	case reflect.String:
+		_, ok := v.(string)
+		return ok
+	case reflect.Bool:
+		_, ok := v.(bool)
+		return ok
+	case reflect.Slice:
+		vals, ok := v.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, e := range vals {
+			if !reportValueFits(t.Elem(), e) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Methods //
+
+// convert and set user-provided values into opts struct
+func (o *optsImport) set(p *flags.Parser) (ok bool) {
+	o.File, ok = p.Active.FindOptionByLongName("file").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Target, ok = p.Active.FindOptionByLongName("target").Value().(string)
+	if !ok {
+		return false
+	}
+	o.EmulatorProjectId, ok = p.Active.FindOptionByLongName("projectId").Value().(string)
+	if !ok {
+		return false
+	}
+	o.As, ok = p.Active.FindOptionByLongName("as").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Conflict, ok = p.Active.FindOptionByLongName("conflict").Value().(string)
+	if !ok {
+		return false
+	}
+	return true
+}
@@ -2,47 +2,279 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"carmalink.com/replaystream/stream"
+	"cloud.google.com/go/firestore"
 	"github.com/jessevdk/go-flags"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// number of tags Firestore accepts in a single array-contains-any filter
+const maxTagFilters = 10
+
 func list(ctx context.Context, p *flags.Parser) error {
 	// collects args provided by user
 	var opts optsList
 	// populate into struct
 	ok := opts.set(p)
 	if !ok {
-		fmt.Printf("%s cmd line args cannot be parsed!\n", red("ERROR"))
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse list args")
+	}
+	// resolve and validate our filters before connecting
+	err := opts.resolve(now())
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
 	}
 	// create firestore client using source file's project_id and credentials
 	conf := fsClientConfig{c: opts.Source}
-	c := createFirestoreClient(ctx, conf)
-
-	// build query //
-	tests := c.Collection("Tests").Where("Tag", "array-contains", opts.Tag).Limit(opts.Results)
+	c, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
 
 	// run query //
-	testList, err := tests.Documents(ctx).GetAll()
+	// keep scanning until we have a page worth of matches (or everything with --all)
+	var testList []*stream.TestDoc
+	var lastScanned string
+	var more bool
+	err = stream.NewFirestoreStore(c).Tests(ctx, opts.testQuery(), func(t *stream.TestDoc) bool {
+		if !opts.All && len(testList) == opts.Results {
+			more = true
+			return false
+		}
+		lastScanned = t.Name
+		if opts.matchesTest(t) && opts.matches(t.Stats) {
+			testList = append(testList, t)
+		}
+		return true
+	})
 	if err != nil {
-		fmt.Printf("%s querying collection\n", red("ERROR"))
+		fmt.Fprintf(msgOut, "%s querying collection\n", red("ERROR"))
+		fmt.Fprintln(msgOut, err)
+		if status.Code(err) == codes.FailedPrecondition {
+			fmt.Fprintf(msgOut, "%s sorting by %s while filtering on tags needs a composite index on Tests: %s Arrays, %s\n",
+				yellow("HINT"), blue(opts.Sort), blue("Tag"), blue(opts.sortField()))
+		}
+		return err
 	}
-	fmt.Printf("Search results for tag: %s\n", yellow(opts.Tag))
+	if structuredOutput() {
+		rw := newRecordWriter(args.Output)
+		for _, t := range testList {
+			if err := rw.write(newListRecord(t)); err != nil {
+				return err
+			}
+		}
+		if more {
+			fmt.Fprintf(msgOut, "%s : %s\n", blue("next page"), yellow(lastScanned))
+		}
+		return rw.close()
+	}
+	fmt.Fprintf(msgOut, "Search results for tags: %s (%s)\n", yellow(strings.Join(opts.Tag, ", ")), opts.Match)
 	// pretty print results //
-	for _, doc := range testList {
-		data := doc.Data()
-		name, ok := data["Name"].(string)
-		if !ok {
-			fmt.Printf("%s no name key found %v\n", red("ERROR"), data)
-			continue
+	for _, t := range testList {
+		fmt.Fprintf(msgOut, "%s : %v\n", blue("name"), green(t.Name))
+		if opts.Long {
+			printStats(t.Stats, "    ")
 		}
-		fmt.Printf("%s : %v\n", blue("name"), green(name))
+	}
+	if more {
+		fmt.Fprintf(msgOut, "%s : %s\n", blue("next page"), yellow(lastScanned))
 	}
 	return nil
 }
 
+// a single test as emitted by list in structured output modes
+type listRecord struct {
+	Name         string
+	Description  string
+	Tags         []string
+	Account      int
+	Transponders []int
+	StartTime    time.Time
+	EndTime      time.Time
+	Created      time.Time
+	Stats        *testStats `json:",omitempty"`
+}
+
+func newListRecord(t *stream.TestDoc) listRecord {
+	r := listRecord{
+		Name:         t.Name,
+		Description:  t.Description,
+		Tags:         t.Tag,
+		Account:      t.Account,
+		Transponders: t.Transponders,
+		StartTime:    t.StartTime,
+		EndTime:      t.EndTime,
+		Created:      t.Created,
+		Stats:        t.Stats,
+	}
+	if len(r.Transponders) == 0 && t.Transponder != 0 { // tests copied before multi vehicle support
+		r.Transponders = []int{t.Transponder}
+	}
+	return r
+}
+
+func (r listRecord) csvHeader() []string {
+	return []string{"name", "description", "tags", "account", "transponders", "startTime", "endTime", "created",
+		"docs", "durationSec", "distance", "maxSpeed"}
+}
+
+func (r listRecord) csvRow() []string {
+	xs := make([]string, len(r.Transponders))
+	for i, x := range r.Transponders {
+		xs[i] = strconv.Itoa(x)
+	}
+	row := []string{r.Name, r.Description, strings.Join(r.Tags, ";"), strconv.Itoa(r.Account), strings.Join(xs, ";"),
+		csvTime(r.StartTime), csvTime(r.EndTime), csvTime(r.Created)}
+	if r.Stats == nil {
+		return append(row, "", "", "", "")
+	}
+	return append(row, strconv.Itoa(r.Stats.Docs), csvFloat(r.Stats.DurationSec), csvFloat(r.Stats.Distance), csvFloat(r.Stats.MaxSpeed))
+}
+
+// tags, sorting, name prefix and our page cursor are handed to the store
+func (o *optsList) testQuery() stream.TestQuery {
+	return stream.TestQuery{Tags: o.Tag, MatchAll: o.Match == "all", Prefix: o.Prefix, Sort: o.Sort, Desc: o.Desc, After: o.PageToken}
+}
+
+// print a test's statistics, each line prefixed with indent
+func printStats(s *testStats, indent string) {
+	if s == nil {
+		fmt.Fprintf(msgOut, "%s%s\n", indent, yellow("no statistics stored for this test"))
+		return
+	}
+	fmt.Fprintf(msgOut, "%s%s : %s\n", indent, blue("docs"), green(strconv.Itoa(s.Docs)))
+	types := make([]string, 0, len(s.DocsByType))
+	for t := range s.DocsByType {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(msgOut, "%s  %s : %s\n", indent, blue(t), green(strconv.Itoa(s.DocsByType[t])))
+	}
+	fmt.Fprintf(msgOut, "%s%s : %s -> %s (%s)\n", indent, blue("reports"),
+		green(s.FirstReport.Format(time.RFC3339)), green(s.LastReport.Format(time.RFC3339)),
+		green((time.Duration(s.DurationSec) * time.Second).String()))
+	fmt.Fprintf(msgOut, "%s%s : %s\n", indent, blue("distance"), green(strconv.FormatFloat(s.Distance, 'f', 1, 64)))
+	fmt.Fprintf(msgOut, "%s%s : %s\n", indent, blue("max speed"), green(strconv.FormatFloat(s.MaxSpeed, 'f', 1, 64)))
+	if s.BoundingBox != nil {
+		b := s.BoundingBox
+		fmt.Fprintf(msgOut, "%s%s : %s\n", indent, blue("bounds"), green(fmt.Sprintf("%.5f,%.5f %.5f,%.5f", b.MinLat, b.MinLng, b.MaxLat, b.MaxLng)))
+	}
+	if s.IngestDelay != nil {
+		d := s.IngestDelay
+		fmt.Fprintf(msgOut, "%s%s : %s\n", indent, blue("ingest delay ms"),
+			green(fmt.Sprintf("min %.0f / median %.0f / p95 %.0f / max %.0f", d.MinMs, d.MedianMs, d.P95Ms, d.MaxMs)))
+	}
+}
+
 // Methods //
 
+// stored field (or document id) a --sort option orders by
+func (o *optsList) sortField() string {
+	switch o.Sort {
+	case "start":
+		return "StartTime"
+	case "end":
+		return "EndTime"
+	case "created":
+		return "Created"
+	default:
+		return firestore.DocumentID
+	}
+}
+
+// validate our options and resolve user-provided time strings
+func (o *optsList) resolve(ref time.Time) error {
+	if len(o.Tag) > maxTagFilters && o.Match == "any" {
+		return fmt.Errorf("at most %d tags can be matched with --match any", maxTagFilters)
+	}
+	loc, err := time.LoadLocation(o.Timezone)
+	if err != nil {
+		return fmt.Errorf("unknown timezone %q: %s", o.Timezone, err)
+	}
+	for _, t := range []struct {
+		flag string
+		in   string
+		out  *time.Time
+	}{
+		{"--from", o.From, &o.FromTime},
+		{"--to", o.To, &o.ToTime},
+		{"--createdAfter", o.CreatedAfter, &o.CreatedAfterTime},
+		{"--createdBefore", o.CreatedBefore, &o.CreatedBeforeTime},
+	} {
+		if t.in == "" {
+			continue
+		}
+		*t.out, err = parseTimeSpec(t.in, loc, ref)
+		if err != nil {
+			return fmt.Errorf("%s: %s", t.flag, err)
+		}
+	}
+	if !o.FromTime.IsZero() && !o.ToTime.IsZero() && o.FromTime.After(o.ToTime) {
+		return errors.New("--from is after --to")
+	}
+	return nil
+}
+
+// client side filters on a test document: capture window and creation date
+func (o *optsList) matchesTest(t *stream.TestDoc) bool {
+	// captured window must overlap [from, to]
+	if !o.FromTime.IsZero() && t.EndTime.Before(o.FromTime) {
+		return false
+	}
+	if !o.ToTime.IsZero() && t.StartTime.After(o.ToTime) {
+		return false
+	}
+	if !o.CreatedAfterTime.IsZero() && t.Created.Before(o.CreatedAfterTime) {
+		return false
+	}
+	if !o.CreatedBeforeTime.IsZero() && t.Created.After(o.CreatedBeforeTime) {
+		return false
+	}
+	return true
+}
+
+// true if any statistics based filters were requested
+func (o *optsList) filtering() bool {
+	return o.MinDocs > 0 || o.MinDuration > 0 || o.MaxDuration > 0 || o.MinDistance > 0 || o.MinSpeed > 0 || o.HasType != ""
+}
+
+// see if a test's statistics satisfy our filters, tests without stats only match when we aren't filtering
+func (o *optsList) matches(s *testStats) bool {
+	if !o.filtering() {
+		return true
+	}
+	if s == nil {
+		return false
+	}
+	d := time.Duration(s.DurationSec * float64(time.Second))
+	switch {
+	case s.Docs < o.MinDocs:
+		return false
+	case o.MinDuration > 0 && d < o.MinDuration:
+		return false
+	case o.MaxDuration > 0 && d > o.MaxDuration:
+		return false
+	case s.Distance < o.MinDistance:
+		return false
+	case s.MaxSpeed < o.MinSpeed:
+		return false
+	case o.HasType != "" && s.DocsByType[o.HasType] == 0:
+		return false
+	}
+	return true
+}
+
 // convert and set user-provided values into opts struct
 func (o *optsList) set(p *flags.Parser) (ok bool) {
 	o.Source, ok = p.Active.FindOptionByLongName("source").Value().(string)
@@ -53,7 +285,79 @@ func (o *optsList) set(p *flags.Parser) (ok bool) {
 	if !ok {
 		return false
 	}
-	o.Tag, ok = p.Active.FindOptionByLongName("tag").Value().(string)
+	o.Tag, ok = p.Active.FindOptionByLongName("tag").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.Match, ok = p.Active.FindOptionByLongName("match").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Prefix, ok = p.Active.FindOptionByLongName("prefix").Value().(string)
+	if !ok {
+		return false
+	}
+	o.From, ok = p.Active.FindOptionByLongName("from").Value().(string)
+	if !ok {
+		return false
+	}
+	o.To, ok = p.Active.FindOptionByLongName("to").Value().(string)
+	if !ok {
+		return false
+	}
+	o.CreatedAfter, ok = p.Active.FindOptionByLongName("createdAfter").Value().(string)
+	if !ok {
+		return false
+	}
+	o.CreatedBefore, ok = p.Active.FindOptionByLongName("createdBefore").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Timezone, ok = p.Active.FindOptionByLongName("timezone").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Sort, ok = p.Active.FindOptionByLongName("sort").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Desc, ok = p.Active.FindOptionByLongName("desc").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.PageToken, ok = p.Active.FindOptionByLongName("page-token").Value().(string)
+	if !ok {
+		return false
+	}
+	o.All, ok = p.Active.FindOptionByLongName("all").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.Long, ok = p.Active.FindOptionByLongName("long").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.MinDocs, ok = p.Active.FindOptionByLongName("minDocs").Value().(int)
+	if !ok {
+		return false
+	}
+	o.MinDuration, ok = p.Active.FindOptionByLongName("minDuration").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	o.MaxDuration, ok = p.Active.FindOptionByLongName("maxDuration").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	o.MinDistance, ok = p.Active.FindOptionByLongName("minDistance").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.MinSpeed, ok = p.Active.FindOptionByLongName("minSpeed").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.HasType, ok = p.Active.FindOptionByLongName("hasType").Value().(string)
 	if !ok {
 		return false
 	}
@@ -6,73 +6,271 @@ import (
 	"os"
 	"time"
 
+	"carmalink.com/replaystream/stream"
 	"github.com/fatih/color"
 	"github.com/jessevdk/go-flags"
-	"google.golang.org/genproto/googleapis/type/latlng"
 )
 
 type optsBase struct {
 	Verbose  bool         `short:"v" long:"verbose" description:"enable verbose output"`
+	Output   string       `short:"o" long:"output" description:"output format, structured formats write records to stdout and messages to stderr" choice:"table" choice:"json" choice:"ndjson" choice:"csv" default:"table"`
+	NoColor  bool         `long:"no-color" description:"disable colored output, automatic when stdout isn't a terminal"`
 	Copy     optsCopy     `command:"copy" description:"copy interesting data into Firestore (preferrably test-latinum)"`
 	Replay   optsReplay   `command:"replay" description:"replay interesting data from Firestore (test-latinum) into Firestore emulator with re-written reportTimestamps"`
 	List     optsList     `command:"list" description:"list available replays from within test-latinum Firestore db"`
 	ListTags optsListTags `command:"tags" description:"list all tags available in test db, start here :)"`
+	Show     optsShow     `command:"show" description:"show everything about a single test: metadata, statistics and a sampled timeline"`
+	Delete   optsDelete   `command:"delete" description:"delete a test along with all of its reports"`
+	Rename   optsRename   `command:"rename" description:"rename a test"`
+	Clone    optsClone    `command:"clone" description:"copy a test and all of its reports to a new name"`
+	Tag      optsTag      `command:"tag" description:"add or remove tags on an existing test"`
+	Export   optsExport   `command:"export" description:"export a test and all of its reports to an archive file, or its routes to GeoJSON, KML or GPX"`
+	Import   optsImport   `command:"import" description:"import a test from an archive file into Firestore or a local emulator"`
+	Track    optsTrack    `command:"track" description:"create a synthetic test from a GPX, KML or GeoJSON route"`
+	Generate optsGenerate `command:"generate" description:"generate a synthetic trip from a simple vehicle model, into Firestore or an archive file"`
+	Report   optsReport   `command:"report" description:"write a self-contained HTML trip report with a route map, charts and an event timeline"`
+	Watch    optsWatch    `command:"watch" description:"listen for reports landing in a target db and measure their end to end delay"`
+	Suite    optsSuite    `command:"suite" description:"run every test matching some tags as a regression suite"`
+	Record   optsRecord   `command:"record" description:"record a live test drive into a test as its reports arrive"`
+	Mirror   optsMirror   `command:"mirror" description:"mirror live reports from source vehicles into a local emulator, rewritten like replay"`
 }
 type optsCopy struct {
-	Transponder int       `short:"x" long:"transponderId" description:"cartwheel's transponder id (aka webId)" required:"true"`
-	Account     int       `short:"a" long:"accountId" description:"account id transponder belongs to" required:"true"`
-	Stime       int64     `short:"s" long:"startTime" description:"milliseconds unix epoch" required:"true"`
-	Etime       int64     `short:"e" long:"endTime" description:"milliseconds unix epoch" required:"true"`
-	Description string    `short:"d" long:"description" description:"Short description of test data"`
-	Name        string    `short:"n" long:"name" description:"Name this test data chunk" required:"true"`
-	Source      string    `short:"b" long:"source" description:"Source Firestore db serivce account file" required:"true"`
-	Target      string    `short:"g" long:"target" description:"Target (use test-latinum!!) Firestore db service account file" required:"true"`
-	Tag         []string  `short:"t" long:"tag" description:"Add provided tag(s) to test ex: '-t e2e -t smoke_test'" required:"true"`
-	StartTime   time.Time // contains Stime type-converted into time.Time
-	EndTime     time.Time // contains Etime type-converted into time.Time
+	Transponders []int      `short:"x" long:"transponderId" description:"cartwheel's transponder id (aka webId), repeat to copy several vehicles ex: '-x 83 -x 84'"`
+	AllVehicles  bool       `long:"allVehicles" description:"copy every vehicle under --accountId"`
+	Account      int        `short:"a" long:"accountId" description:"account id transponder belongs to" required:"true"`
+	Start        string     `short:"s" long:"startTime" description:"epoch millis, RFC3339, local time '2006-01-02 15:04:05' or relative ex: 'now-30m', '-s=-2h' (a bare '-2h' reads as a flag)" required:"true" firestore:"-"`
+	End          string     `short:"e" long:"endTime" description:"same formats as --startTime, use this or --duration" firestore:"-"`
+	Duration     string     `long:"duration" description:"length of capture starting at --startTime ex: '15m', '1h30m', '1d'" firestore:"-"`
+	Timezone     string     `short:"z" long:"timezone" description:"IANA timezone used for local time strings ex: 'America/Denver'" default:"UTC" firestore:"-"`
+	Description  string     `short:"d" long:"description" description:"Short description of test data"`
+	Name         string     `short:"n" long:"name" description:"Name this test data chunk" required:"true"`
+	Source       string     `short:"b" long:"source" description:"Source Firestore db serivce account file" required:"true"`
+	Target       string     `short:"g" long:"target" description:"Target (use test-latinum!!) Firestore db service account file" required:"true"`
+	Tag          []string   `short:"t" long:"tag" description:"Add provided tag(s) to test ex: '-t e2e -t smoke_test'" required:"true"`
+	Type         []string   `short:"y" long:"type" description:"Only copy reports of provided type(s) ex: '-y status -y speeding', default is all types"`
+	IncStart     bool       `long:"includeStart" description:"include reports exactly at --startTime (default is exclusive)"`
+	IncEnd       bool       `long:"includeEnd" description:"include reports exactly at --endTime (default is exclusive)"`
+	Stime        int64      // StartTime in milliseconds unix epoch
+	Etime        int64      // EndTime in milliseconds unix epoch
+	StartTime    time.Time  // contains Start resolved into UTC time.Time
+	EndTime      time.Time  // contains End (or Start + Duration) resolved into UTC time.Time
+	Transponder  int        // first (or only) transponder copied, kept for single vehicle tests
+	MultiVehicle bool       // true if reports are stored per vehicle under Tests/{name}/vehicle/{transponderId}
+	Stats        *testStats `firestore:",omitempty"`       // summary of copied reports, set once copy completes
+	Created      time.Time  `firestore:",serverTimestamp"` // set by Firestore when the test document is written
 }
 type optsReplay struct {
-	Name              string `short:"n" long:"name" description:"Name of test packet to replay" required:"true"`
-	Transponder       int    `short:"x" long:"transponderId" description:"transponder serial number to replay onto" required:"true"`
-	Account           int    `short:"a" long:"accountId" description:"account id to replay data onto" required:"true"`
-	Target            string `short:"g" long:"target" description:"Target env-latinum Firestore db service account file" required:"true"`
-	EmulatorProjectId string `short:"p" long:"projectId" description:"projectId used when starting your local firebase emulator" required:"true"`
-	Source            string `short:"b" long:"source" description:"Source Test Firestore db 'host:port' string" required:"true"`
-	TargetEmulator    bool   // true if we detect a localhost:port string as target
+	Name              string        `short:"n" long:"name" description:"Name of test packet to replay, required unless using --from-file"`
+	Transponder       int           `short:"x" long:"transponderId" description:"transponder serial number to replay onto (single vehicle tests)"`
+	Map               []string      `short:"m" long:"map" description:"map a test vehicle onto a target transponder for multi vehicle tests ex: '-m 83:1337 -m 84:1338'"`
+	Account           int           `short:"a" long:"accountId" description:"account id to replay data onto" required:"true"`
+	Target            string        `short:"g" long:"target" description:"Target env-latinum Firestore db service account file" required:"true"`
+	EmulatorProjectId string        `short:"p" long:"projectId" description:"projectId used when starting your local firebase emulator" required:"true"`
+	Source            string        `short:"b" long:"source" description:"Source Test Firestore db service account file, required unless using --from-file"`
+	FromFile          string        `short:"f" long:"from-file" description:"replay from a local test archive (see export) instead of a Test Firestore db"`
+	SkipVerify        bool          `long:"skip-verify" description:"don't read back and verify written reports once replay is done"`
+	Tolerance         time.Duration `long:"tolerance" description:"how far off schedule a report may land before verification flags it" default:"2s"`
+	Expect            []string      `long:"expect" description:"wait for downstream documents once replay is done ex: --expect 'account/{account}/alerts: type == speeding'"`
+	Scenario          string        `long:"scenario" description:"JSON file of assertions to wait for once replay is done, see README"`
+	AssertTimeout     time.Duration `long:"assertTimeout" description:"how long each assertion waits for its documents unless it sets its own timeout" default:"60s"`
+	JUnit             string        `long:"junit" description:"write a JUnit XML report of the replay, verification and assertions to this file"`
+	Results           string        `long:"results" description:"write a JSON summary of the replay, verification and assertions to this file"`
+	TargetEmulator    bool          // true if we detect a localhost:port string as target
 }
 type optsList struct {
-	Source  string `short:"b" long:"source" description:"Test data Firestore service account file (test-latinum project most likely...)" required:"true"`
-	Tag     string `short:"t" long:"tag" description:"List results matching provided tag" required:"true"`
-	Results int    `short:"r" long:"results" description:"Number of results to show, default of 10" default:"10"`
+	Source            string        `short:"b" long:"source" description:"Test data Firestore service account file (test-latinum project most likely...)" required:"true"`
+	Tag               []string      `short:"t" long:"tag" description:"List results matching provided tag(s) ex: '-t e2e -t smoke_test'"`
+	Match             string        `long:"match" description:"match tests having any or all of the provided tags" choice:"any" choice:"all" default:"any"`
+	Prefix            string        `short:"p" long:"prefix" description:"only tests whose name starts with this"`
+	From              string        `long:"from" description:"only tests whose captured time range overlaps this start, same formats as copy --startTime"`
+	To                string        `long:"to" description:"only tests whose captured time range overlaps this end, same formats as copy --startTime"`
+	CreatedAfter      string        `long:"createdAfter" description:"only tests created after this time"`
+	CreatedBefore     string        `long:"createdBefore" description:"only tests created before this time"`
+	Timezone          string        `short:"z" long:"timezone" description:"IANA timezone used for local time strings" default:"UTC"`
+	Sort              string        `long:"sort" description:"sort results by" choice:"name" choice:"start" choice:"end" choice:"created" default:"name"`
+	Desc              bool          `long:"desc" description:"sort in descending order"`
+	PageToken         string        `long:"page-token" description:"continue listing after a previous page, use the 'next page' value printed by the last run"`
+	All               bool          `long:"all" description:"list every matching test, ignores --results"`
+	Results           int           `short:"r" long:"results" description:"Number of results to show, default of 10" default:"10"`
+	Long              bool          `short:"l" long:"long" description:"show stored statistics for each test"`
+	MinDocs           int           `long:"minDocs" description:"only tests with at least this many reports"`
+	MinDuration       time.Duration `long:"minDuration" description:"only tests spanning at least this long ex: '5m'"`
+	MaxDuration       time.Duration `long:"maxDuration" description:"only tests spanning at most this long ex: '1h'"`
+	MinDistance       float64       `long:"minDistance" description:"only tests covering at least this odometer distance"`
+	MinSpeed          float64       `long:"minSpeed" description:"only tests with a max speed of at least this"`
+	HasType           string        `long:"hasType" description:"only tests containing reports of this type ex: 'speeding'"`
+	FromTime          time.Time     // From resolved into UTC time.Time
+	ToTime            time.Time     // To resolved into UTC time.Time
+	CreatedAfterTime  time.Time     // CreatedAfter resolved into UTC time.Time
+	CreatedBeforeTime time.Time     // CreatedBefore resolved into UTC time.Time
 }
 type optsListTags struct {
 	Source  string `short:"b" long:"source" description:"Test data Firestore service account file (test-latinum project most likely...)" required:"true"`
-	Results int    `short:"r" long:"results" description:"Number of results to show, default of 10" default:"10"`
+	Results int    `short:"r" long:"results" description:"Number of tags to show, default of 10, 0 shows all" default:"10"`
+	Sort    string `long:"sort" description:"sort tags by usage count or name" choice:"count" choice:"name" default:"count"`
+	Scan    bool   `long:"scan" description:"count tags by scanning every test instead of reading the tag index"`
+	Rebuild bool   `long:"rebuild" description:"scan every test and rewrite the tag index from scratch"`
+}
+type optsShow struct {
+	Source  string `short:"b" long:"source" description:"Test data Firestore service account file (test-latinum project most likely...)" required:"true"`
+	Name    string `short:"n" long:"name" description:"Name of test to show" required:"true"`
+	JSON    bool   `short:"j" long:"json" description:"print test details as JSON"`
+	Samples int    `short:"s" long:"samples" description:"Number of reports to sample into the timeline, 0 shows all" default:"20"`
+}
+type optsDelete struct {
+	Source  string `short:"b" long:"source" description:"Test data Firestore service account file (test-latinum project most likely...)" required:"true"`
+	Name    string `short:"n" long:"name" description:"Name of test to delete" required:"true"`
+	Yes     bool   `short:"y" long:"yes" description:"don't ask for confirmation"`
+	Shallow bool   `long:"shallow" description:"only look for subcollections below the test and its vehicles, faster on big tests but skips anything nested below reports"`
+}
+type optsRename struct {
+	Source  string `short:"b" long:"source" description:"Test data Firestore service account file (test-latinum project most likely...)" required:"true"`
+	Name    string `short:"n" long:"name" description:"Current name of test" required:"true"`
+	To      string `long:"to" description:"New name of test" required:"true"`
+	Shallow bool   `long:"shallow" description:"only look for subcollections below the test and its vehicles, faster on big tests but skips anything nested below reports"`
+}
+type optsClone struct {
+	Source  string `short:"b" long:"source" description:"Test data Firestore service account file (test-latinum project most likely...)" required:"true"`
+	Target  string `short:"g" long:"target" description:"Firestore service account file to clone into, default is --source"`
+	Name    string `short:"n" long:"name" description:"Name of test to clone" required:"true"`
+	To      string `long:"to" description:"Name of the new test" required:"true"`
+	Shallow bool   `long:"shallow" description:"only look for subcollections below the test and its vehicles, faster on big tests but skips anything nested below reports"`
+}
+type optsTag struct {
+	Add    optsTagEdit `command:"add" description:"add tag(s) to a test"`
+	Remove optsTagEdit `command:"remove" description:"remove tag(s) from a test"`
+}
+type optsTagEdit struct {
+	Source string   `short:"b" long:"source" description:"Test data Firestore service account file (test-latinum project most likely...)" required:"true"`
+	Name   string   `short:"n" long:"name" description:"Name of test" required:"true"`
+	Tag    []string `short:"t" long:"tag" description:"tag(s) to add or remove ex: '-t e2e -t smoke_test'" required:"true"`
+}
+type optsExport struct {
+	Source  string `short:"b" long:"source" description:"Test data Firestore service account file (test-latinum project most likely...)" required:"true"`
+	Name    string `short:"n" long:"name" description:"Name of test to export" required:"true"`
+	File    string `short:"f" long:"file" description:"file to write, default is the test name with a .ndjson.gz (or --format) extension"`
+	Force   bool   `long:"force" description:"overwrite an existing file"`
+	Format  string `long:"format" description:"a full archive, or just the test's routes and events for a map tool" choice:"archive" choice:"geojson" choice:"kml" choice:"gpx" default:"archive"`
+	Shallow bool   `long:"shallow" description:"only look for subcollections below the test and its vehicles, faster on big tests but skips anything nested below reports"`
+}
+type optsImport struct {
+	File              string `short:"f" long:"file" description:"archive file to import" required:"true"`
+	Target            string `short:"g" long:"target" description:"Target Firestore db service account file, or emulator 'host:port' string" required:"true"`
+	EmulatorProjectId string `short:"p" long:"projectId" description:"projectId used when starting your local firebase emulator, only used with an emulator target"`
+	As                string `long:"as" description:"import the test under this name instead of its archived one"`
+	Conflict          string `long:"conflict" description:"what to do if the test already exists: fail, skip, overwrite its documents or replace it entirely" choice:"fail" choice:"skip" choice:"overwrite" choice:"replace" default:"fail"`
+}
+type optsTrack struct {
+	File              string        `short:"f" long:"file" description:"GPX, KML or GeoJSON file holding the route" required:"true"`
+	Format            string        `long:"format" description:"route file format, auto goes by the file extension" choice:"auto" choice:"gpx" choice:"kml" choice:"geojson" default:"auto"`
+	Name              string        `short:"n" long:"name" description:"Name this test" required:"true"`
+	Description       string        `short:"d" long:"description" description:"Short description of test data"`
+	Tag               []string      `short:"t" long:"tag" description:"Add provided tag(s) to test ex: '-t e2e -t geofence'" required:"true"`
+	Target            string        `short:"g" long:"target" description:"Target Firestore db service account file, or emulator 'host:port' string" required:"true"`
+	EmulatorProjectId string        `short:"p" long:"projectId" description:"projectId used when starting your local firebase emulator, only used with an emulator target"`
+	Account           int           `short:"a" long:"accountId" description:"account id stored on the test"`
+	Transponder       int           `short:"x" long:"transponderId" description:"transponder id the reports claim to come from" required:"true"`
+	Start             string        `short:"s" long:"startTime" description:"time of the first report, same formats as copy --startTime. Default is the route's own timestamps, or now"`
+	Timezone          string        `short:"z" long:"timezone" description:"IANA timezone used for local time strings" default:"UTC"`
+	Interval          time.Duration `short:"i" long:"interval" description:"report cadence ex: '5s'" default:"10s"`
+	Speed             float64       `long:"speed" description:"speed in km/h used for routes without timestamps" default:"50"`
+	SpeedLimit        float64       `long:"speedLimit" description:"speedLimit in km/h set on every report"`
+	Odometer          float64       `long:"odometer" description:"odometer in km at the first report"`
+	Type              string        `short:"y" long:"type" description:"report type" default:"status"`
+	Delay             time.Duration `long:"delay" description:"simulated ingest delay between reportTimestamp and fsCreateTimestamp" default:"1s"`
+}
+type optsGenerate struct {
+	Name              string        `short:"n" long:"name" description:"Name this test" required:"true"`
+	Description       string        `short:"d" long:"description" description:"Short description of test data"`
+	Tag               []string      `short:"t" long:"tag" description:"Add provided tag(s) to test ex: '-t load -t synthetic'" required:"true"`
+	Target            string        `short:"g" long:"target" description:"Target Firestore db service account file, or emulator 'host:port' string"`
+	EmulatorProjectId string        `short:"p" long:"projectId" description:"projectId used when starting your local firebase emulator, only used with an emulator target"`
+	File              string        `short:"f" long:"file" description:"write the test to this archive file instead of a Firestore db"`
+	Force             bool          `long:"force" description:"overwrite an existing archive file"`
+	Account           int           `short:"a" long:"accountId" description:"account id stored on the test"`
+	Transponder       int           `short:"x" long:"transponderId" description:"transponder id the reports claim to come from" required:"true"`
+	From              string        `long:"from" description:"starting point 'lat,lng', default is the first --waypoint or a random point within --bbox"`
+	Waypoint          []string      `short:"w" long:"waypoint" description:"drive through these 'lat,lng' points in order ex: '-w 39.74,-104.99 -w 39.75,-105.0'"`
+	BBox              string        `long:"bbox" description:"random walk within 'minLat,minLng,maxLat,maxLng' instead of --waypoints"`
+	Legs              int           `long:"legs" description:"number of random walk legs within --bbox" default:"5"`
+	Seed              int64         `long:"seed" description:"random seed to reproduce a trip, default is based on the current time"`
+	Start             string        `short:"s" long:"startTime" description:"time of the first report, same formats as copy --startTime, default is now"`
+	Timezone          string        `short:"z" long:"timezone" description:"IANA timezone used for local time strings" default:"UTC"`
+	Interval          time.Duration `short:"i" long:"interval" description:"status report cadence ex: '5s'" default:"10s"`
+	Speed             float64       `long:"speed" description:"cruising speed in km/h" default:"60"`
+	SpeedJitter       float64       `long:"speedJitter" description:"cruising speed wanders up to this many km/h either way" default:"10"`
+	Accel             float64       `long:"accel" description:"acceleration and braking in m/s²" default:"2"`
+	SpeedLimit        float64       `long:"speedLimit" description:"speedLimit in km/h, exceeding it sends speeding events, 0 disables them" default:"65"`
+	Stop              time.Duration `long:"stop" description:"time parked at each waypoint" default:"2m"`
+	Battery           float64       `long:"battery" description:"resting battery voltage at the start" default:"12.6"`
+	BatteryDrain      float64       `long:"batteryDrain" description:"resting battery voltage lost per hour parked" default:"0.5"`
+	Odometer          float64       `long:"odometer" description:"odometer in km at the first report"`
+	Delay             time.Duration `long:"delay" description:"simulated ingest delay between reportTimestamp and fsCreateTimestamp" default:"1s"`
+}
+type optsReport struct {
+	Source   string `short:"b" long:"source" description:"Test data Firestore service account file (test-latinum project most likely...), required unless using --from-file"`
+	Name     string `short:"n" long:"name" description:"Name of test to report on, required unless using --from-file"`
+	FromFile string `short:"f" long:"from-file" description:"report on a local test archive (see export) instead of a Test Firestore db"`
+	HTML     string `long:"html" description:"HTML file to write, default is the test name with a .html extension"`
+	Force    bool   `long:"force" description:"overwrite an existing HTML file"`
+}
+type optsWatch struct {
+	Target            string        `short:"g" long:"target" description:"Firestore db service account file, or emulator 'host:port' string" required:"true"`
+	EmulatorProjectId string        `short:"p" long:"projectId" description:"projectId used when starting your local firebase emulator, only used with an emulator target"`
+	Account           int           `short:"a" long:"accountId" description:"only reports of this account"`
+	Vehicle           []int         `short:"x" long:"transponderId" description:"only reports of these transponder(s) ex: '-x 1337 -x 1338'"`
+	Type              []string      `short:"y" long:"type" description:"only reports of these type(s) ex: '-y status', default is all types"`
+	Existing          bool          `long:"existing" description:"also measure reports already there when we start listening"`
+	For               time.Duration `long:"for" description:"stop watching after this long ex: '10m', default is until interrupted"`
+	Count             int           `long:"count" description:"stop watching after this many reports"`
+}
+type optsRecord struct {
+	Account           int           `short:"a" long:"accountId" description:"account id the vehicle(s) belong to" required:"true"`
+	Transponders      []int         `short:"x" long:"transponderId" description:"transponder(s) to record, repeat for several vehicles ex: '-x 83 -x 84'" required:"true"`
+	Name              string        `short:"n" long:"name" description:"Name this test, it must not exist yet" required:"true"`
+	Description       string        `short:"d" long:"description" description:"Short description of test data"`
+	Tag               []string      `short:"t" long:"tag" description:"Add provided tag(s) to test ex: '-t e2e -t smoke_test'" required:"true"`
+	Type              []string      `short:"y" long:"type" description:"Only record reports of provided type(s) ex: '-y status -y speeding', default is all types"`
+	Source            string        `short:"b" long:"source" description:"Source Firestore db service account file, or emulator 'host:port' string" required:"true"`
+	Target            string        `short:"g" long:"target" description:"Target (use test-latinum!!) Firestore db service account file, or emulator 'host:port' string" required:"true"`
+	EmulatorProjectId string        `short:"p" long:"projectId" description:"projectId used when starting your local firebase emulator, only used with an emulator source or target"`
+	For               time.Duration `long:"for" description:"stop recording after this long ex: '30m', default is until interrupted"`
+}
+type optsMirror struct {
+	Account           int           `short:"a" long:"accountId" description:"account id the source vehicle(s) belong to" required:"true"`
+	TargetAccount     int           `long:"targetAccountId" description:"account id to mirror onto, default is --accountId"`
+	Transponders      []int         `short:"x" long:"transponderId" description:"source transponder(s) to mirror ex: '-x 83 -x 84'" required:"true"`
+	Map               []string      `short:"m" long:"map" description:"mirror a source vehicle onto another target transponder ex: '-m 83:1337', default is the same id"`
+	Type              []string      `short:"y" long:"type" description:"Only mirror reports of provided type(s) ex: '-y status -y speeding', default is all types"`
+	Source            string        `short:"b" long:"source" description:"Source Firestore db service account file, or emulator 'host:port' string" required:"true"`
+	Target            string        `short:"g" long:"target" description:"Target Firestore emulator 'host:port' string" required:"true"`
+	EmulatorProjectId string        `short:"p" long:"projectId" description:"projectId used when starting your local firebase emulator" required:"true"`
+	Delay             time.Duration `long:"delay" description:"hold each report back this long before writing it ex: '30s'"`
+	For               time.Duration `long:"for" description:"stop mirroring after this long ex: '1h', default is until interrupted"`
+}
+type optsSuite struct {
+	Run optsSuiteRun `command:"run" description:"replay and verify every test matching the provided tag(s), then write one aggregated report"`
+}
+type optsSuiteRun struct {
+	Source            string        `short:"b" long:"source" description:"Test data Firestore service account file" required:"true"`
+	Tag               []string      `short:"t" long:"tag" description:"run tests matching provided tag(s) ex: '-t e2e -t smoke_test'" required:"true"`
+	Match             string        `long:"match" description:"run tests having any or all of the provided tags" choice:"any" choice:"all" default:"any"`
+	Account           int           `short:"a" long:"accountId" description:"account id to replay data onto" required:"true"`
+	Transponders      []int         `short:"x" long:"transponderId" description:"target transponders to replay onto, each test takes as many free ones as it has vehicles ex: '-x 1337 -x 1338'" required:"true"`
+	Target            string        `short:"g" long:"target" description:"Target Firestore emulator 'host:port' string" required:"true"`
+	EmulatorProjectId string        `short:"p" long:"projectId" description:"projectId used when starting your local firebase emulator" required:"true"`
+	Parallel          int           `long:"parallel" description:"number of tests replayed at the same time, needs enough --transponderId targets to go around" default:"1"`
+	SkipVerify        bool          `long:"skip-verify" description:"don't read back and verify written reports once each replay is done"`
+	Tolerance         time.Duration `long:"tolerance" description:"how far off schedule a report may land before verification flags it" default:"2s"`
+	Expect            []string      `long:"expect" description:"wait for downstream documents once each replay is done, same as replay --expect"`
+	Scenario          string        `long:"scenario" description:"JSON file of assertions to wait for once each replay is done, see README"`
+	AssertTimeout     time.Duration `long:"assertTimeout" description:"how long each assertion waits for its documents unless it sets its own timeout" default:"60s"`
+	JUnit             string        `long:"junit" description:"write a JUnit XML report with a test suite per replayed test to this file"`
+	Results           string        `long:"results" description:"write a JSON summary of every replayed test to this file"`
 }
 
 // Transponder generated reports (speeding, status, hard_accel, ...)
-type FirestoreTransponderReportV1 struct {
-	ConfigId           float64        `firestore:"configId,omitempty"`
-	Duration           float64        `firestore:"duration,omitempty"`
-	EventStart         time.Time      `firestore:"eventStart,omitempty"`
-	InProgress         bool           `firestore:"inProgress,omitempty"`
-	LocationAccuracy   float64        `firestore:"locationAccuracy,omitempty"`
-	Heading            float64        `firestore:"heading,omitempty"`
-	Address            string         `firestore:"address,omitempty"`
-	DotOrientation     string         `firestore:"dotOrientation,omitempty"`
-	GeoTags            []string       `firestore:"geoTags,omitempty"`
-	LatLng             *latlng.LatLng `firestore:"latLng,omitempty"`
-	BatteryVoltage     float64        `firestore:"batteryVoltage,omitempty"`
-	CellSignalStrength float64        `firestore:"cellSignalStrength,omitempty"`
-	IsLowBattery       bool           `firestore:"isLowBatteryVoltage,omitempty"`
-	Odometer           float64        `firestore:"odometer,omitempty"`
-	Speed              float64        `firestore:"speed,omitempty"`
-	SpeedLimit         float64        `firestore:"speedLimit,omitempty"`
-	ReportTimestamp    time.Time      `firestore:"reportTimestamp,omitempty"`
-	Serial             float64        `firestore:"serial,omitempty"`
-	Type               string         `firestore:"type"`                              // this is the "dataType" field of a streaming packet
-	FirestoreCreation  time.Time      `firestore:"fsCreateTimestamp,serverTimestamp"` // if zero, Firestore sets this on their end
-}
+type FirestoreTransponderReportV1 = stream.Report
 
 var (
 	args                        = new(optsBase)
@@ -95,23 +293,97 @@ func main() {
 		log.Printf("%s Unable to parse args.\n", red("FATAL"))
 		os.Exit(1)
 	}
+	setupOutput(args.Output, args.NoColor)
 	switch p.Active.Name {
 	case "copy":
 		err := copy(ctx, p)
 		if err != nil {
-			//
+			os.Exit(1)
 		}
 	case "replay":
 		err := replay(ctx, p)
 		if err != nil {
-			//
+			os.Exit(1) // let CI know our replay can't be trusted
 		}
 	case "list":
 		err := list(ctx, p)
 		if err != nil {
-			//
+			os.Exit(1)
 		}
 	case "tags":
-		tags(ctx, p)
+		err := tags(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "show":
+		err := show(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "delete":
+		err := deleteTest(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "rename":
+		err := rename(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "clone":
+		err := clone(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "tag":
+		err := retag(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "export":
+		err := export(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "import":
+		err := importTest(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "track":
+		err := track(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "generate":
+		err := generate(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "report":
+		err := report(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "watch":
+		err := watch(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "record":
+		err := record(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "mirror":
+		err := mirror(ctx, p)
+		if err != nil {
+			os.Exit(1)
+		}
+	case "suite":
+		err := suite(ctx, p)
+		if err != nil {
+			os.Exit(1) // a failed suite has to fail CI too
+		}
 	}
 }
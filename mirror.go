@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"carmalink.com/replaystream/stream"
+	"github.com/jessevdk/go-flags"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// a live copy + replay: listen on source vehicles' report_data and write each new report into a local emulator
+// right away (or --delay later), remapped and rewritten exactly like replay does, no test document in between
+func mirror(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsMirror
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse mirror args")
+	}
+	if !isEmulatorAddr(opts.Target) {
+		err := errors.New("mirror doesn't support anything beyond a local firestore emulator target")
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	if len(opts.Type) > maxTypeFilters {
+		err := fmt.Errorf("at most %d --type filters can be used", maxTypeFilters)
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	targets, err := opts.targetVehicles()
+	if err == nil {
+		err = opts.checkLoop(targets)
+	}
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	sc, err := createFirestoreClient(ctx, targetClientConfig(opts.Source, opts.EmulatorProjectId))
+	if err != nil {
+		return err
+	}
+	tc, err := createFirestoreClient(ctx, fsClientConfig{c: opts.Target, e: opts.EmulatorProjectId, l: true})
+	if err != nil {
+		return err
+	}
+
+	// stop cleanly on Ctrl-C so we still get our summary
+	lctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if opts.For > 0 {
+		lctx, cancel = context.WithTimeout(lctx, opts.For)
+		defer cancel()
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-lctx.Done():
+		}
+	}()
+
+	// one listener per source vehicle, we write everything they see in the order it arrived
+	reportCollection := SupportedTransponderReports[0]
+	started := now()
+	arrivals := make(chan recordedReport, 64)
+	var listenErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, x := range opts.Transponders {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			err := listenReports(lctx, sc, opts.Account, x, reportCollection, opts.Type, started, arrivals)
+			if err != nil {
+				mu.Lock()
+				if listenErr == nil {
+					listenErr = err
+				}
+				mu.Unlock()
+				cancel()
+			}
+		}(x)
+	}
+	go func() {
+		wg.Wait()
+		close(arrivals)
+	}()
+
+	var rw *recordWriter
+	if structuredOutput() {
+		rw = newRecordWriter(args.Output)
+	}
+	fmt.Fprintf(msgOut, "mirroring %s, press Ctrl-C to stop\n", blue(opts.describe(targets)))
+	summary := mirrorSummary{Event: "summary", Started: started}
+	var outErr error // first failed record write, stops our listeners as nobody is reading anymore
+	for a := range arrivals {
+		// hold each report back by --delay, written with our outer ctx so the ones already received still make it
+		time.Sleep(time.Until(a.arrived.Add(opts.Delay)))
+		var r FirestoreTransponderReportV1
+		if err := a.doc.DataTo(&r); err != nil {
+			fmt.Fprintf(msgOut, "%s unpacking report %s, skipping it\n", yellow("WARN"), blue(a.doc.Ref.Path))
+			continue
+		}
+		dst := targets[a.vehicle]
+		now := now()
+		diff := stream.Rewrite(&r, dst, now)
+		dRef := tc.Collection("account/" + strconv.Itoa(opts.targetAccount()) + "/vehicle/" + strconv.Itoa(dst) + "/" + reportCollection).NewDoc()
+		_, err := dRef.Set(ctx, r)
+		summary.Reports++
+		ev := replayEvent{
+			Event:           "write",
+			Seq:             summary.Reports,
+			Vehicle:         a.vehicle,
+			Transponder:     dst,
+			Type:            r.Type,
+			Path:            dRef.Path,
+			ReportTimestamp: r.ReportTimestamp,
+			WrittenAt:       now,
+			DelayMs:         float64(diff) / float64(time.Millisecond),
+		}
+		if err != nil {
+			summary.Failed++
+			ev.Error = err.Error()
+		}
+		if rw != nil {
+			if outErr == nil {
+				if outErr = rw.write(ev); outErr != nil {
+					cancel()
+				}
+			}
+		} else if err != nil {
+			fmt.Fprintf(msgOut, "%s writing report from %s\n", red("ERROR"), blue(a.doc.Ref.Path))
+			fmt.Fprintln(msgOut, err)
+		} else {
+			fmt.Fprintf(msgOut, "%s  %-6d -> %-6d %-12s lag %s\n", now.Format(time.RFC3339Nano), a.vehicle, dst, blue(r.Type),
+				green(strconv.FormatFloat(durationMs(now.Sub(a.arrived)), 'f', 0, 64)+"ms"))
+		}
+	}
+	summary.Finished = now()
+	if rw != nil {
+		if outErr == nil {
+			if outErr = rw.write(summary); outErr == nil {
+				outErr = rw.close()
+			}
+		}
+		if outErr != nil {
+			fmt.Fprintf(msgOut, "%s writing %s output\n", red("ERROR"), args.Output)
+			fmt.Fprintln(msgOut, outErr)
+			return outErr
+		}
+	} else {
+		fmt.Fprintf(msgOut, "%s mirrored %s reports, %s failed\n", green("done"), blue(strconv.Itoa(summary.Reports)), blue(strconv.Itoa(summary.Failed)))
+	}
+	if listenErr != nil {
+		fmt.Fprintf(msgOut, "%s listening for reports\n", red("ERROR"))
+		fmt.Fprintln(msgOut, listenErr)
+		if len(opts.Type) > 0 && status.Code(listenErr) == codes.FailedPrecondition {
+			fmt.Fprintf(msgOut, "%s --type filters need a composite index on %s: %s Ascending, %s Ascending\n",
+				yellow("HINT"), blue(reportCollection), blue("type"), blue("fsCreateTimestamp"))
+		}
+		return listenErr
+	}
+	return nil
+}
+
+// final record emitted by mirror in structured output modes
+type mirrorSummary struct {
+	Event    string // always "summary"
+	Reports  int
+	Failed   int
+	Started  time.Time
+	Finished time.Time
+}
+
+func (s mirrorSummary) csvHeader() []string {
+	return []string{"event", "reports", "failed", "started", "finished"}
+}
+
+func (s mirrorSummary) csvRow() []string {
+	return []string{s.Event, strconv.Itoa(s.Reports), strconv.Itoa(s.Failed), csvTime(s.Started), csvTime(s.Finished)}
+}
+
+// Methods //
+
+// target transponder of each source vehicle, vehicles without a --map entry keep their id
+func (o *optsMirror) targetVehicles() (map[int]int, error) {
+	m, err := parseVehicleMap(o.Map)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[int]int)
+	for _, x := range o.Transponders {
+		targets[x] = x
+		if dst, ok := m[x]; ok {
+			targets[x] = dst
+		}
+	}
+	for src := range m {
+		if _, ok := targets[src]; !ok {
+			return nil, fmt.Errorf("--map %d:%d refers to a vehicle we're not mirroring, add -x %d", src, m[src], src)
+		}
+	}
+	return targets, nil
+}
+
+// mirroring an emulator onto itself is fine as long as we don't write into a vehicle we're listening to,
+// our own writes would show up as new reports and we'd mirror them again, forever
+func (o *optsMirror) checkLoop(targets map[int]int) error {
+	if o.Source != o.Target || o.targetAccount() != o.Account {
+		return nil
+	}
+	for _, x := range o.Transponders {
+		if _, ok := targets[targets[x]]; ok {
+			return fmt.Errorf("vehicle %d would be mirrored onto vehicle %d we're listening to in the same emulator, "+
+				"use --targetAccountId or map it onto another vehicle with -m", x, targets[x])
+		}
+	}
+	return nil
+}
+
+// account we write into, the source account unless --targetAccountId is given
+func (o *optsMirror) targetAccount() int {
+	if o.TargetAccount != 0 {
+		return o.TargetAccount
+	}
+	return o.Account
+}
+
+// what we're mirroring, for humans
+func (o *optsMirror) describe(targets map[int]int) string {
+	var xs []string
+	for _, x := range o.Transponders {
+		xs = append(xs, strconv.Itoa(x)+" -> "+strconv.Itoa(targets[x]))
+	}
+	s := "account " + strconv.Itoa(o.Account) + " vehicle " + strings.Join(xs, ", ")
+	if o.targetAccount() != o.Account {
+		s += " onto account " + strconv.Itoa(o.targetAccount())
+	}
+	if len(o.Type) > 0 {
+		s += " type " + strings.Join(o.Type, ", ")
+	}
+	if o.Delay > 0 {
+		s += " delayed " + o.Delay.String()
+	}
+	return s
+}
+
+// convert and set user-provided values into opts struct
+func (o *optsMirror) set(p *flags.Parser) (ok bool) {
+	o.Account, ok = p.Active.FindOptionByLongName("accountId").Value().(int)
+	if !ok {
+		return false
+	}
+	o.TargetAccount, ok = p.Active.FindOptionByLongName("targetAccountId").Value().(int)
+	if !ok {
+		return false
+	}
+	o.Transponders, ok = p.Active.FindOptionByLongName("transponderId").Value().([]int)
+	if !ok {
+		return false
+	}
+	o.Map, ok = p.Active.FindOptionByLongName("map").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.Type, ok = p.Active.FindOptionByLongName("type").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.Source, ok = p.Active.FindOptionByLongName("source").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Target, ok = p.Active.FindOptionByLongName("target").Value().(string)
+	if !ok {
+		return false
+	}
+	o.EmulatorProjectId, ok = p.Active.FindOptionByLongName("projectId").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Delay, ok = p.Active.FindOptionByLongName("delay").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	o.For, ok = p.Active.FindOptionByLongName("for").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	return true
+}
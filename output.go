@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// supported --output formats
+const (
+	outputTable  = "table" // colored, human friendly text
+	outputJSON   = "json"
+	outputNDJSON = "ndjson"
+	outputCSV    = "csv"
+)
+
+// dataOut receives our records, in structured output modes it's the only thing writing to stdout
+var dataOut io.Writer = os.Stdout
+
+// msgOut receives our human friendly messages, progress bars already go to stderr
+var msgOut io.Writer = os.Stdout
+
+// apply global output options, called once args are parsed
+// fatih/color already disables colors when stdout isn't a TTY, we also honor --no-color and NO_COLOR
+// structured formats keep stdout for records only: our human friendly messages move over to stderr
+func setupOutput(format string, noColor bool) {
+	if noColor || os.Getenv("NO_COLOR") != "" {
+		color.NoColor = true
+	}
+	if format != outputTable {
+		msgOut = os.Stderr
+		color.NoColor = true
+	}
+}
+
+// true if records should be written with a recordWriter instead of our colored text output
+func structuredOutput() bool {
+	return args.Output != outputTable
+}
+
+// csvRecord is implemented by anything we can emit with --output csv
+type csvRecord interface {
+	csvHeader() []string
+	csvRow() []string
+}
+
+// recordWriter emits records as a JSON array, NDJSON (one object per line) or CSV
+type recordWriter struct {
+	format  string
+	w       io.Writer
+	csv     *csv.Writer
+	header  reflect.Type  // record type our last csv header was written for
+	records []interface{} // buffered for a single JSON array
+}
+
+func newRecordWriter(format string) *recordWriter {
+	rw := &recordWriter{format: format, w: dataOut}
+	if format == outputCSV {
+		rw.csv = csv.NewWriter(dataOut)
+	}
+	return rw
+}
+
+// write a single record, csv starts a new header whenever the record type changes
+func (rw *recordWriter) write(v interface{}) error {
+	switch rw.format {
+	case outputJSON:
+		rw.records = append(rw.records, v)
+		return nil
+	case outputNDJSON:
+		return json.NewEncoder(rw.w).Encode(v)
+	case outputCSV:
+		r, ok := v.(csvRecord)
+		if !ok {
+			return errors.New("record type doesn't support csv output")
+		}
+		if t := reflect.TypeOf(v); t != rw.header {
+			rw.header = t
+			if err := rw.csv.Write(r.csvHeader()); err != nil {
+				return err
+			}
+		}
+		if err := rw.csv.Write(r.csvRow()); err != nil {
+			return err
+		}
+		rw.csv.Flush() // keep rows flowing for long running commands like replay
+		return rw.csv.Error()
+	}
+	return errors.New("unsupported output format " + rw.format)
+}
+
+// flush anything buffered, must be called once all records are written
+func (rw *recordWriter) close() error {
+	switch rw.format {
+	case outputJSON:
+		if rw.records == nil {
+			rw.records = []interface{}{}
+		}
+		enc := json.NewEncoder(rw.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rw.records)
+	case outputCSV:
+		rw.csv.Flush()
+		return rw.csv.Error()
+	}
+	return nil
+}
+
+// csv cell helpers, zero times are left empty
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func csvFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
+
+	"carmalink.com/replaystream/stream"
+	"cloud.google.com/go/firestore"
+	"github.com/jessevdk/go-flags"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// capture a live test drive: listen on each vehicle's report collections in the source db and write every new report
+// into Tests/{name} as it arrives, until interrupted or --for runs out
+// reports are copied as is, so their original fsCreateTimestamp (and its ingest delay) is kept for replays
+func record(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsRecord
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse record args")
+	}
+	if len(opts.Type) > maxTypeFilters {
+		err := fmt.Errorf("at most %d --type filters can be used", maxTypeFilters)
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	sc, err := createFirestoreClient(ctx, targetClientConfig(opts.Source, opts.EmulatorProjectId))
+	if err != nil {
+		return err
+	}
+	tc, err := createFirestoreClient(ctx, targetClientConfig(opts.Target, opts.EmulatorProjectId))
+	if err != nil {
+		return err
+	}
+
+	// a recording can't be redone, so never write over an existing test
+	ref := tc.Collection("Tests").Doc(opts.Name)
+	err = ensureNoTest(ctx, ref)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	started := now()
+	test := opts.test(started)
+	_, err = ref.Set(ctx, test)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s setting our test document up\n", red("ERROR"))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	if test.MultiVehicle {
+		for _, x := range opts.Transponders {
+			_, err = stream.TestVehicleRef(ref, x, true).Set(ctx, map[string]interface{}{"Account": opts.Account, "Transponder": x})
+			if err != nil {
+				fmt.Fprintf(msgOut, "%s setting vehicle document %s up\n", red("ERROR"), blue(strconv.Itoa(x)))
+				fmt.Fprintln(msgOut, err)
+				return err
+			}
+		}
+	}
+
+	// stop cleanly on Ctrl-C so we still finish our test document
+	lctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if opts.For > 0 {
+		lctx, cancel = context.WithTimeout(lctx, opts.For)
+		defer cancel()
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-lctx.Done():
+		}
+	}()
+
+	// one listener per vehicle and report collection, everything they see is written out by us one at a time
+	arrivals := make(chan recordedReport, 64)
+	var listenErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, x := range opts.Transponders {
+		for _, reportCollection := range SupportedTransponderReports {
+			wg.Add(1)
+			go func(x int, reportCollection string) {
+				defer wg.Done()
+				err := listenReports(lctx, sc, opts.Account, x, reportCollection, opts.Type, started, arrivals)
+				if err != nil {
+					mu.Lock()
+					if listenErr == nil {
+						listenErr = err
+					}
+					mu.Unlock()
+					cancel()
+				}
+			}(x, reportCollection)
+		}
+	}
+	go func() {
+		wg.Wait()
+		close(arrivals)
+	}()
+
+	var rw *recordWriter
+	var outErr error // first failed record write
+	if structuredOutput() {
+		rw = newRecordWriter(args.Output)
+	}
+	fmt.Fprintf(msgOut, "recording %s, press Ctrl-C to stop\n", blue(opts.describe()))
+	sb := newStatsBuilder()
+	perVehicle := make(map[int]int)
+	var docs int
+	var writeErr error
+	for a := range arrivals {
+		// written with our outer ctx so reports already received still make it in once we stop listening
+		dst := stream.TestVehicleRef(ref, a.vehicle, test.MultiVehicle).Collection(a.collection).Doc(a.doc.Ref.ID)
+		_, err := dst.Set(ctx, a.doc.Data())
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s writing report %s\n", red("ERROR"), blue(a.doc.Ref.Path))
+			fmt.Fprintln(msgOut, err)
+			if writeErr == nil {
+				writeErr = err
+			}
+			cancel()
+			continue
+		}
+		r := FirestoreTransponderReportV1{}
+		if err := a.doc.DataTo(&r); err != nil {
+			fmt.Fprintf(msgOut, "%s unable to read report %s for test statistics\n", yellow("WARN"), blue(a.doc.Ref.ID))
+		}
+		sb.add(a.collection, a.vehicle, &r)
+		perVehicle[a.vehicle]++
+		docs++
+		if rw != nil {
+			// a failed event write doesn't stop our recording, we report it once the test is saved
+			err := rw.write(recordEvent{Event: "report", Path: dst.Path, Vehicle: a.vehicle, Type: r.Type,
+				ReportTimestamp: r.ReportTimestamp, FsCreateTimestamp: r.FirestoreCreation})
+			if err != nil && outErr == nil {
+				outErr = err
+			}
+		} else {
+			fmt.Fprintf(msgOut, "%s  %-6d %-12s %s\n", r.ReportTimestamp.Format(time.RFC3339), a.vehicle, blue(r.Type), green(strconv.Itoa(docs)))
+		}
+	}
+	finished := now()
+	if listenErr != nil {
+		fmt.Fprintf(msgOut, "%s listening for reports\n", red("ERROR"))
+		fmt.Fprintln(msgOut, listenErr)
+		if len(opts.Type) > 0 && status.Code(listenErr) == codes.FailedPrecondition {
+			fmt.Fprintf(msgOut, "%s --type filters need a composite index on the report collections: %s Ascending, %s Ascending\n",
+				yellow("HINT"), blue("type"), blue("fsCreateTimestamp"))
+		}
+	}
+
+	// like copy, don't leave empty vehicles or tests laying around
+	if test.MultiVehicle {
+		for _, x := range opts.Transponders {
+			if perVehicle[x] == 0 && docs > 0 {
+				fmt.Fprintf(msgOut, "%s no reports were recorded for vehicle %s\n", yellow("WARN"), blue(strconv.Itoa(x)))
+				if _, err := stream.TestVehicleRef(ref, x, true).Delete(ctx); err != nil {
+					fmt.Fprintf(msgOut, "%s deleting vehicle doc %s...\n", red("ERROR"), blue(strconv.Itoa(x)))
+				}
+			}
+		}
+	}
+	if docs == 0 {
+		fmt.Fprintf(msgOut, "%s no reports were recorded. Cleaning up test document...\n", yellow("WARN"))
+		if test.MultiVehicle {
+			for _, x := range opts.Transponders {
+				stream.TestVehicleRef(ref, x, true).Delete(ctx)
+			}
+		}
+		if _, err := ref.Delete(ctx); err != nil {
+			fmt.Fprintf(msgOut, "%s deleting test reference doc...\n", red("ERROR"))
+		}
+		if listenErr != nil {
+			return listenErr
+		}
+		return writeErr
+	}
+	// our capture window is only known now that we've stopped
+	stats := sb.result()
+	_, err = ref.Update(ctx, []firestore.Update{
+		{Path: "Stats", Value: stats},
+		{Path: "EndTime", Value: finished},
+		{Path: "Etime", Value: millis(finished)},
+	})
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s storing test statistics\n", red("ERROR"))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	err = adjustTagIndex(ctx, tc, opts.Tag, 1)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s updating tag index\n", red("ERROR"))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	if rw != nil {
+		if outErr == nil {
+			if outErr = rw.write(copySummary{Event: "summary", Test: opts.Name, Vehicles: opts.Transponders, Docs: docs, Stats: stats}); outErr == nil {
+				outErr = rw.close()
+			}
+		}
+		if outErr != nil {
+			fmt.Fprintf(msgOut, "%s writing %s output\n", red("ERROR"), args.Output)
+			fmt.Fprintln(msgOut, outErr)
+			return outErr
+		}
+	} else {
+		fmt.Fprintf(msgOut, "%s recorded %s reports into %s over %s\n", green("success"), blue(strconv.Itoa(docs)), blue(opts.Name),
+			finished.Sub(started).Round(time.Second))
+	}
+	if listenErr != nil {
+		return listenErr
+	}
+	return writeErr
+}
+
+// a report one of our listeners saw land in the source db
+type recordedReport struct {
+	vehicle    int
+	collection string
+	doc        *firestore.DocumentSnapshot
+	arrived    time.Time
+}
+
+// emitted for every report record captures in structured output modes
+type recordEvent struct {
+	Event             string // always "report"
+	Path              string // where we stored it within our test
+	Vehicle           int
+	Type              string
+	ReportTimestamp   time.Time
+	FsCreateTimestamp time.Time
+}
+
+func (e recordEvent) csvHeader() []string {
+	return []string{"event", "path", "vehicle", "type", "reportTimestamp", "fsCreateTimestamp"}
+}
+
+func (e recordEvent) csvRow() []string {
+	return []string{e.Event, e.Path, strconv.Itoa(e.Vehicle), e.Type, csvTime(e.ReportTimestamp), csvTime(e.FsCreateTimestamp)}
+}
+
+// send every report created in account's vehicle x collection since started to out, until ctx is done
+// filtering on fsCreateTimestamp keeps older reports out of our first snapshot, while late reports still get in
+func listenReports(ctx context.Context, sc *firestore.Client, account, x int, reportCollection string, types []string,
+	started time.Time, out chan<- recordedReport) error {
+	path := "account/" + strconv.Itoa(account) + "/vehicle/" + strconv.Itoa(x) + "/" + reportCollection
+	q := sc.Collection(path).Where("fsCreateTimestamp", ">=", started)
+	switch len(types) {
+	case 0: // all types
+	case 1:
+		q = q.Where("type", "==", types[0])
+	default:
+		q = q.Where("type", "in", types)
+	}
+	iter := q.Snapshots(ctx)
+	defer iter.Stop()
+	for {
+		snap, err := iter.Next()
+		if err != nil {
+			if ctx.Err() != nil || status.Code(err) == codes.Canceled || status.Code(err) == codes.DeadlineExceeded {
+				return nil
+			}
+			return err
+		}
+		for _, change := range snap.Changes {
+			if change.Kind != firestore.DocumentAdded {
+				continue
+			}
+			out <- recordedReport{vehicle: x, collection: reportCollection, doc: change.Doc, arrived: now()}
+		}
+	}
+}
+
+// Methods //
+
+// our test document, its capture window starts now and is closed once we stop
+func (o *optsRecord) test(started time.Time) optsCopy {
+	return optsCopy{
+		Transponders: o.Transponders,
+		Account:      o.Account,
+		Description:  o.Description,
+		Name:         o.Name,
+		Source:       o.Source,
+		Target:       o.Target,
+		Tag:          o.Tag,
+		Type:         o.Type,
+		IncStart:     true,
+		Stime:        millis(started),
+		StartTime:    started,
+		Transponder:  o.Transponders[0],
+		MultiVehicle: len(o.Transponders) > 1,
+	}
+}
+
+// what we're recording, for humans
+func (o *optsRecord) describe() string {
+	s := "account " + strconv.Itoa(o.Account) + " vehicle"
+	for i, x := range o.Transponders {
+		if i > 0 {
+			s += ","
+		}
+		s += " " + strconv.Itoa(x)
+	}
+	return s + " into " + o.Name
+}
+
+// convert and set user-provided values into opts struct
+func (o *optsRecord) set(p *flags.Parser) (ok bool) {
+	o.Account, ok = p.Active.FindOptionByLongName("accountId").Value().(int)
+	if !ok {
+		return false
+	}
+	o.Transponders, ok = p.Active.FindOptionByLongName("transponderId").Value().([]int)
+	if !ok {
+		return false
+	}
+	o.Name, ok = p.Active.FindOptionByLongName("name").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Description, ok = p.Active.FindOptionByLongName("description").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Tag, ok = p.Active.FindOptionByLongName("tag").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.Type, ok = p.Active.FindOptionByLongName("type").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.Source, ok = p.Active.FindOptionByLongName("source").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Target, ok = p.Active.FindOptionByLongName("target").Value().(string)
+	if !ok {
+		return false
+	}
+	o.EmulatorProjectId, ok = p.Active.FindOptionByLongName("projectId").Value().(string)
+	if !ok {
+		return false
+	}
+	o.For, ok = p.Active.FindOptionByLongName("for").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// rename a test, Firestore can't move documents so we copy everything over to the new name and delete the old one
+func rename(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsRename
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse rename args")
+	}
+	// create our client based on usr provided opts
+	conf := fsClientConfig{c: opts.Source}
+	c, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	src := c.Collection("Tests").Doc(opts.Name)
+	dst := c.Collection("Tests").Doc(opts.To)
+	_, err = readTest(ctx, src)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s reading test document: %s\n", red("ERROR"), blue(opts.Name))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	err = ensureNoTest(ctx, dst)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	// tags stay the same, so our tag index doesn't change
+	n, err := copyDocTree(ctx, src, c, dst, opts.Shallow, func(data map[string]interface{}) {
+		data["Name"] = opts.To
+	})
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s copying test %s to %s, %s documents written so far\n", red("ERROR"), blue(opts.Name), blue(opts.To), blue(strconv.Itoa(n)))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	_, err = deleteDocTree(ctx, c, src, opts.Shallow)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s removing old test %s, it now exists under both names\n", red("ERROR"), blue(opts.Name))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	fmt.Fprintf(msgOut, "%s renamed %s to %s\n", green("success"), blue(opts.Name), blue(opts.To))
+	return nil
+}
+
+// Methods //
+
+// convert and set user-provided values into opts struct
+func (o *optsRename) set(p *flags.Parser) (ok bool) {
+	o.Source, ok = p.Active.FindOptionByLongName("source").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Name, ok = p.Active.FindOptionByLongName("name").Value().(string)
+	if !ok {
+		return false
+	}
+	o.To, ok = p.Active.FindOptionByLongName("to").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Shallow, ok = p.Active.FindOptionByLongName("shallow").Value().(bool)
+	if !ok {
+		return false
+	}
+	return true
+}
@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/firestore"
+	"carmalink.com/replaystream/stream"
 	"github.com/jessevdk/go-flags"
 	progressbar "github.com/schollz/progressbar/v3"
 )
@@ -24,15 +27,24 @@ func replay(ctx context.Context, p *flags.Parser) error {
 	// populate our opts
 	ok := opts.set(p)
 	if !ok {
-		fmt.Printf("%s cmd line args cannot be parsed!\n", red("ERROR"))
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse replay args")
 	}
 
-	// For source data we're using cloud firestore + a service account file (most likely it's test-latinum)...
-	conf := fsClientConfig{c: opts.Source}
-	sc := createFirestoreClient(ctx, conf)
+	if opts.FromFile == "" && (opts.Source == "" || opts.Name == "") {
+		err := errors.New("replay needs --source and --name, or --from-file")
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	// downstream assertions to check once we're done, read up front so a typo doesn't waste a whole replay
+	assertions, err := opts.assertions()
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
 
 	// For target data we're using a local firestore emulator, attempt to connect via option.WithGRPCCONN
-	conf = fsClientConfig{c: opts.Target}
+	conf := fsClientConfig{c: opts.Target}
 	if opts.TargetEmulator { // pointing at a firestore emulator, good b/c that's all we support right now
 		conf.e = opts.EmulatorProjectId
 		conf.l = true
@@ -41,89 +53,349 @@ func replay(ctx context.Context, p *flags.Parser) error {
 		errMsg := fmt.Sprintf("%s replay sub-command doesn't support anything beyond a local firestore emulator", red("FATAL"))
 		return errors.New(errMsg)
 	}
-	tc := createFirestoreClient(ctx, conf) // firestore source connection
-
-	// get our supported data collections so we can combine them all into a big structure
-	// then we sort ALL events by fsCreateTimestamp to get our "playlist" of data
-	// all of our data is now in a queue to be written keyed by the time it was 1st written
-	// next we will hit "play" and start writing, this will now require us to
-	// modify each record's reportTimestamp ideally to an offset equal to fsCreateTimestamp - reportTimestamp
-	// of our original report, so if we have a 7 second diff between reportTimestamp -> fsCreateTimestamp
-	// we will carry that over to our new reportTimestamp to ensure that the same effect of "late" or delayed
-	// data is visible within the replay environment...
-
-	// find our "Tests" document in Firestore: Tests/{testDocId} to locate our test data collections
-
-	// We only support FirestoreTransponderReportV1 type "report_data" structures in Firestore.
-	// At some point we'll need to go get other types of reports and play those back as well.
-	// We are using Firestore to sort all of our entries back to us by fsCreateTimestamp
-	reportCollection := SupportedTransponderReports[0]
-	// Tests/{testDocId}/{reportCollection}/{reportDataDocuments}
-	sCollection := sc.Collection("Tests/" + opts.Name + "/" + reportCollection)
-	//fmt.Printf("DEBUG: source collection query: %v\n", sCollection)
-	sIter1, err := sCollection.OrderBy("fsCreateTimestamp", firestore.Asc).Documents(ctx).GetAll() // no query params here, get it all
+	tc, err := createFirestoreClient(ctx, conf) // firestore target connection
 	if err != nil {
-		fmt.Printf("%s querying source collection: %s\n", red("ERROR"), blue(reportCollection))
-		fmt.Println(err)
 		return err
 	}
+	// For source data we're using cloud firestore + a service account file (most likely it's test-latinum)...
+	// unless we're replaying a local archive, no cloud Firestore involved at all
+	var source stream.Store
+	if opts.FromFile == "" {
+		sc, err := createFirestoreClient(ctx, fsClientConfig{c: opts.Source})
+		if err != nil {
+			return err
+		}
+		source = stream.NewFirestoreStore(sc)
+	}
+
+	// structured per-document events and a final summary for --output json|ndjson|csv
+	var rw *recordWriter
+	if structuredOutput() {
+		rw = newRecordWriter(args.Output)
+	}
+	res, err := opts.run(ctx, stream.NewFirestoreStore(tc), source, assertions, rw, false)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	if rw != nil {
+		if err := writeReplayRecords(rw, res); err != nil {
+			fmt.Fprintf(msgOut, "%s writing %s output\n", red("ERROR"), args.Output)
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+	} else {
+		printReplayIssues(res.Issues)
+		printAssertionResults(res.Assertions)
+	}
+	if opts.Results != "" {
+		if err := writeResults(opts.Results, res); err != nil {
+			fmt.Fprintf(msgOut, "%s writing results to %s\n", red("ERROR"), blue(opts.Results))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+	}
+	if opts.JUnit != "" {
+		if err := writeJUnit(opts.JUnit, []*replayResults{res}); err != nil {
+			fmt.Fprintf(msgOut, "%s writing JUnit report to %s\n", red("ERROR"), blue(opts.JUnit))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+	}
+	if err := res.Err(); err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("FAILED"), err)
+		return err
+	}
+	if res.Docs != 0 {
+		fmt.Fprintf(msgOut, "\n%s\n", green("success"))
+	}
+
+	return nil
+}
+
+// replay a single test onto target then verify it and run our assertions, source is only used when not replaying --from-file
+// per-document events go to rw when it isn't nil, quiet leaves out our progress bar and messages for running tests side by side
+// an error means the replay couldn't run at all, problems it found are in our results
+func (o *optsReplay) run(ctx context.Context, target, source stream.Store, assertions []stream.Assertion, rw *recordWriter, quiet bool) (*replayResults, error) {
+	m, err := parseVehicleMap(o.Map)
+	if err != nil {
+		return nil, err
+	}
+	var src stream.Source = stream.StoredTest{Store: source, Name: o.Name}
+	testName, from := o.Name, o.Source
+	if o.FromFile != "" {
+		src = archiveSource(o.FromFile)
+		testName, from = o.FromFile, o.FromFile
+	}
+	var bar *progressbar.ProgressBar
+	var r *stream.Replayer
+	var rwErr error // first failed event write, ends our replay as nobody is listening anymore
+	opts := stream.Options{
+		Target:        target,
+		Account:       o.Account,
+		Transponder:   o.Transponder,
+		Map:           m,
+		SkipVerify:    o.SkipVerify,
+		Tolerance:     o.Tolerance,
+		Assertions:    assertions,
+		AssertTimeout: o.AssertTimeout,
+		OnWrite: func(w stream.Write) {
+			if bar != nil {
+				bar.Add(1) // progress tracking
+			}
+			if rw != nil && rwErr == nil {
+				if rwErr = rw.write(newReplayEvent(w)); rwErr != nil {
+					r.Stop()
+				}
+			}
+		},
+	}
+	if !quiet {
+		opts.Logf = func(format string, a ...interface{}) {
+			fmt.Fprintf(msgOut, "\n"+format+"\n", a...)
+		}
+	}
+	r = stream.New(src, opts)
+	if err := r.Load(ctx); err != nil {
+		return nil, err
+	}
 	// if there were no documents available for this report type, warn and move on
-	docsTotal := len(sIter1)
-	if docsTotal == 0 {
-		// warn
-		fmt.Printf("%s no reports found for type %s in Test Firestore document...\n", yellow("WARNING"), blue(reportCollection))
+	if r.Len() == 0 {
+		fmt.Fprintf(msgOut, "%s no reports found for type %s in %s...\n", yellow("WARNING"), blue(stream.ReportCollection), blue(testName))
+	}
+	if !quiet {
+		bar = progressbar.Default(int64(r.Len()))
+	}
+	if err := r.Start(ctx); err != nil {
+		return nil, err
+	}
+	res, err := r.Wait()
+	if rwErr != nil {
+		return nil, fmt.Errorf("writing %s output: %s", args.Output, rwErr)
+	}
+	if res == nil {
+		return nil, err
+	}
+	res.Source = from
+	if err != nil && res.Error == "" {
+		res.Error = err.Error()
+		res.Passed = false
+	}
+	return res, nil
+}
+
+// our issues, assertion results and summary, once a replay is done
+func writeReplayRecords(rw *recordWriter, res *replayResults) error {
+	for _, issue := range res.Issues {
+		if err := rw.write(replayIssue(issue)); err != nil {
+			return err
+		}
+	}
+	for _, r := range res.Assertions {
+		if err := rw.write(assertionResult(r)); err != nil {
+			return err
+		}
 	}
+	if err := rw.write(newReplaySummary(res)); err != nil {
+		return err
+	}
+	return rw.close()
+}
 
-	// destination setup
-	tCollectionRef := fmt.Sprintf("account/" + strconv.Itoa(opts.Account) + "/vehicle/" + strconv.Itoa(opts.Transponder) + "/" + reportCollection)
-	//fmt.Printf("DEBUG: assembled target ref string:: %s\n", tCollectionRef)
-	tCollection := tc.Collection(tCollectionRef)
+// emitted for every document replay writes in structured output modes
+type replayEvent struct {
+	Event           string // always "write"
+	Seq             int    // position within our playlist, starting at 1
+	Vehicle         int    // original test vehicle
+	Transponder     int    // target transponder
+	Type            string
+	Path            string // full path of the written document
+	ReportTimestamp time.Time
+	WrittenAt       time.Time
+	DelayMs         float64 // original ingest delay carried over into ReportTimestamp
+	Error           string  `json:",omitempty"`
+}
 
-	// basic copy operation metrics
-	var docsAdded int
-	bar := progressbar.Default(int64(docsTotal))
+func (e replayEvent) csvHeader() []string {
+	return []string{"event", "seq", "vehicle", "transponder", "type", "path", "reportTimestamp", "writtenAt", "delayMs", "error"}
+}
 
-	// timer items to pace our writes back into Firestore so they appear real
-	var sleepyTime time.Duration
-	var lastFsCreationTime time.Time
+func (e replayEvent) csvRow() []string {
+	return []string{e.Event, strconv.Itoa(e.Seq), strconv.Itoa(e.Vehicle), strconv.Itoa(e.Transponder), e.Type, e.Path,
+		csvTime(e.ReportTimestamp), csvTime(e.WrittenAt), csvFloat(e.DelayMs), e.Error}
+}
 
-	for i, doc := range sIter1 { // pull source collection's documents and push them out to target collection
-		// unpack report data into struct
-		p := FirestoreTransponderReportV1{}
-		doc.DataTo(&p)
+func newReplayEvent(w stream.Write) replayEvent {
+	ev := replayEvent{
+		Event:           "write",
+		Seq:             w.Seq,
+		Vehicle:         w.Vehicle,
+		Transponder:     w.Transponder,
+		Type:            w.Report.Type,
+		Path:            w.Path,
+		ReportTimestamp: w.Report.ReportTimestamp,
+		WrittenAt:       w.WrittenAt,
+		DelayMs:         durationMs(w.Delay),
+	}
+	if w.Err != nil {
+		ev.Error = w.Err.Error()
+	}
+	return ev
+}
 
-		// set new sleep time upon second iteration through our range
-		if i != 0 {
-			sleepyTime = p.FirestoreCreation.Sub(lastFsCreationTime)
-		}
-		// wait until we are ready
-		time.Sleep(sleepyTime)
+// final record emitted by replay in structured output modes
+type replaySummary struct {
+	Event        string // always "summary"
+	Test         string
+	Docs         int // reports in our playlist
+	Written      int
+	Failed       int
+	Verified     bool // false if verification was skipped
+	Issues       int  // problems found, see replayIssue
+	Assertions   int  // downstream assertions checked, see assertionResult
+	AssertFailed int
+	Started      time.Time
+	Finished     time.Time
+	DurationSec  float64
+}
 
-		// intentionally zero out eventStart, because we aren't synth'ing it
-		p.EventStart = time.Time{}
+func (s replaySummary) csvHeader() []string {
+	return []string{"event", "test", "docs", "written", "failed", "verified", "issues", "assertions", "assertFailed", "started", "finished", "durationSec"}
+}
 
-		// set serial number to user-requested
-		p.Serial = float64(opts.Transponder)
+func (s replaySummary) csvRow() []string {
+	return []string{s.Event, s.Test, strconv.Itoa(s.Docs), strconv.Itoa(s.Written), strconv.Itoa(s.Failed),
+		strconv.FormatBool(s.Verified), strconv.Itoa(s.Issues),
+		strconv.Itoa(s.Assertions), strconv.Itoa(s.AssertFailed), csvTime(s.Started), csvTime(s.Finished), csvFloat(s.DurationSec)}
+}
 
-		// keep track of our re-play timeline
-		lastFsCreationTime = p.FirestoreCreation
+// a test archive replayed --from-file
+type archiveSource string
 
-		// differential between this report's fsCreateTimestamp and reportTimestamp
-		// this gives us our "delay" between transponder making a report, it hitting cl api and then firestore
-		diff := p.FirestoreCreation.Sub(p.ReportTimestamp)
-		now := now()
-		p.ReportTimestamp = now.Add(-diff)
+func (file archiveSource) Load(ctx context.Context) (*stream.Test, error) {
+	vehicles, reports, err := archiveReports(string(file), stream.ReportCollection)
+	if err != nil {
+		return nil, fmt.Errorf("reading archive %s: %s", file, err)
+	}
+	t := &stream.Test{Name: string(file), Vehicles: vehicles, Reports: reports}
+	if a, err := archiveTest(string(file)); err == nil {
+		t.Name, t.Tags = a.Name, a.Tag
+	}
+	return t, nil
+}
 
-		// write it out
-		tCollection.NewDoc().Set(ctx, p)
-		bar.Add(1) // progress tracking
-		docsAdded++
+// read every report of one collection type from a test archive, returns the test's vehicles too
+func archiveReports(file, reportCollection string) ([]int, []stream.VehicleReport, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
 	}
-	if docsTotal != 0 {
-		fmt.Printf("\n%s\n", green("success"))
+	defer f.Close()
+	ar, err := newArchiveReader(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	var single int // transponder of a single vehicle test
+	seen := make(map[int]bool)
+	var vehicles []int
+	var reports []stream.VehicleReport
+	for {
+		kind, rel, data, err := ar.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if kind == recTest {
+			var t optsCopy
+			err = mapToStruct(data, &t)
+			if err != nil {
+				return nil, nil, fmt.Errorf("test document: %s", err)
+			}
+			if !t.MultiVehicle {
+				single = t.Transponder
+				seen[single] = true
+				vehicles = append(vehicles, single)
+			}
+			continue
+		}
+		// report_data/{id} or vehicle/{transponderId}/report_data/{id}
+		parts := strings.Split(rel, "/")
+		vehicle := single
+		switch {
+		case len(parts) == 2 && parts[0] == reportCollection:
+		case len(parts) == 4 && parts[0] == "vehicle" && parts[2] == reportCollection:
+			vehicle, err = strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, nil, fmt.Errorf("unexpected vehicle id in %s", rel)
+			}
+		default:
+			continue // vehicle documents or collections we don't replay
+		}
+		if !seen[vehicle] {
+			seen[vehicle] = true
+			vehicles = append(vehicles, vehicle)
+		}
+		r := FirestoreTransponderReportV1{}
+		err = mapToStruct(data, &r)
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s unpacking report %s, skipping it\n", yellow("WARN"), blue(rel))
+			continue
+		}
+		reports = append(reports, stream.VehicleReport{Vehicle: vehicle, Report: r})
 	}
+	sort.Ints(vehicles)
+	return vehicles, reports, nil
+}
 
-	return nil
+// read just the test document of an archive, named after the archived test
+func archiveTest(file string) (*optsCopy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ar, err := newArchiveReader(f)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		kind, _, data, err := ar.next()
+		if err != nil {
+			return nil, err // io.EOF included, archives always hold a test document
+		}
+		if kind == recTest {
+			var t optsCopy
+			err = mapToStruct(data, &t)
+			if err != nil {
+				return nil, fmt.Errorf("test document: %s", err)
+			}
+			t.Name = ar.Manifest.Test
+			return &t, nil
+		}
+	}
+}
+
+// parse --map 'sourceTransponderId:targetTransponderId' pairs
+func parseVehicleMap(pairs []string) (map[int]int, error) {
+	m := make(map[int]int)
+	for _, pair := range pairs {
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --map %q, expected 'sourceTransponderId:targetTransponderId'", pair)
+		}
+		src, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid source transponder in --map %q", pair)
+		}
+		dst, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid target transponder in --map %q", pair)
+		}
+		m[src] = dst
+	}
+	return m, nil
 }
 
 func (o *optsReplay) set(p *flags.Parser) (ok bool) {
@@ -135,6 +407,10 @@ func (o *optsReplay) set(p *flags.Parser) (ok bool) {
 	if !ok {
 		return false
 	}
+	o.Map, ok = p.Active.FindOptionByLongName("map").Value().([]string)
+	if !ok {
+		return false
+	}
 	o.Name, ok = p.Active.FindOptionByLongName("name").Value().(string)
 	if !ok {
 		return false
@@ -143,6 +419,38 @@ func (o *optsReplay) set(p *flags.Parser) (ok bool) {
 	if !ok {
 		return false
 	}
+	o.FromFile, ok = p.Active.FindOptionByLongName("from-file").Value().(string)
+	if !ok {
+		return false
+	}
+	o.SkipVerify, ok = p.Active.FindOptionByLongName("skip-verify").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.Tolerance, ok = p.Active.FindOptionByLongName("tolerance").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	o.Expect, ok = p.Active.FindOptionByLongName("expect").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.Scenario, ok = p.Active.FindOptionByLongName("scenario").Value().(string)
+	if !ok {
+		return false
+	}
+	o.AssertTimeout, ok = p.Active.FindOptionByLongName("assertTimeout").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	o.JUnit, ok = p.Active.FindOptionByLongName("junit").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Results, ok = p.Active.FindOptionByLongName("results").Value().(string)
+	if !ok {
+		return false
+	}
 	o.EmulatorProjectId, ok = p.Active.FindOptionByLongName("projectId").Value().(string)
 	if !ok {
 		return false
@@ -152,12 +460,12 @@ func (o *optsReplay) set(p *flags.Parser) (ok bool) {
 		return false
 	} else {
 		// see if this matches a localhost:port string (ze emulator)
-		if strings.Contains(o.Target, "localhost:") || strings.Contains(o.Target, "127.0.0.1:") {
+		if isEmulatorAddr(o.Target) {
 			o.TargetEmulator = true
 		} else {
 			o.TargetEmulator = false
 			// non-emulator replay targets not supported atm
-			fmt.Printf("%s replaying into non-local db is unsupported", red("ERROR"))
+			fmt.Fprintf(msgOut, "%s replaying into non-local db is unsupported", red("ERROR"))
 			return false
 		}
 	}
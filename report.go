@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// chart layout, in SVG user units
+const (
+	chartWidth   = 900.0
+	chartHeight  = 220.0
+	mapHeight    = 520.0
+	chartLeft    = 60.0 // room for y axis labels
+	chartRight   = 15.0
+	chartTop     = 15.0
+	chartBottom  = 30.0 // room for x axis labels
+	chartTicks   = 5
+	eventRadius  = 5.0
+	markerRadius = 7.0
+)
+
+// one color per vehicle, reused if a test has more vehicles than this
+var vehicleColors = []string{"#1f77b4", "#d62728", "#2ca02c", "#ff7f0e", "#9467bd", "#8c564b", "#e377c2", "#17becf"}
+
+// write a single self-contained HTML page about a test: route map, speed, battery and signal charts and an event timeline
+// everything is inlined (SVG charts, CSS), so the page works offline and can be passed around as a single file
+func report(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsReport
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse report args")
+	}
+	var tr *testRoutes
+	var err error
+	var description string
+	switch {
+	case opts.FromFile != "":
+		tr, err = archiveRoutes(opts.FromFile)
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s reading archive %s\n", red("ERROR"), blue(opts.FromFile))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+		tr.Test = opts.Name
+		if tr.Test == "" {
+			tr.Test = strings.TrimSuffix(filepath.Base(opts.FromFile), ".ndjson.gz")
+		}
+	case opts.Source != "" && opts.Name != "":
+		c, err := createFirestoreClient(ctx, fsClientConfig{c: opts.Source})
+		if err != nil {
+			return err
+		}
+		t, err := readTest(ctx, c.Collection("Tests").Doc(opts.Name))
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s finding test document: %s\n", red("ERROR"), blue(opts.Name))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+		description = t.Description
+		tr, err = loadRoutes(ctx, c, opts.Name)
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s reading test %s\n", red("ERROR"), blue(opts.Name))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+	default:
+		err = errors.New("report needs --source and --name, or --from-file")
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	if opts.HTML == "" {
+		opts.HTML = unsafeFileChars.ReplaceAllString(tr.Test, "_") + ".html"
+	}
+
+	page := buildReport(tr, description)
+	f, err := createExportFile(opts.HTML, opts.Force)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s creating report file %s\n", red("ERROR"), blue(opts.HTML))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	err = reportTemplate.Execute(f, page)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s writing report %s\n", red("ERROR"), blue(opts.HTML))
+		fmt.Fprintln(msgOut, err)
+		os.Remove(opts.HTML)
+		return err
+	}
+	fmt.Fprintf(msgOut, "%s wrote report for %s with %s reports to %s\n", green("success"), blue(tr.Test), blue(strconv.Itoa(page.Stats.Docs)), blue(opts.HTML))
+	return nil
+}
+
+// everything our HTML template renders
+type reportPage struct {
+	Test        string
+	Description string
+	Generated   time.Time
+	Stats       testStats
+	Vehicles    []reportVehicle
+	Map         svgChart
+	Speed       svgChart
+	Battery     svgChart
+	Signal      svgChart
+	Events      []reportEvent
+}
+
+type reportVehicle struct {
+	Transponder int
+	Color       string
+	Reports     int
+}
+
+// a single non status report on our timeline
+type reportEvent struct {
+	Time       time.Time
+	Vehicle    int
+	Color      string
+	Type       string
+	Speed      float64
+	SpeedLimit float64
+	Address    string
+	GeoTags    string
+	Detail     string // in progress, or how long it lasted
+}
+
+// svgChart is a plot already projected into SVG coordinates
+type svgChart struct {
+	Title  string
+	Width  float64
+	Height float64
+	Lines  []svgLine
+	Dots   []svgDot
+	XTicks []svgTick
+	YTicks []svgTick
+	Left   float64 // plot area, for axes and grid lines
+	Right  float64
+	Top    float64
+	Bottom float64
+	Empty  bool // nothing to plot
+}
+
+type svgLine struct {
+	Points string // 'x,y x,y ...'
+	Color  string
+	Dashed bool
+}
+
+type svgDot struct {
+	X, Y   float64
+	R      float64
+	Color  string
+	Title  string // tooltip
+	Stroke string
+}
+
+type svgTick struct {
+	Pos   float64
+	Label string
+}
+
+// a value over time for one vehicle
+type timeSeries struct {
+	Color  string
+	Dashed bool
+	Times  []time.Time
+	Values []float64
+}
+
+// shape a test's reports into our page
+func buildReport(tr *testRoutes, description string) *reportPage {
+	page := &reportPage{Test: tr.Test, Description: description, Generated: now()}
+	sb := newStatsBuilder()
+	var speed, battery, signal []timeSeries
+	for i, v := range tr.Vehicles {
+		color := vehicleColors[i%len(vehicleColors)]
+		reports := tr.Reports[v]
+		page.Vehicles = append(page.Vehicles, reportVehicle{Transponder: v, Color: color, Reports: len(reports)})
+		sp := timeSeries{Color: color}
+		limit := timeSeries{Color: color, Dashed: true}
+		bat := timeSeries{Color: color}
+		sig := timeSeries{Color: color}
+		for j := range reports {
+			r := &reports[j]
+			sb.add(SupportedTransponderReports[0], v, r)
+			if r.Type != statusReport {
+				page.Events = append(page.Events, newReportEvent(v, color, r))
+			}
+			sp.add(r.ReportTimestamp, r.Speed)
+			if r.SpeedLimit > 0 {
+				limit.add(r.ReportTimestamp, r.SpeedLimit)
+			}
+			if r.BatteryVoltage != 0 {
+				bat.add(r.ReportTimestamp, r.BatteryVoltage)
+			}
+			if r.CellSignalStrength != 0 {
+				sig.add(r.ReportTimestamp, r.CellSignalStrength)
+			}
+		}
+		speed = append(speed, sp, limit)
+		battery = append(battery, bat)
+		signal = append(signal, sig)
+	}
+	page.Stats = sb.result()
+	sort.SliceStable(page.Events, func(i, j int) bool { return page.Events[i].Time.Before(page.Events[j].Time) })
+	start, end := page.Stats.FirstReport, page.Stats.LastReport
+	page.Map = routeMap(tr, page.Vehicles)
+	page.Speed = timeChart("Speed vs speed limit (dashed)", start, end, speed, true)
+	page.Battery = timeChart("Battery voltage", start, end, battery, false)
+	page.Signal = timeChart("Cell signal strength", start, end, signal, false)
+	return page
+}
+
+func (s *timeSeries) add(t time.Time, v float64) {
+	if t.IsZero() {
+		return
+	}
+	s.Times = append(s.Times, t)
+	s.Values = append(s.Values, v)
+}
+
+func newReportEvent(vehicle int, color string, r *FirestoreTransponderReportV1) reportEvent {
+	e := reportEvent{
+		Time:       r.ReportTimestamp,
+		Vehicle:    vehicle,
+		Color:      color,
+		Type:       r.Type,
+		Speed:      r.Speed,
+		SpeedLimit: r.SpeedLimit,
+		Address:    r.Address,
+		GeoTags:    strings.Join(r.GeoTags, ", "),
+	}
+	switch {
+	case r.InProgress:
+		e.Detail = "in progress"
+	case r.Duration > 0:
+		e.Detail = "lasted " + (time.Duration(r.Duration * float64(time.Second))).Round(time.Second).String()
+	}
+	return e
+}
+
+// new chart with our standard plot area
+func newChart(title string, height float64) svgChart {
+	return svgChart{
+		Title:  title,
+		Width:  chartWidth,
+		Height: height,
+		Left:   chartLeft,
+		Right:  chartWidth - chartRight,
+		Top:    chartTop,
+		Bottom: height - chartBottom,
+	}
+}
+
+// plot series over [start, end], zeroBased charts always include 0 on their y axis
+func timeChart(title string, start, end time.Time, series []timeSeries, zeroBased bool) svgChart {
+	c := newChart(title, chartHeight)
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, s := range series {
+		for _, v := range s.Values {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+	}
+	if math.IsInf(lo, 1) || !end.After(start) {
+		c.Empty = true
+		return c
+	}
+	if zeroBased {
+		lo = math.Min(lo, 0)
+	}
+	if hi-lo < 1 {
+		lo, hi = lo-0.5, hi+0.5
+	}
+	pad := (hi - lo) * 0.05
+	if !zeroBased || lo < 0 {
+		lo -= pad
+	}
+	hi += pad
+	span := float64(end.Sub(start))
+	x := func(t time.Time) float64 { return c.Left + float64(t.Sub(start))/span*(c.Right-c.Left) }
+	y := func(v float64) float64 { return c.Bottom - (v-lo)/(hi-lo)*(c.Bottom-c.Top) }
+	for _, s := range series {
+		if len(s.Values) == 0 {
+			continue
+		}
+		pts := make([]string, len(s.Values))
+		for i, v := range s.Values {
+			pts[i] = svgXY(x(s.Times[i]), y(v))
+		}
+		c.Lines = append(c.Lines, svgLine{Points: strings.Join(pts, " "), Color: s.Color, Dashed: s.Dashed})
+	}
+	timeFormat := "15:04:05"
+	if end.Sub(start) > 24*time.Hour {
+		timeFormat = "Jan 2 15:04"
+	}
+	for i := 0; i <= chartTicks; i++ {
+		frac := float64(i) / chartTicks
+		t := start.Add(time.Duration(frac * span))
+		c.XTicks = append(c.XTicks, svgTick{Pos: x(t), Label: t.Format(timeFormat)})
+		v := lo + frac*(hi-lo)
+		c.YTicks = append(c.YTicks, svgTick{Pos: y(v), Label: strconv.FormatFloat(v, 'f', 1, 64)})
+	}
+	return c
+}
+
+// draw each vehicle's route with its events, projected so distances look right around the route's latitude
+func routeMap(tr *testRoutes, vehicles []reportVehicle) svgChart {
+	c := newChart("Route", mapHeight)
+	minLat, minLng, maxLat, maxLng := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, v := range tr.Vehicles {
+		for _, r := range tr.Reports[v] {
+			if r.LatLng == nil {
+				continue
+			}
+			minLat, maxLat = math.Min(minLat, r.LatLng.GetLatitude()), math.Max(maxLat, r.LatLng.GetLatitude())
+			minLng, maxLng = math.Min(minLng, r.LatLng.GetLongitude()), math.Max(maxLng, r.LatLng.GetLongitude())
+		}
+	}
+	if math.IsInf(minLat, 1) {
+		c.Empty = true
+		return c
+	}
+	// equirectangular projection, plenty for the area a trip covers
+	k := math.Cos(radians((minLat + maxLat) / 2))
+	w, h := (maxLng-minLng)*k, maxLat-minLat
+	scale := math.Inf(1)
+	if w > 0 {
+		scale = (c.Right - c.Left) / w
+	}
+	if h > 0 {
+		scale = math.Min(scale, (c.Bottom-c.Top)/h)
+	}
+	if math.IsInf(scale, 1) { // a single point
+		scale = 0
+	}
+	// center the route within our plot area
+	offX := c.Left + ((c.Right-c.Left)-w*scale)/2
+	offY := c.Top + ((c.Bottom-c.Top)-h*scale)/2
+	project := func(lat, lng float64) (float64, float64) {
+		return offX + (lng-minLng)*k*scale, offY + (maxLat-lat)*scale
+	}
+	for i, v := range tr.Vehicles {
+		color := vehicles[i].Color
+		var pts []string
+		var first, last *svgDot
+		for _, r := range tr.Reports[v] {
+			if r.LatLng == nil {
+				continue
+			}
+			px, py := project(r.LatLng.GetLatitude(), r.LatLng.GetLongitude())
+			pts = append(pts, svgXY(px, py))
+			tip := fmt.Sprintf("%d %s %s speed %.1f", v, r.Type, r.ReportTimestamp.Format(time.RFC3339), r.Speed)
+			if first == nil {
+				first = &svgDot{X: px, Y: py, R: markerRadius, Color: "#ffffff", Stroke: color, Title: "start " + tip}
+			}
+			last = &svgDot{X: px, Y: py, R: markerRadius, Color: color, Stroke: "#000000", Title: "end " + tip}
+			if r.Type != statusReport {
+				if r.Address != "" {
+					tip += " at " + r.Address
+				}
+				c.Dots = append(c.Dots, svgDot{X: px, Y: py, R: eventRadius, Color: color, Stroke: "#000000", Title: tip})
+			}
+		}
+		if len(pts) == 0 {
+			continue
+		}
+		c.Lines = append(c.Lines, svgLine{Points: strings.Join(pts, " "), Color: color})
+		c.Dots = append(c.Dots, *first, *last)
+	}
+	return c
+}
+
+func svgXY(x, y float64) string {
+	return strconv.FormatFloat(x, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64)
+}
+
+// Methods //
+
+// convert and set user-provided values into opts struct
+func (o *optsReport) set(p *flags.Parser) (ok bool) {
+	o.Source, ok = p.Active.FindOptionByLongName("source").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Name, ok = p.Active.FindOptionByLongName("name").Value().(string)
+	if !ok {
+		return false
+	}
+	o.FromFile, ok = p.Active.FindOptionByLongName("from-file").Value().(string)
+	if !ok {
+		return false
+	}
+	o.HTML, ok = p.Active.FindOptionByLongName("html").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Force, ok = p.Active.FindOptionByLongName("force").Value().(bool)
+	if !ok {
+		return false
+	}
+	return true
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"rfc3339": func(t time.Time) string { return t.Format(time.RFC3339) },
+	"clock":   func(t time.Time) string { return t.Format("15:04:05") },
+	"num":     func(f float64) string { return strconv.FormatFloat(f, 'f', 1, 64) },
+}).Parse(reportHTML))
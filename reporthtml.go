@@ -0,0 +1,86 @@
+package main
+
+// reportHTML renders a reportPage, it must stay self-contained: no scripts, fonts, tiles or styles from anywhere else
+const reportHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Test}} - replaystream trip report</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em auto; max-width: 960px; color: #222; }
+h1 { margin-bottom: 0.2em; }
+h2 { margin-top: 1.6em; border-bottom: 1px solid #ddd; padding-bottom: 0.2em; }
+.muted { color: #777; }
+.swatch { display: inline-block; width: 0.9em; height: 0.9em; border-radius: 50%; vertical-align: middle; margin-right: 0.3em; }
+table { border-collapse: collapse; width: 100%; font-size: 0.9em; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #eee; }
+th { background: #f6f6f6; }
+dl { display: grid; grid-template-columns: max-content auto; gap: 0.2em 1em; }
+dt { font-weight: bold; }
+dd { margin: 0; }
+svg { background: #fcfcfc; border: 1px solid #eee; }
+svg text { font-size: 11px; fill: #555; }
+svg .grid { stroke: #e6e6e6; stroke-width: 1; }
+svg .axis { stroke: #999; stroke-width: 1; }
+</style>
+</head>
+<body>
+<h1>{{.Test}}</h1>
+{{if .Description}}<p>{{.Description}}</p>{{end}}
+<p class="muted">generated {{rfc3339 .Generated}}</p>
+
+<h2>Summary</h2>
+<dl>
+<dt>vehicles</dt><dd>{{range .Vehicles}}<span class="swatch" style="background: {{.Color}}"></span>{{.Transponder}} ({{.Reports}} reports) {{end}}</dd>
+<dt>reports</dt><dd>{{.Stats.Docs}}{{range $type, $n := .Stats.DocsByType}} · {{$type}} {{$n}}{{end}}</dd>
+<dt>first report</dt><dd>{{rfc3339 .Stats.FirstReport}}</dd>
+<dt>last report</dt><dd>{{rfc3339 .Stats.LastReport}}</dd>
+<dt>duration</dt><dd>{{num .Stats.DurationSec}}s</dd>
+<dt>distance</dt><dd>{{num .Stats.Distance}}</dd>
+<dt>max speed</dt><dd>{{num .Stats.MaxSpeed}}</dd>
+{{with .Stats.IngestDelay}}<dt>ingest delay</dt><dd>median {{num .MedianMs}}ms · p95 {{num .P95Ms}}ms · max {{num .MaxMs}}ms</dd>{{end}}
+</dl>
+
+{{template "chart" .Map}}
+<p class="muted">Hollow circles mark where each vehicle started, filled ones where it ended, small dots are events. Hover for details.</p>
+{{template "chart" .Speed}}
+{{template "chart" .Battery}}
+{{template "chart" .Signal}}
+
+<h2>Event timeline</h2>
+{{if .Events}}
+<table>
+<tr><th>time</th><th>vehicle</th><th>type</th><th>speed</th><th>limit</th><th>address</th><th>geo tags</th><th></th></tr>
+{{range .Events}}<tr><td>{{rfc3339 .Time}}</td><td><span class="swatch" style="background: {{.Color}}"></span>{{.Vehicle}}</td><td>{{.Type}}</td><td>{{num .Speed}}</td><td>{{if .SpeedLimit}}{{num .SpeedLimit}}{{end}}</td><td>{{.Address}}</td><td>{{.GeoTags}}</td><td>{{.Detail}}</td></tr>
+{{end}}</table>
+{{else}}
+<p class="muted">No events, only status reports.</p>
+{{end}}
+</body>
+</html>
+{{define "chart"}}
+<h2>{{.Title}}</h2>
+{{if .Empty}}<p class="muted">Nothing to plot.</p>{{else}}
+<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+{{- $c := .}}
+{{- range .YTicks}}
+<line class="grid" x1="{{$c.Left}}" x2="{{$c.Right}}" y1="{{.Pos}}" y2="{{.Pos}}"/>
+<text x="{{$c.Left}}" y="{{.Pos}}" dx="-6" dy="4" text-anchor="end">{{.Label}}</text>
+{{- end}}
+{{- range .XTicks}}
+<line class="grid" x1="{{.Pos}}" x2="{{.Pos}}" y1="{{$c.Top}}" y2="{{$c.Bottom}}"/>
+<text x="{{.Pos}}" y="{{$c.Bottom}}" dy="16" text-anchor="middle">{{.Label}}</text>
+{{- end}}
+{{- if .YTicks}}
+<line class="axis" x1="{{.Left}}" x2="{{.Left}}" y1="{{.Top}}" y2="{{.Bottom}}"/>
+<line class="axis" x1="{{.Left}}" x2="{{.Right}}" y1="{{.Bottom}}" y2="{{.Bottom}}"/>
+{{- end}}
+{{- range .Lines}}
+<polyline fill="none" stroke="{{.Color}}" stroke-width="2"{{if .Dashed}} stroke-dasharray="6 4"{{end}} points="{{.Points}}"/>
+{{- end}}
+{{- range .Dots}}
+<circle cx="{{.X}}" cy="{{.Y}}" r="{{.R}}" fill="{{.Color}}" stroke="{{.Stroke}}" stroke-width="1.5"><title>{{.Title}}</title></circle>
+{{- end}}
+</svg>
+{{end}}
+{{end}}`
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"carmalink.com/replaystream/stream"
+)
+
+// everything a CI pipeline wants to know about one replay, written by --results as JSON
+type replayResults = stream.Results
+
+// final record emitted by replay in structured output modes
+func newReplaySummary(r *replayResults) replaySummary {
+	return replaySummary{
+		Event:        "summary",
+		Test:         r.Test,
+		Docs:         r.Docs,
+		Written:      r.Written,
+		Failed:       r.Failed,
+		Verified:     r.Verified,
+		Issues:       len(r.Issues),
+		Assertions:   len(r.Assertions),
+		AssertFailed: r.AssertFailed(),
+		Started:      r.Started,
+		Finished:     r.Finished,
+		DurationSec:  r.DurationSec,
+	}
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// write results as an indented JSON document
+func writeResults(file string, r *replayResults) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	err = r.WriteJSON(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write a JUnit XML report holding a test suite for each replay
+func writeJUnit(file string, results []*replayResults) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	err = stream.WriteJUnit(f, results...)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
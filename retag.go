@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"github.com/jessevdk/go-flags"
+)
+
+// add or remove tags on an existing test, keeping our tag index in step
+func retag(ctx context.Context, p *flags.Parser) error {
+	// tag has add/remove sub-commands of its own
+	sub := p.Active.Active
+	if sub == nil {
+		return errors.New("tag needs a sub-command: add or remove")
+	}
+	add := sub.Name == "add"
+	// collect args provided by user
+	var opts optsTagEdit
+	// populate our opts
+	ok := opts.set(sub)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse tag args")
+	}
+	// create our client based on usr provided opts
+	conf := fsClientConfig{c: opts.Source}
+	c, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	// work out which tags actually change inside a transaction so our index counts stay accurate
+	ref := c.Collection("Tests").Doc(opts.Name)
+	var changed []string
+	err = c.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		changed = nil
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var t optsCopy
+		err = snap.DataTo(&t)
+		if err != nil {
+			return err
+		}
+		have := make(map[string]bool, len(t.Tag))
+		for _, tag := range t.Tag {
+			have[tag] = true
+		}
+		for _, tag := range opts.Tag {
+			if have[tag] != add {
+				changed = append(changed, tag)
+				have[tag] = add
+			}
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		remaining := 0
+		for _, v := range have {
+			if v {
+				remaining++
+			}
+		}
+		if remaining == 0 {
+			return errors.New("a test needs at least one tag")
+		}
+		vals := make([]interface{}, len(changed))
+		for i, tag := range changed {
+			vals[i] = tag
+		}
+		var update interface{} = firestore.ArrayRemove(vals...)
+		if add {
+			update = firestore.ArrayUnion(vals...)
+		}
+		return tx.Update(ref, []firestore.Update{{Path: "Tag", Value: update}})
+	})
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s updating tags on test %s\n", red("ERROR"), blue(opts.Name))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	if len(changed) == 0 {
+		fmt.Fprintf(msgOut, "%s nothing to change\n", yellow("WARN"))
+		return nil
+	}
+	delta := -1
+	if add {
+		delta = 1
+	}
+	err = adjustTagIndex(ctx, c, changed, delta)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s updating tag index\n", red("ERROR"))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	fmt.Fprintf(msgOut, "%s %s tags: %s\n", green("success"), sub.Name, blue(strings.Join(changed, ", ")))
+	return nil
+}
+
+// Methods //
+
+// convert and set user-provided values into opts struct
+func (o *optsTagEdit) set(cmd *flags.Command) (ok bool) {
+	o.Source, ok = cmd.FindOptionByLongName("source").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Name, ok = cmd.FindOptionByLongName("name").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Tag, ok = cmd.FindOptionByLongName("tag").Value().([]string)
+	if !ok {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"carmalink.com/replaystream/stream"
+	"cloud.google.com/go/firestore"
+	"github.com/jessevdk/go-flags"
+)
+
+// everything show knows about a single test, this is also our --json output
+type testDetail struct {
+	Test     optsCopy
+	Vehicles []int
+	Stats    testStats        // computed from the test's current reports
+	Timeline []timelineSample `json:",omitempty"`
+}
+
+// a single report within our sampled timeline
+type timelineSample struct {
+	Vehicle         int
+	Type            string
+	ReportTimestamp time.Time
+	Speed           float64
+	SpeedLimit      float64
+	Lat             float64
+	Lng             float64
+	IngestDelayMs   float64
+}
+
+func show(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsShow
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return fmt.Errorf("unable to parse show args")
+	}
+	// create our client based on usr provided opts
+	conf := fsClientConfig{c: opts.Source}
+	c, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	d, err := loadTestDetail(ctx, c, opts.Name, opts.Samples)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s loading test %s\n", red("ERROR"), blue(opts.Name))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	switch {
+	case opts.JSON || args.Output == outputJSON:
+		enc := json.NewEncoder(dataOut)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	case args.Output == outputNDJSON:
+		return json.NewEncoder(dataOut).Encode(d)
+	case args.Output == outputCSV: // csv only carries our timeline
+		rw := newRecordWriter(args.Output)
+		for _, s := range d.Timeline {
+			if err := rw.write(s); err != nil {
+				return err
+			}
+		}
+		return rw.close()
+	}
+	printTestDetail(d)
+	return nil
+}
+
+// read a test document and all of its reports, sampling up to samples reports into a timeline
+func loadTestDetail(ctx context.Context, c *firestore.Client, name string, samples int) (*testDetail, error) {
+	snap, err := c.Collection("Tests").Doc(name).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d := &testDetail{}
+	err = snap.DataTo(&d.Test)
+	if err != nil {
+		return nil, err
+	}
+	vehicles, err := stream.TestVehicles(ctx, snap)
+	if err != nil {
+		return nil, err
+	}
+	sb := newStatsBuilder()
+	var all []timelineSample
+	for _, v := range vehicles {
+		d.Vehicles = append(d.Vehicles, v.Transponder)
+		for _, reportCollection := range SupportedTransponderReports {
+			docs, err := v.Reports(reportCollection).OrderBy("reportTimestamp", firestore.Asc).Documents(ctx).GetAll()
+			if err != nil {
+				return nil, err
+			}
+			for _, doc := range docs {
+				r := FirestoreTransponderReportV1{}
+				if err := doc.DataTo(&r); err != nil {
+					fmt.Fprintf(os.Stderr, "%s unable to read report %s\n", yellow("WARN"), doc.Ref.ID)
+					continue
+				}
+				sb.add(reportCollection, v.Transponder, &r)
+				all = append(all, sampleOf(v.Transponder, &r))
+			}
+		}
+	}
+	d.Stats = sb.result()
+	sort.SliceStable(all, func(i, j int) bool { return all[i].ReportTimestamp.Before(all[j].ReportTimestamp) })
+	d.Timeline = sampleTimeline(all, samples)
+	return d, nil
+}
+
+func (s timelineSample) csvHeader() []string {
+	return []string{"vehicle", "type", "reportTimestamp", "speed", "speedLimit", "lat", "lng", "ingestDelayMs"}
+}
+
+func (s timelineSample) csvRow() []string {
+	return []string{strconv.Itoa(s.Vehicle), s.Type, csvTime(s.ReportTimestamp), csvFloat(s.Speed), csvFloat(s.SpeedLimit),
+		csvFloat(s.Lat), csvFloat(s.Lng), csvFloat(s.IngestDelayMs)}
+}
+
+func sampleOf(vehicle int, r *FirestoreTransponderReportV1) timelineSample {
+	s := timelineSample{
+		Vehicle:         vehicle,
+		Type:            r.Type,
+		ReportTimestamp: r.ReportTimestamp,
+		Speed:           r.Speed,
+		SpeedLimit:      r.SpeedLimit,
+	}
+	if r.LatLng != nil {
+		s.Lat, s.Lng = r.LatLng.GetLatitude(), r.LatLng.GetLongitude()
+	}
+	if !r.FirestoreCreation.IsZero() && !r.ReportTimestamp.IsZero() {
+		s.IngestDelayMs = float64(r.FirestoreCreation.Sub(r.ReportTimestamp)) / float64(time.Millisecond)
+	}
+	return s
+}
+
+// pick n evenly spaced samples, always keeping the first and last, n <= 0 keeps everything
+func sampleTimeline(all []timelineSample, n int) []timelineSample {
+	if n <= 0 || len(all) <= n {
+		return all
+	}
+	if n == 1 {
+		return all[:1]
+	}
+	out := make([]timelineSample, 0, n)
+	for i := 0; i < n; i++ {
+		out = append(out, all[i*(len(all)-1)/(n-1)])
+	}
+	return out
+}
+
+func printTestDetail(d *testDetail) {
+	t := d.Test
+	fmt.Fprintf(msgOut, "%s : %s\n", blue("name"), green(t.Name))
+	if t.Description != "" {
+		fmt.Fprintf(msgOut, "%s : %s\n", blue("description"), t.Description)
+	}
+	fmt.Fprintf(msgOut, "%s : %s\n", blue("tags"), green(strings.Join(t.Tag, ", ")))
+	fmt.Fprintf(msgOut, "%s : %s\n", blue("account"), green(strconv.Itoa(t.Account)))
+	vehicles := make([]string, len(d.Vehicles))
+	for i, v := range d.Vehicles {
+		vehicles[i] = strconv.Itoa(v)
+	}
+	fmt.Fprintf(msgOut, "%s : %s\n", blue("vehicles"), green(strings.Join(vehicles, ", ")))
+	fmt.Fprintf(msgOut, "%s : %s -> %s\n", blue("captured"), green(t.StartTime.Format(time.RFC3339)), green(t.EndTime.Format(time.RFC3339)))
+	if len(t.Type) > 0 {
+		fmt.Fprintf(msgOut, "%s : %s\n", blue("type filter"), green(strings.Join(t.Type, ", ")))
+	}
+	fmt.Fprintf(msgOut, "%s : start %s / end %s\n", blue("inclusive"), green(strconv.FormatBool(t.IncStart)), green(strconv.FormatBool(t.IncEnd)))
+
+	fmt.Fprintf(msgOut, "%s\n", yellow("stored statistics"))
+	printStats(t.Stats, "    ")
+	fmt.Fprintf(msgOut, "%s\n", yellow("current statistics"))
+	printStats(&d.Stats, "    ")
+
+	fmt.Fprintf(msgOut, "%s (%d samples)\n", yellow("timeline"), len(d.Timeline))
+	for _, s := range d.Timeline {
+		fmt.Fprintf(msgOut, "    %s  %-6d %-12s speed %6.1f/%-6.1f at %11.6f,%-11.6f delay %6.0fms\n",
+			s.ReportTimestamp.Format(time.RFC3339), s.Vehicle, blue(s.Type), s.Speed, s.SpeedLimit, s.Lat, s.Lng, s.IngestDelayMs)
+	}
+}
+
+// Methods //
+
+// convert and set user-provided values into opts struct
+func (o *optsShow) set(p *flags.Parser) (ok bool) {
+	o.Source, ok = p.Active.FindOptionByLongName("source").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Name, ok = p.Active.FindOptionByLongName("name").Value().(string)
+	if !ok {
+		return false
+	}
+	o.JSON, ok = p.Active.FindOptionByLongName("json").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.Samples, ok = p.Active.FindOptionByLongName("samples").Value().(int)
+	if !ok {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"carmalink.com/replaystream/stream"
+)
+
+// Summary of a test's reports, computed during copy and stored on the Tests document as "Stats"
+type testStats = stream.TestStats
+
+type boundingBox = stream.BoundingBox
+
+// ingest delay distribution in milliseconds
+type delayStats = stream.DelayStats
+
+// statsBuilder accumulates reports one at a time and produces a testStats
+type statsBuilder struct {
+	stats    testStats
+	delays   []float64
+	odoMin   map[int]float64 // per vehicle
+	odoMax   map[int]float64
+	haveTime bool
+}
+
+func newStatsBuilder() *statsBuilder {
+	return &statsBuilder{
+		stats: testStats{
+			DocsByCollection: make(map[string]int),
+			DocsByType:       make(map[string]int),
+		},
+		odoMin: make(map[int]float64),
+		odoMax: make(map[int]float64),
+	}
+}
+
+// add a single report belonging to vehicle (original transponder id) from collection ex: report_data
+func (b *statsBuilder) add(collection string, vehicle int, r *FirestoreTransponderReportV1) {
+	s := &b.stats
+	s.Docs++
+	s.DocsByCollection[collection]++
+	s.DocsByType[r.Type]++
+	if !r.ReportTimestamp.IsZero() {
+		if !b.haveTime || r.ReportTimestamp.Before(s.FirstReport) {
+			s.FirstReport = r.ReportTimestamp
+		}
+		if !b.haveTime || r.ReportTimestamp.After(s.LastReport) {
+			s.LastReport = r.ReportTimestamp
+		}
+		b.haveTime = true
+		if !r.FirestoreCreation.IsZero() {
+			b.delays = append(b.delays, float64(r.FirestoreCreation.Sub(r.ReportTimestamp))/float64(time.Millisecond))
+		}
+	}
+	if r.Odometer > 0 {
+		if min, ok := b.odoMin[vehicle]; !ok || r.Odometer < min {
+			b.odoMin[vehicle] = r.Odometer
+		}
+		if r.Odometer > b.odoMax[vehicle] {
+			b.odoMax[vehicle] = r.Odometer
+		}
+	}
+	if r.Speed > s.MaxSpeed {
+		s.MaxSpeed = r.Speed
+	}
+	if r.LatLng != nil {
+		lat, lng := r.LatLng.GetLatitude(), r.LatLng.GetLongitude()
+		if s.BoundingBox == nil {
+			s.BoundingBox = &boundingBox{MinLat: lat, MinLng: lng, MaxLat: lat, MaxLng: lng}
+		} else {
+			s.BoundingBox.MinLat = math.Min(s.BoundingBox.MinLat, lat)
+			s.BoundingBox.MinLng = math.Min(s.BoundingBox.MinLng, lng)
+			s.BoundingBox.MaxLat = math.Max(s.BoundingBox.MaxLat, lat)
+			s.BoundingBox.MaxLng = math.Max(s.BoundingBox.MaxLng, lng)
+		}
+	}
+}
+
+// finish up our derived fields and return the summary
+func (b *statsBuilder) result() testStats {
+	s := b.stats
+	s.DurationSec = s.LastReport.Sub(s.FirstReport).Seconds()
+	s.Distance = 0
+	for v, max := range b.odoMax {
+		s.Distance += max - b.odoMin[v]
+	}
+	s.IngestDelay = stream.NewDelayStats(append([]float64(nil), b.delays...))
+	return s
+}
@@ -0,0 +1,386 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Scenario is a scenario file, JSON:
+//
+//	{"assertions": [
+//	  {"name": "speeding alert", "path": "account/{account}/alerts", "where": ["type == speeding"], "count": 1, "timeout": "2m"}
+//	]}
+type Scenario struct {
+	Assertions []Assertion `json:"assertions"`
+}
+
+// Assertion waits for documents matching every predicate in Where to show up in a collection of the target db
+// Path is a collection path ex: 'account/{account}/alerts', {account} and {transponder} are filled in from the replay,
+// a path starting with '**/' is a collection group ex: '**/trip_summaries'
+type Assertion struct {
+	Name    string   `json:"name"`
+	Path    string   `json:"path"`
+	Where   []string `json:"where"`
+	Count   int      `json:"count"`   // at least this many documents, default is 1
+	Timeout Duration `json:"timeout"` // default is Options.AssertTimeout
+}
+
+// Duration is a time.Duration written as a string ex: "90s" in JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// AssertionResult is the outcome of a single assertion
+type AssertionResult struct {
+	Event     string // always "assertion"
+	Name      string
+	Path      string
+	Where     []string
+	Want      int
+	Found     int
+	Passed    bool
+	WaitedSec float64
+	Error     string `json:",omitempty"`
+}
+
+// LoadScenario reads a scenario file
+func LoadScenario(file string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var s Scenario
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return &s, nil
+}
+
+// ParseExpect parses 'path: predicate, predicate...' ex: 'account/{account}/alerts: type == speeding', what replay --expect takes
+func ParseExpect(s string) (Assertion, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return Assertion{}, fmt.Errorf("expected 'path: predicate, ...', got %q", s)
+	}
+	a := Assertion{Name: strings.TrimSpace(s), Path: strings.TrimSpace(s[:i])}
+	for _, pred := range splitPredicates(s[i+1:]) {
+		if pred = strings.TrimSpace(pred); pred != "" {
+			a.Where = append(a.Where, pred)
+		}
+	}
+	return a, nil
+}
+
+// split on commas outside of quoted values ex: "driver == 'Smith, J', type == speeding"
+func splitPredicates(s string) []string {
+	var preds []string
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			preds = append(preds, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(preds, s[start:])
+}
+
+// expand placeholders, one assertion per target transponder if its path refers to {transponder}
+func expandAssertions(as []Assertion, account int, transponders []int, timeout time.Duration) []Assertion {
+	var out []Assertion
+	for _, a := range as {
+		if a.Count <= 0 {
+			a.Count = 1
+		}
+		if a.Timeout <= 0 {
+			a.Timeout = Duration(timeout)
+		}
+		if a.Name == "" {
+			a.Name = a.Path
+		}
+		a.Path = strings.ReplaceAll(a.Path, "{account}", strconv.Itoa(account))
+		if !strings.Contains(a.Path, "{transponder}") {
+			out = append(out, a)
+			continue
+		}
+		for _, x := range transponders {
+			ax := a
+			ax.Path = strings.ReplaceAll(a.Path, "{transponder}", strconv.Itoa(x))
+			ax.Name = strings.ReplaceAll(a.Name, "{transponder}", strconv.Itoa(x))
+			out = append(out, ax)
+		}
+	}
+	return out
+}
+
+// wait on every assertion, each up to its own timeout from when we start, for documents created since since
+// all assertions wait at the same time so a slow one doesn't eat into another's timeout
+func runAssertions(ctx context.Context, c *firestore.Client, as []Assertion, since time.Time) []AssertionResult {
+	results := make([]AssertionResult, len(as))
+	done := make(chan struct{}, len(as))
+	start := now()
+	for i := range as {
+		go func(i int) {
+			results[i] = runAssertion(ctx, c, &as[i], since, start)
+			done <- struct{}{}
+		}(i)
+	}
+	for range as {
+		<-done
+	}
+	return results
+}
+
+func runAssertion(ctx context.Context, c *firestore.Client, a *Assertion, since, start time.Time) AssertionResult {
+	res := AssertionResult{Event: "assertion", Name: a.Name, Path: a.Path, Where: a.Where, Want: a.Count}
+	preds, err := parsePredicates(a.Where)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	var q firestore.Query
+	if strings.HasPrefix(a.Path, "**/") {
+		q = c.CollectionGroup(strings.TrimPrefix(a.Path, "**/")).Query
+	} else if col := c.Collection(a.Path); col != nil {
+		q = col.Query
+	} else {
+		res.Error = "not a collection path"
+		return res
+	}
+	// equality filters are cheap for Firestore to do for us, everything else is checked here
+	for _, p := range preds {
+		if p.op == "==" {
+			q = q.Where(p.field, "==", p.value)
+		}
+	}
+	// listen instead of polling, after our first snapshot Firestore only sends us what changed
+	wctx, cancel := context.WithDeadline(ctx, start.Add(time.Duration(a.Timeout)))
+	defer cancel()
+	iter := q.Snapshots(wctx)
+	defer iter.Stop()
+	matched := make(map[string]bool) // paths of documents created since since matching every predicate
+	for {
+		snap, err := iter.Next()
+		res.WaitedSec = now().Sub(start).Seconds()
+		switch {
+		case ctx.Err() != nil:
+			res.Error = ctx.Err().Error()
+			return res
+		case wctx.Err() != nil:
+			res.Error = fmt.Sprintf("timed out after %s", time.Duration(a.Timeout))
+			return res
+		case err != nil:
+			res.Error = err.Error()
+			return res
+		}
+		for _, change := range snap.Changes {
+			path := change.Doc.Ref.Path
+			if change.Kind != firestore.DocumentRemoved && !change.Doc.CreateTime.Before(since) && matchesAll(preds, change.Doc.Data()) {
+				matched[path] = true
+			} else {
+				delete(matched, path)
+			}
+		}
+		res.Found = len(matched)
+		if res.Found >= a.Count {
+			res.Passed = true
+			return res
+		}
+	}
+}
+
+// true if data satisfies every predicate
+func matchesAll(preds []predicate, data map[string]interface{}) bool {
+	for _, p := range preds {
+		if !p.matches(data) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks an assertion has a path and that its predicates parse
+func (a Assertion) Validate() error {
+	if a.Path == "" {
+		return errors.New("every assertion needs a path")
+	}
+	_, err := parsePredicates(a.Where)
+	return err
+}
+
+// field op value ex: 'type == speeding', 'severity >= 2', 'geoTags contains depot'
+type predicate struct {
+	field string
+	op    string
+	value interface{}
+}
+
+var predicateRe = regexp.MustCompile(`^\s*([\w.]+)\s*(==|!=|<=|>=|<|>|\bcontains\b)\s*(.*?)\s*$`)
+
+func parsePredicates(where []string) ([]predicate, error) {
+	var preds []predicate
+	for _, w := range where {
+		m := predicateRe.FindStringSubmatch(w)
+		if m == nil {
+			return nil, fmt.Errorf("invalid predicate %q, expected 'field op value'", w)
+		}
+		preds = append(preds, predicate{field: m[1], op: m[2], value: parsePredicateValue(m[3])})
+	}
+	return preds, nil
+}
+
+// numbers, true/false, null, RFC3339 timestamps and quoted or bare strings
+func parsePredicateValue(s string) interface{} {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t
+	}
+	return s
+}
+
+func (p predicate) matches(data map[string]interface{}) bool {
+	var v interface{} = data
+	for _, part := range strings.Split(p.field, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		v = m[part]
+	}
+	switch p.op {
+	case "contains":
+		vals, _ := v.([]interface{})
+		for _, e := range vals {
+			if compareValues(e, p.value) == 0 {
+				return true
+			}
+		}
+		return false
+	case "==":
+		return compareValues(v, p.value) == 0
+	case "!=":
+		return compareValues(v, p.value) != 0
+	}
+	c := compareValues(v, p.value)
+	if c == incomparable {
+		return false
+	}
+	switch p.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// returned by compareValues for values of different kinds
+const incomparable = 2
+
+// -1, 0 or 1 like strings.Compare, incomparable if a and b aren't the same kind of value
+func compareValues(a, b interface{}) int {
+	switch av := a.(type) {
+	case int64:
+		return compareValues(float64(av), b)
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return incomparable
+		}
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		}
+		return 0
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return incomparable
+		}
+		return strings.Compare(av, bv)
+	case bool:
+		bv, ok := b.(bool)
+		if !ok {
+			return incomparable
+		}
+		if av == bv {
+			return 0
+		}
+		return incomparable
+	case time.Time:
+		bv, ok := b.(time.Time)
+		if !ok {
+			return incomparable
+		}
+		switch {
+		case av.Before(bv):
+			return -1
+		case av.After(bv):
+			return 1
+		}
+		return 0
+	case nil:
+		if b == nil {
+			return 0
+		}
+	}
+	return incomparable
+}
+
+// target transponders in ascending order
+func sortedTargets(targets map[int]int) []int {
+	var xs []int
+	for _, x := range targets {
+		xs = append(xs, x)
+	}
+	sort.Ints(xs)
+	return xs
+}
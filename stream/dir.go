@@ -0,0 +1,287 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirStore keeps tests and reports as JSON files in a local directory, so tests can be kept without any database:
+//
+//	{dir}/tests/{name}.json                             test document
+//	{dir}/tests/{name}.ndjson                           its reports, one per line
+//	{dir}/account/{account}/vehicle/{transponder}/report_data.ndjson   vehicle reports, one per line
+//
+// test names are URL path escaped ex: 'truckster 5 min trip' -> truckster%205%20min%20trip.json
+// a report's raw Data is kept typed like an archive (see EncodeFields) so it comes back exactly as it was stored
+type DirStore struct {
+	Dir string
+
+	mu sync.Mutex
+}
+
+// NewDirStore uses dir, which is created along with anything below it as needed
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{Dir: dir}
+}
+
+func (s *DirStore) testFile(name, ext string) string {
+	return filepath.Join(s.Dir, "tests", url.PathEscape(name)+ext)
+}
+
+func (s *DirStore) Test(ctx context.Context, name string) (*TestDoc, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readTest(s.testFile(name, ".json"))
+}
+
+func (s *DirStore) readTest(file string) (*TestDoc, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t TestDoc
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *DirStore) Tests(ctx context.Context, q TestQuery, fn func(t *TestDoc) bool) error {
+	s.mu.Lock()
+	files, err := filepath.Glob(filepath.Join(s.Dir, "tests", "*.json"))
+	var tests []*TestDoc
+	for _, file := range files {
+		t, err := s.readTest(file)
+		if err != nil {
+			continue // not one of ours
+		}
+		tests = append(tests, t)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return selectTests(tests, q, fn)
+}
+
+func (s *DirStore) PutTest(ctx context.Context, t *TestDoc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *t
+	if stored.Created.IsZero() {
+		stored.Created = now()
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := s.testFile(t.Name, ".json")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	// an overwritten test starts out empty
+	if err := os.Remove(s.testFile(t.Name, ".ndjson")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
+
+func (s *DirStore) TestReports(ctx context.Context, t *TestDoc) ([]VehicleReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var reports []VehicleReport
+	err := readLines(s.testFile(t.Name, ".ndjson"), func(line []byte) error {
+		var dr dirReport
+		data, err := dr.decode(line)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, VehicleReport{Vehicle: dr.Vehicle, Report: dr.Report, Data: data})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sortTestReports(reports)
+	return reports, nil
+}
+
+func (s *DirStore) AddTestReport(ctx context.Context, t *TestDoc, vr VehicleReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dr, err := newDirReport(vr.Report, vr.Data)
+	if err != nil {
+		return err
+	}
+	dr.Vehicle = vr.Vehicle
+	return appendLine(s.testFile(t.Name, ".ndjson"), dr)
+}
+
+func (s *DirStore) Reports(ctx context.Context, account, transponder int, q ReportQuery) ([]StoredReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var reports []StoredReport
+	err := s.readReports(reportsPath(account, transponder), func(sr *StoredReport) {
+		if q.matches(&sr.Report) {
+			reports = append(reports, *sr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortByReportTime(reports)
+	return reports, nil
+}
+
+func (s *DirStore) WriteReport(ctx context.Context, account, transponder int, r Report) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	col := reportsPath(account, transponder)
+	created := now()
+	if r.FirestoreCreation.IsZero() {
+		r.FirestoreCreation = created
+	}
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	dr := dirReport{Path: col + "/" + id, Created: created, Report: r}
+	return dr.Path, appendLine(filepath.Join(s.Dir, filepath.FromSlash(col)+".ndjson"), dr)
+}
+
+func (s *DirStore) ReadReports(ctx context.Context, paths []string) ([]*StoredReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// each collection is only read once
+	byPath := make(map[string]*StoredReport)
+	read := make(map[string]bool)
+	reports := make([]*StoredReport, len(paths))
+	for i, path := range paths {
+		col := path
+		if j := strings.LastIndex(path, "/"); j >= 0 {
+			col = path[:j]
+		}
+		if !read[col] {
+			read[col] = true
+			err := s.readReports(col, func(sr *StoredReport) { byPath[sr.Path] = sr })
+			if err != nil {
+				return nil, err
+			}
+		}
+		reports[i] = byPath[path]
+	}
+	return reports, nil
+}
+
+// hand every report of a collection to fn, a collection we haven't written to yet is empty
+func (s *DirStore) readReports(col string, fn func(sr *StoredReport)) error {
+	err := readLines(filepath.Join(s.Dir, filepath.FromSlash(col)+".ndjson"), func(line []byte) error {
+		var dr dirReport
+		data, err := dr.decode(line)
+		if err != nil {
+			return err
+		}
+		fn(&StoredReport{Path: dr.Path, Created: dr.Created, Report: dr.Report, Data: data})
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func readLines(file string, fn func(line []byte) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		if err := fn(sc.Bytes()); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func appendLine(file string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// random document id, like Firestore's NewDoc
+func newID() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating document id: %s", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// a single line of our ndjson files
+type dirReport struct {
+	Vehicle int       `json:",omitempty"` // test reports: original vehicle
+	Path    string    `json:",omitempty"` // vehicle reports: where we keep it
+	Created time.Time `json:",omitempty"`
+	Report  Report
+	Fields  map[string]interface{} `json:",omitempty"` // the report's raw Data, typed
+}
+
+func newDirReport(r Report, data map[string]interface{}) (dirReport, error) {
+	dr := dirReport{Report: r}
+	if data != nil {
+		fields, err := EncodeFields(data)
+		if err != nil {
+			return dr, err
+		}
+		dr.Fields = fields
+	}
+	return dr, nil
+}
+
+// unpack a line, returns the report's raw Data if it had any
+func (dr *dirReport) decode(line []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber() // keeps integers apart from doubles in our typed fields
+	if err := dec.Decode(dr); err != nil {
+		return nil, err
+	}
+	if dr.Fields == nil {
+		return nil, nil
+	}
+	return DecodeFields(dr.Fields)
+}
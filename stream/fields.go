@@ -0,0 +1,231 @@
+package stream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// DocPath is a document reference kept as a path relative to the database root ex: 'account/18/vehicle/83'
+// what DecodeFields turns references into, so they can be written into another database
+type DocPath string
+
+// ResolveRefs swaps DocPaths within decoded fields for real references within a client's database
+func ResolveRefs(c *firestore.Client, v interface{}) interface{} {
+	switch t := v.(type) {
+	case DocPath:
+		return c.Doc(string(t))
+	case []interface{}:
+		for i := range t {
+			t[i] = ResolveRefs(c, t[i])
+		}
+	case map[string]interface{}:
+		for k := range t {
+			t[k] = ResolveRefs(c, t[k])
+		}
+	}
+	return v
+}
+
+// Typed values //
+//
+// Field values are typed the same way Firestore's REST API does it ex: {"timestampValue":"2021-03-05T13:40:00.123456Z"},
+// {"geoPointValue":{"latitude":1,"longitude":2}} so timestamps, lat/lngs, integers vs doubles and references survive JSON.
+
+// EncodeFields turns document data as returned by DocumentSnapshot.Data() into its typed JSON form
+func EncodeFields(data map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		ev, err := encodeValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", k, err)
+		}
+		out[k] = ev
+	}
+	return out, nil
+}
+
+// encode a value as returned by DocumentSnapshot.Data() into its typed JSON form
+func encodeValue(v interface{}) (map[string]interface{}, error) {
+	switch t := v.(type) {
+	case nil:
+		return map[string]interface{}{"nullValue": nil}, nil
+	case bool:
+		return map[string]interface{}{"booleanValue": t}, nil
+	case int64:
+		// strings keep 64 bit integers exact, as Firestore's REST API does
+		return map[string]interface{}{"integerValue": strconv.FormatInt(t, 10)}, nil
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return map[string]interface{}{"doubleValue": strconv.FormatFloat(t, 'g', -1, 64)}, nil
+		}
+		return map[string]interface{}{"doubleValue": t}, nil
+	case string:
+		return map[string]interface{}{"stringValue": t}, nil
+	case []byte:
+		return map[string]interface{}{"bytesValue": base64.StdEncoding.EncodeToString(t)}, nil
+	case time.Time:
+		return map[string]interface{}{"timestampValue": t.UTC().Format(time.RFC3339Nano)}, nil
+	case *latlng.LatLng:
+		return map[string]interface{}{"geoPointValue": map[string]interface{}{"latitude": t.GetLatitude(), "longitude": t.GetLongitude()}}, nil
+	case *firestore.DocumentRef:
+		return map[string]interface{}{"referenceValue": refPath(t)}, nil
+	case []interface{}:
+		vals := make([]interface{}, len(t))
+		for i, e := range t {
+			ev, err := encodeValue(e)
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = ev
+		}
+		return map[string]interface{}{"arrayValue": vals}, nil
+	case map[string]interface{}:
+		fields, err := EncodeFields(t)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"mapValue": fields}, nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", v)
+}
+
+// path of a document relative to its database root ex: 'account/18/vehicle/83'
+func refPath(ref *firestore.DocumentRef) string {
+	var parts []string
+	for d := ref; d != nil; {
+		parts = append(parts, d.ID, d.Parent.ID)
+		d = d.Parent.Parent
+	}
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return strings.Join(parts, "/")
+}
+
+// DecodeFields turns typed JSON fields back into data Firestore accepts for writes, numbers need to be json.Numbers
+// (decoded with UseNumber) and references come back as DocPaths
+func DecodeFields(fields map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		dv, err := decodeValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", k, err)
+		}
+		out[k] = dv
+	}
+	return out, nil
+}
+
+// decode a typed JSON value back into the Go type Firestore writes it as
+func decodeValue(v interface{}) (interface{}, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return nil, errors.New("expected a single typed value ex: {\"stringValue\": \"...\"}")
+	}
+	var typ string
+	var raw interface{}
+	for typ, raw = range m {
+	}
+	switch typ {
+	case "nullValue":
+		return nil, nil
+	case "booleanValue":
+		b, ok := raw.(bool)
+		if !ok {
+			return nil, errors.New("booleanValue isn't a bool")
+		}
+		return b, nil
+	case "integerValue":
+		s, ok := raw.(string)
+		if !ok {
+			if n, isNum := raw.(json.Number); isNum {
+				s, ok = n.String(), true
+			}
+		}
+		if !ok {
+			return nil, errors.New("integerValue isn't an integer")
+		}
+		return strconv.ParseInt(s, 10, 64)
+	case "doubleValue":
+		switch n := raw.(type) {
+		case json.Number:
+			return n.Float64()
+		case string: // NaN, +Inf, -Inf
+			return strconv.ParseFloat(n, 64)
+		}
+		return nil, errors.New("doubleValue isn't a number")
+	case "stringValue":
+		s, ok := raw.(string)
+		if !ok {
+			return nil, errors.New("stringValue isn't a string")
+		}
+		return s, nil
+	case "bytesValue":
+		s, ok := raw.(string)
+		if !ok {
+			return nil, errors.New("bytesValue isn't a base64 string")
+		}
+		return base64.StdEncoding.DecodeString(s)
+	case "timestampValue":
+		s, ok := raw.(string)
+		if !ok {
+			return nil, errors.New("timestampValue isn't a string")
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	case "geoPointValue":
+		g, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("geoPointValue isn't an object")
+		}
+		lat, err1 := jsonFloat(g["latitude"])
+		lng, err2 := jsonFloat(g["longitude"])
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("geoPointValue needs numeric latitude and longitude")
+		}
+		return &latlng.LatLng{Latitude: lat, Longitude: lng}, nil
+	case "referenceValue":
+		s, ok := raw.(string)
+		if !ok || strings.Count(s, "/")%2 != 1 {
+			return nil, errors.New("referenceValue isn't a document path")
+		}
+		return DocPath(s), nil
+	case "arrayValue":
+		a, ok := raw.([]interface{})
+		if !ok {
+			return nil, errors.New("arrayValue isn't an array")
+		}
+		vals := make([]interface{}, len(a))
+		for i, e := range a {
+			dv, err := decodeValue(e)
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = dv
+		}
+		return vals, nil
+	case "mapValue":
+		f, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("mapValue isn't an object")
+		}
+		return DecodeFields(f)
+	}
+	return nil, fmt.Errorf("unknown value type %q", typ)
+}
+
+func jsonFloat(v interface{}) (float64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, errors.New("not a number")
+	}
+	return n.Float64()
+}
@@ -0,0 +1,322 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Firestore can hold up to this many documents in a single GetAll
+	maxGetAll = 500
+	// and commits at most this many writes at a time
+	maxBatchWrites = 500
+)
+
+// FirestoreStore keeps tests in Tests/{name} and reads and writes vehicle reports under account/{account}/vehicle/{transponder}
+type FirestoreStore struct {
+	Client *firestore.Client
+
+	mu       sync.Mutex
+	vehicles map[string]bool // multi vehicle test documents we've set up
+}
+
+// NewFirestoreStore wraps a Firestore client, a test db, a local emulator or both
+func NewFirestoreStore(c *firestore.Client) *FirestoreStore {
+	return &FirestoreStore{Client: c, vehicles: make(map[string]bool)}
+}
+
+func (s *FirestoreStore) Test(ctx context.Context, name string) (*TestDoc, error) {
+	snap, err := s.Client.Collection("Tests").Doc(name).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return testDoc(snap)
+}
+
+func testDoc(snap *firestore.DocumentSnapshot) (*TestDoc, error) {
+	var t TestDoc
+	if err := snap.DataTo(&t); err != nil {
+		return nil, fmt.Errorf("test document: %s", err)
+	}
+	if t.Name == "" {
+		t.Name = snap.Ref.ID
+	}
+	if t.Created.IsZero() { // tests copied before we stored it
+		t.Created = snap.CreateTime
+	}
+	return &t, nil
+}
+
+// tags, sorting, name prefix (when sorting by name) and our page cursor are done by Firestore
+// the rest of our tags and prefix are checked here as Firestore only allows a single array filter per query
+func (s *FirestoreStore) Tests(ctx context.Context, q TestQuery, fn func(t *TestDoc) bool) error {
+	tests := s.Client.Collection("Tests")
+	fq := tests.Query
+	switch {
+	case len(q.Tags) == 1 || (len(q.Tags) > 1 && q.MatchAll):
+		fq = fq.Where("Tag", "array-contains", q.Tags[0])
+	case len(q.Tags) > 1:
+		fq = fq.Where("Tag", "array-contains-any", q.Tags)
+	}
+	dir := firestore.Asc
+	if q.Desc {
+		dir = firestore.Desc
+	}
+	fq = fq.OrderBy(testSortField(q.Sort), dir)
+	if q.After != "" {
+		snap, err := tests.Doc(q.After).Get(ctx)
+		if err != nil {
+			return fmt.Errorf("no test %q to continue after: %s", q.After, err)
+		}
+		fq = fq.StartAfter(snap)
+	}
+	if q.Prefix != "" && (q.Sort == "" || q.Sort == "name") {
+		if q.Desc {
+			if q.After == "" {
+				fq = fq.StartAt(q.Prefix + "\uf8ff")
+			}
+			fq = fq.EndAt(q.Prefix)
+		} else {
+			if q.After == "" {
+				fq = fq.StartAt(q.Prefix)
+			}
+			fq = fq.EndBefore(q.Prefix + "\uf8ff")
+		}
+	}
+	iter := fq.Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		t, err := testDoc(doc)
+		if err != nil {
+			continue // not one of ours
+		}
+		if q.matches(t) && !fn(t) {
+			return nil
+		}
+	}
+}
+
+// stored field (or document id) tests are sorted by
+func testSortField(sort string) string {
+	switch sort {
+	case "start":
+		return "StartTime"
+	case "end":
+		return "EndTime"
+	case "created":
+		return "Created"
+	default:
+		return firestore.DocumentID
+	}
+}
+
+func (s *FirestoreStore) PutTest(ctx context.Context, t *TestDoc) error {
+	ref := s.Client.Collection("Tests").Doc(t.Name)
+	if err := s.dropReports(ctx, ref); err != nil {
+		return fmt.Errorf("dropping reports of existing test %s: %s", t.Name, err)
+	}
+	_, err := ref.Set(ctx, t)
+	return err
+}
+
+// delete a test's reports in either layout along with its vehicle documents, an overwritten test starts out empty
+func (s *FirestoreStore) dropReports(ctx context.Context, test *firestore.DocumentRef) error {
+	vehicles, err := test.Collection("vehicle").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	b := s.Client.Batch()
+	n := 0
+	del := func(ref *firestore.DocumentRef) error {
+		b.Delete(ref)
+		if n++; n < maxBatchWrites {
+			return nil
+		}
+		_, err := b.Commit(ctx)
+		b, n = s.Client.Batch(), 0
+		return err
+	}
+	for _, parent := range append([]*firestore.DocumentRef{test}, vehicles...) {
+		iter := parent.Collection(ReportCollection).DocumentRefs(ctx)
+		for {
+			ref, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err == nil {
+				err = del(ref)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if parent != test {
+			if err := del(parent); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			delete(s.vehicles, parent.Path)
+			s.mu.Unlock()
+		}
+	}
+	if n > 0 {
+		_, err = b.Commit(ctx)
+	}
+	return err
+}
+
+func (s *FirestoreStore) TestReports(ctx context.Context, t *TestDoc) ([]VehicleReport, error) {
+	// find our "Tests" document in Firestore: Tests/{testDocId} to locate our test data collections
+	snap, err := s.Client.Collection("Tests").Doc(t.Name).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tvs, err := TestVehicles(ctx, snap)
+	if err != nil {
+		return nil, err
+	}
+	var reports []VehicleReport
+	for _, v := range tvs {
+		// Tests/{testDocId}/{reportCollection}/{reportDataDocuments}
+		// or Tests/{testDocId}/vehicle/{transponderId}/{reportCollection}/{reportDataDocuments}
+		// We are using Firestore to sort all of our entries back to us by fsCreateTimestamp
+		docs, err := v.Reports(ReportCollection).OrderBy("fsCreateTimestamp", firestore.Asc).Documents(ctx).GetAll() // no query params here, get it all
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			// unpack report data into struct, skipping anything that isn't a report
+			var r Report
+			if doc.DataTo(&r) != nil {
+				continue
+			}
+			reports = append(reports, VehicleReport{Vehicle: v.Transponder, Report: r, Data: doc.Data()})
+		}
+	}
+	return reports, nil
+}
+
+func (s *FirestoreStore) AddTestReport(ctx context.Context, t *TestDoc, vr VehicleReport) error {
+	vehicle := vr.Vehicle
+	ref := TestVehicleRef(s.Client.Collection("Tests").Doc(t.Name), vehicle, t.MultiVehicle)
+	if t.MultiVehicle {
+		s.mu.Lock()
+		done := s.vehicles[ref.Path]
+		s.mu.Unlock()
+		if !done {
+			_, err := ref.Set(ctx, map[string]interface{}{"Account": t.Account, "Transponder": vehicle})
+			if err != nil {
+				return fmt.Errorf("setting vehicle document %d up: %s", vehicle, err)
+			}
+			s.mu.Lock()
+			s.vehicles[ref.Path] = true
+			s.mu.Unlock()
+		}
+	}
+	var data interface{} = vr.Report
+	if vr.Data != nil {
+		// references read out of a DirStore are only paths until now
+		data = ResolveRefs(s.Client, vr.Data)
+	}
+	_, err := ref.Collection(ReportCollection).NewDoc().Set(ctx, data)
+	return err
+}
+
+// filtering on type along with a reportTimestamp range requires a composite index (type, reportTimestamp)
+func (s *FirestoreStore) Reports(ctx context.Context, account, transponder int, q ReportQuery) ([]StoredReport, error) {
+	fq := s.Client.Collection(reportsPath(account, transponder)).Query
+	if !q.Start.IsZero() {
+		op := ">"
+		if q.IncStart {
+			op = ">="
+		}
+		fq = fq.Where("reportTimestamp", op, q.Start)
+	}
+	if !q.End.IsZero() {
+		op := "<"
+		if q.IncEnd {
+			op = "<="
+		}
+		fq = fq.Where("reportTimestamp", op, q.End)
+	}
+	switch len(q.Types) {
+	case 0: // all types
+	case 1:
+		fq = fq.Where("type", "==", q.Types[0])
+	default:
+		fq = fq.Where("type", "in", q.Types)
+	}
+	docs, err := fq.OrderBy("reportTimestamp", firestore.Asc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]StoredReport, 0, len(docs))
+	for _, doc := range docs {
+		reports = append(reports, storedReport(doc))
+	}
+	return reports, nil
+}
+
+func (s *FirestoreStore) WriteReport(ctx context.Context, account, transponder int, r Report) (string, error) {
+	ref := s.Client.Collection(reportsPath(account, transponder)).NewDoc()
+	_, err := ref.Set(ctx, r)
+	return docPath(ref), err
+}
+
+func (s *FirestoreStore) ReadReports(ctx context.Context, paths []string) ([]*StoredReport, error) {
+	reports := make([]*StoredReport, 0, len(paths))
+	for start := 0; start < len(paths); start += maxGetAll {
+		end := start + maxGetAll
+		if end > len(paths) {
+			end = len(paths)
+		}
+		var refs []*firestore.DocumentRef
+		for _, path := range paths[start:end] {
+			refs = append(refs, s.Client.Doc(path))
+		}
+		snaps, err := s.Client.GetAll(ctx, refs)
+		if err != nil {
+			return nil, err
+		}
+		for _, snap := range snaps {
+			if !snap.Exists() {
+				reports = append(reports, nil)
+				continue
+			}
+			r := storedReport(snap)
+			reports = append(reports, &r)
+		}
+	}
+	return reports, nil
+}
+
+func storedReport(snap *firestore.DocumentSnapshot) StoredReport {
+	sr := StoredReport{Path: docPath(snap.Ref), Created: snap.CreateTime, Data: snap.Data()}
+	sr.Err = snap.DataTo(&sr.Report)
+	return sr
+}
+
+// path of a document within its database ex: account/18/vehicle/83/report_data/{id}
+func docPath(ref *firestore.DocumentRef) string {
+	if i := strings.Index(ref.Path, "/documents/"); i >= 0 {
+		return ref.Path[i+len("/documents/"):]
+	}
+	return ref.Path
+}
@@ -0,0 +1,124 @@
+package stream
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryStore keeps everything in memory, handy for tests that shouldn't need a database
+type MemoryStore struct {
+	mu          sync.Mutex
+	tests       map[string]TestDoc
+	testReports map[string][]VehicleReport
+	reports     map[string][]StoredReport // by report collection path
+	seq         int                       // for report ids
+}
+
+// NewMemoryStore starts out empty
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		tests:       make(map[string]TestDoc),
+		testReports: make(map[string][]VehicleReport),
+		reports:     make(map[string][]StoredReport),
+	}
+}
+
+func (s *MemoryStore) Test(ctx context.Context, name string) (*TestDoc, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tests[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &t, nil
+}
+
+func (s *MemoryStore) Tests(ctx context.Context, q TestQuery, fn func(t *TestDoc) bool) error {
+	s.mu.Lock()
+	tests := make([]*TestDoc, 0, len(s.tests))
+	for _, t := range s.tests {
+		t := t
+		tests = append(tests, &t)
+	}
+	s.mu.Unlock()
+	return selectTests(tests, q, fn)
+}
+
+func (s *MemoryStore) PutTest(ctx context.Context, t *TestDoc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *t
+	if stored.Created.IsZero() {
+		stored.Created = now()
+	}
+	s.tests[t.Name] = stored
+	delete(s.testReports, t.Name) // an overwritten test starts out empty
+	return nil
+}
+
+func (s *MemoryStore) TestReports(ctx context.Context, t *TestDoc) ([]VehicleReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tests[t.Name]; !ok {
+		return nil, ErrNotFound
+	}
+	reports := append([]VehicleReport(nil), s.testReports[t.Name]...)
+	sortTestReports(reports)
+	return reports, nil
+}
+
+func (s *MemoryStore) AddTestReport(ctx context.Context, t *TestDoc, vr VehicleReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.testReports[t.Name] = append(s.testReports[t.Name], vr)
+	return nil
+}
+
+func (s *MemoryStore) Reports(ctx context.Context, account, transponder int, q ReportQuery) ([]StoredReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var reports []StoredReport
+	for _, sr := range s.reports[reportsPath(account, transponder)] {
+		if q.matches(&sr.Report) {
+			reports = append(reports, sr)
+		}
+	}
+	sortByReportTime(reports)
+	return reports, nil
+}
+
+func (s *MemoryStore) WriteReport(ctx context.Context, account, transponder int, r Report) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	col := reportsPath(account, transponder)
+	created := now()
+	if r.FirestoreCreation.IsZero() {
+		r.FirestoreCreation = created
+	}
+	sr := StoredReport{Path: col + "/" + strconv.Itoa(s.seq), Created: created, Report: r}
+	s.reports[col] = append(s.reports[col], sr)
+	return sr.Path, nil
+}
+
+func (s *MemoryStore) ReadReports(ctx context.Context, paths []string) ([]*StoredReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reports := make([]*StoredReport, len(paths))
+	for i, path := range paths {
+		col := path
+		if j := strings.LastIndex(path, "/"); j >= 0 {
+			col = path[:j]
+		}
+		for _, sr := range s.reports[col] {
+			if sr.Path == path {
+				sr := sr
+				reports[i] = &sr
+				break
+			}
+		}
+	}
+	return reports, nil
+}
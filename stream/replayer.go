@@ -0,0 +1,262 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Options configures a single replay
+type Options struct {
+	Target        Store                                 // where reports are replayed to, assertions need a FirestoreStore
+	Account       int                                   // target account
+	Transponder   int                                   // target of a single vehicle test, Map takes precedence
+	Map           map[int]int                           // original test vehicle -> target transponder, needed by multi vehicle tests
+	SkipVerify    bool                                  // don't read back and verify written reports once we're done
+	Tolerance     time.Duration                         // how far off schedule a report may land before verification flags it
+	Assertions    []Assertion                           // downstream documents to wait for once we're done
+	AssertTimeout time.Duration                         // for assertions without a timeout of their own
+	OnWrite       func(Write)                           // called after every write, from the replay goroutine
+	Logf          func(format string, a ...interface{}) // progress messages, nil keeps quiet
+}
+
+// Write is a single report a replay wrote
+type Write struct {
+	Seq         int // position within our playlist, starting at 1
+	Vehicle     int // original test vehicle
+	Transponder int // target transponder
+	Path        string
+	Report      Report // as written
+	WrittenAt   time.Time
+	Delay       time.Duration // original ingest delay carried over into ReportTimestamp
+	Err         error
+}
+
+// a single report scheduled for replay along with where it's headed
+type playlistEntry struct {
+	report      Report
+	vehicle     int // original test vehicle
+	transponder int // target transponder id
+}
+
+// Replayer plays a test back onto target vehicles in real time, verifies what it wrote and waits on assertions
+//
+//	src := stream.StoredTest{Store: stream.NewFirestoreStore(sc), Name: "truckster 5 min trip"}
+//	r := stream.New(src, stream.Options{Target: stream.NewFirestoreStore(tc), Account: 1, Transponder: 1337})
+//	if err := r.Start(ctx); err != nil { ... }
+//	res, err := r.Wait()
+type Replayer struct {
+	src  Source
+	opts Options
+
+	test     *Test
+	targets  map[int]int
+	playlist []playlistEntry
+	cancel   context.CancelFunc
+	done     chan struct{}
+	res      *Results
+	err      error
+}
+
+// New sets up a replay of src, nothing happens until Start
+func New(src Source, opts Options) *Replayer {
+	return &Replayer{src: src, opts: opts}
+}
+
+// Run replays src and waits for it to finish
+func Run(ctx context.Context, src Source, opts Options) (*Results, error) {
+	r := New(src, opts)
+	if err := r.Start(ctx); err != nil {
+		return nil, err
+	}
+	return r.Wait()
+}
+
+// Load reads our test and builds its playlist, so Len is known before playback starts
+// Start loads it for us if we haven't
+func (r *Replayer) Load(ctx context.Context) error {
+	if r.opts.Target == nil {
+		return errors.New("replay needs a Target store")
+	}
+	if _, ok := r.opts.Target.(*FirestoreStore); !ok && len(r.opts.Assertions) > 0 {
+		return errors.New("assertions need a Firestore target")
+	}
+	t, err := r.src.Load(ctx)
+	if err != nil {
+		return err
+	}
+	targets, err := r.opts.targets(t.Vehicles)
+	if err != nil {
+		return err
+	}
+	r.test, r.targets, r.playlist = t, targets, nil
+	for _, vr := range t.Reports {
+		r.playlist = append(r.playlist, playlistEntry{report: vr.Report, vehicle: vr.Vehicle, transponder: targets[vr.Vehicle]})
+	}
+	// merge all of our vehicles into one timeline, ordered by fsCreateTimestamp
+	sort.SliceStable(r.playlist, func(i, j int) bool {
+		return r.playlist[i].report.FirestoreCreation.Before(r.playlist[j].report.FirestoreCreation)
+	})
+	return nil
+}
+
+// Start plays our test back in the background
+// an error means the replay couldn't start, cancelling ctx or calling Stop ends it early
+func (r *Replayer) Start(ctx context.Context) error {
+	if r.done != nil {
+		return errors.New("replay already started")
+	}
+	if r.test == nil {
+		if err := r.Load(ctx); err != nil {
+			return err
+		}
+	}
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		defer r.cancel()
+		r.res, r.err = r.run(ctx)
+	}()
+	return nil
+}
+
+// Len is the number of reports in our playlist, known once loaded
+func (r *Replayer) Len() int {
+	return len(r.playlist)
+}
+
+// Stop ends a replay early, Wait still returns results for everything written until then
+func (r *Replayer) Stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// Wait for our replay, its verification and assertions to finish
+// the error is only set when the replay was cut short, problems it found are in our results, see Results.Err
+func (r *Replayer) Wait() (*Results, error) {
+	if r.done == nil {
+		return nil, errors.New("replay not started")
+	}
+	<-r.done
+	return r.res, r.err
+}
+
+func (r *Replayer) run(ctx context.Context) (*Results, error) {
+	// modify each record's reportTimestamp ideally to an offset equal to fsCreateTimestamp - reportTimestamp
+	// of our original report, so if we have a 7 second diff between reportTimestamp -> fsCreateTimestamp
+	// we will carry that over to our new reportTimestamp to ensure that the same effect of "late" or delayed
+	// data is visible within the replay environment...
+	started := now()
+
+	// pace our writes back into Firestore so they appear real: each report is scheduled at its fsCreateTimestamp
+	// offset from our first one, so time spent writing doesn't pile up into drift over long replays
+	var firstWrite time.Time
+	// everything we wrote, and when it should have landed, for our verification pass
+	written := make([]writtenReport, 0, len(r.playlist))
+
+	for i, entry := range r.playlist {
+		p := entry.report
+
+		if i == 0 {
+			firstWrite = now()
+		}
+		scheduled := firstWrite.Add(p.FirestoreCreation.Sub(r.playlist[0].report.FirestoreCreation))
+		// wait until we are ready, select picks at random when we're both due and stopped so check ctx again
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(scheduled)):
+		}
+		if ctx.Err() != nil {
+			// stopped early, all we know about is what we wrote so far
+			res := newResults(r.test.Name, r.test.Tags, "", started, now(), len(r.playlist), false, written, failedWrites(written), nil)
+			return res, ctx.Err()
+		}
+
+		now := now()
+		diff := Rewrite(&p, entry.transponder, now)
+
+		// write it out
+		path, err := r.opts.Target.WriteReport(ctx, r.opts.Account, entry.transponder, p)
+		written = append(written, writtenReport{
+			path:        path,
+			account:     r.opts.Account,
+			transponder: entry.transponder,
+			expected:    p,
+			scheduled:   scheduled,
+			writtenAt:   now,
+			err:         err,
+		})
+		if r.opts.OnWrite != nil {
+			r.opts.OnWrite(Write{Seq: i + 1, Vehicle: entry.vehicle, Transponder: entry.transponder, Path: path,
+				Report: p, WrittenAt: now, Delay: diff, Err: err})
+		}
+	}
+	finished := now()
+
+	// read everything back and reconcile it against our playlist
+	var issues []Issue
+	verified := false
+	if !r.opts.SkipVerify && len(r.playlist) != 0 {
+		r.logf("verifying %d written reports", len(written))
+		var err error
+		issues, err = verifyReplay(ctx, r.opts.Target, written, r.opts.Tolerance)
+		if err != nil {
+			// stopped (or failed) while reading back, all we know about is what we wrote
+			res := newResults(r.test.Name, r.test.Tags, "", started, finished, len(r.playlist), false, written, failedWrites(written), nil)
+			if ctx.Err() != nil {
+				return res, ctx.Err()
+			}
+			return res, fmt.Errorf("verifying replay of %s: %s", r.test.Name, err)
+		}
+		verified = true
+	} else {
+		// without reading back we only know about failed writes
+		issues = failedWrites(written)
+	}
+	// wait for whatever our reports should have triggered downstream
+	var asserted []AssertionResult
+	if len(r.opts.Assertions) > 0 {
+		as := expandAssertions(r.opts.Assertions, r.opts.Account, sortedTargets(r.targets), r.opts.AssertTimeout)
+		r.logf("waiting on %d assertions", len(as))
+		asserted = runAssertions(ctx, r.opts.Target.(*FirestoreStore).Client, as, started)
+	}
+	res := newResults(r.test.Name, r.test.Tags, "", started, finished, len(r.playlist), verified, written, issues, asserted)
+	return res, ctx.Err()
+}
+
+func (r *Replayer) logf(format string, a ...interface{}) {
+	if r.opts.Logf != nil {
+		r.opts.Logf(format, a...)
+	}
+}
+
+// failed writes are all we know about without reading back
+func failedWrites(written []writtenReport) []Issue {
+	var issues []Issue
+	for _, w := range written {
+		if w.err != nil {
+			issues = append(issues, Issue{Event: "issue", Kind: IssueFailed, Path: w.path, Detail: w.err.Error()})
+		}
+	}
+	return issues
+}
+
+// work out which target transponder each of a test's original vehicles replays onto
+// Transponder covers single vehicle tests, Map entries cover the rest
+func (o *Options) targets(vehicles []int) (map[int]int, error) {
+	targets := make(map[int]int)
+	for _, v := range vehicles {
+		if dst, ok := o.Map[v]; ok {
+			targets[v] = dst
+		} else if len(vehicles) == 1 && o.Transponder != 0 {
+			targets[v] = o.Transponder
+		} else {
+			return nil, fmt.Errorf("no target for test vehicle %d, add it to Options.Map", v)
+		}
+	}
+	return targets, nil
+}
@@ -0,0 +1,206 @@
+package stream
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// a test of n reports per vehicle, spaced out by gap
+func testOf(name string, vehicles []int, n int, gap time.Duration) *Test {
+	t := &Test{Name: name, Tags: []string{"unit"}, Vehicles: vehicles}
+	base := time.Date(2021, 3, 5, 13, 40, 0, 0, time.UTC)
+	for _, v := range vehicles {
+		for i := 0; i < n; i++ {
+			created := base.Add(time.Duration(i) * gap)
+			t.Reports = append(t.Reports, VehicleReport{Vehicle: v, Report: Report{
+				Type:              "status",
+				ReportTimestamp:   created.Add(-2 * time.Second),
+				FirestoreCreation: created,
+			}})
+		}
+	}
+	return t
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		test      *Test
+		opts      Options
+		wantErr   bool
+		wantDocs  int
+		wantPaths map[int]int // target transponder -> reports expected there
+	}{
+		{
+			name:      "single vehicle",
+			test:      testOf("single", []int{83}, 3, 10*time.Millisecond),
+			opts:      Options{Account: 200, Transponder: 1337},
+			wantDocs:  3,
+			wantPaths: map[int]int{1337: 3},
+		},
+		{
+			name:      "multi vehicle",
+			test:      testOf("multi", []int{83, 84}, 2, 10*time.Millisecond),
+			opts:      Options{Account: 200, Map: map[int]int{83: 1337, 84: 1338}},
+			wantDocs:  4,
+			wantPaths: map[int]int{1337: 2, 1338: 2},
+		},
+		{
+			name:    "multi vehicle without a map",
+			test:    testOf("unmapped", []int{83, 84}, 1, 0),
+			opts:    Options{Account: 200, Transponder: 1337},
+			wantErr: true,
+		},
+		{
+			name:      "skip verify",
+			test:      testOf("unverified", []int{83}, 2, 0),
+			opts:      Options{Account: 200, Transponder: 1337, SkipVerify: true},
+			wantDocs:  2,
+			wantPaths: map[int]int{1337: 2},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			target := NewMemoryStore()
+			tc.opts.Target = target
+			tc.opts.Tolerance = time.Second
+			var writes int
+			tc.opts.OnWrite = func(w Write) { writes++ }
+			res, err := Run(ctx, tc.test, tc.opts)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := res.Err(); err != nil {
+				t.Fatalf("replay failed: %s %+v", err, res.Issues)
+			}
+			if res.Docs != tc.wantDocs || res.Written != tc.wantDocs || writes != tc.wantDocs {
+				t.Errorf("docs %d written %d writes %d, want %d", res.Docs, res.Written, writes, tc.wantDocs)
+			}
+			if res.Verified == tc.opts.SkipVerify {
+				t.Errorf("verified %v with SkipVerify %v", res.Verified, tc.opts.SkipVerify)
+			}
+			for x, want := range tc.wantPaths {
+				reports, err := target.Reports(ctx, 200, x, ReportQuery{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(reports) != want {
+					t.Errorf("transponder %d has %d reports, want %d", x, len(reports), want)
+				}
+				for _, sr := range reports {
+					if sr.Report.Serial != float64(x) {
+						t.Errorf("report %s has serial %v, want %d", sr.Path, sr.Report.Serial, x)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReplayerStop(t *testing.T) {
+	// our second report is an hour out, we stop once the first one is written
+	test := testOf("stopped", []int{83}, 2, time.Hour)
+	written := make(chan struct{}, 1)
+	r := New(test, Options{
+		Target:      NewMemoryStore(),
+		Account:     200,
+		Transponder: 1337,
+		OnWrite:     func(w Write) { written <- struct{}{} },
+	})
+	if err := r.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 2 {
+		t.Fatalf("playlist of %d reports, want 2", r.Len())
+	}
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(context.Background()); err == nil {
+		t.Error("expected an error starting twice")
+	}
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("first report never written")
+	}
+	r.Stop()
+	res, err := r.Wait()
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if res == nil {
+		t.Fatal("no results for a stopped replay")
+	}
+	if res.Docs != 2 || res.Written != 1 || res.Verified {
+		t.Errorf("docs %d written %d verified %v, want 2, 1 and false", res.Docs, res.Written, res.Verified)
+	}
+}
+
+// a store that never finishes reading reports back, until ctx is done
+type stalledStore struct {
+	*MemoryStore
+	reading chan struct{}
+}
+
+func (s stalledStore) ReadReports(ctx context.Context, paths []string) ([]*StoredReport, error) {
+	close(s.reading)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestReplayerStopVerifying(t *testing.T) {
+	target := stalledStore{MemoryStore: NewMemoryStore(), reading: make(chan struct{})}
+	r := New(testOf("verifying", []int{83}, 2, 0), Options{Target: target, Account: 200, Transponder: 1337})
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-target.reading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("verification never started")
+	}
+	r.Stop()
+	res, err := r.Wait()
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if res == nil {
+		t.Fatal("no results for a replay stopped while verifying")
+	}
+	if res.Written != 2 || res.Verified {
+		t.Errorf("written %d verified %v, want 2 and false", res.Written, res.Verified)
+	}
+}
+
+func TestReplayerNotStarted(t *testing.T) {
+	if _, err := New(testOf("idle", []int{83}, 1, 0), Options{}).Wait(); err == nil {
+		t.Error("expected an error waiting on a replay that never started")
+	}
+	if _, err := Run(context.Background(), testOf("untargeted", []int{83}, 1, 0), Options{Transponder: 1337}); err == nil {
+		t.Error("expected an error replaying without a target")
+	}
+}
+
+func TestReplayerStoppedBeforeDue(t *testing.T) {
+	// every report is already due, a stopped replay still mustn't write any of them
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 20; i++ {
+		res, err := Run(ctx, testOf("due", []int{83}, 3, 0), Options{Target: NewMemoryStore(), Account: 200, Transponder: 1337})
+		if err != context.Canceled {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+		if res.Written != 0 || len(res.Issues) != 0 {
+			t.Fatalf("written %d with issues %+v after being stopped", res.Written, res.Issues)
+		}
+	}
+}
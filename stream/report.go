@@ -0,0 +1,53 @@
+package stream
+
+import (
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// ReportCollection is the only report collection we replay atm, future additions of eld_data, video_upload ...
+const ReportCollection = "report_data"
+
+// Report is a FirestoreTransponderReportV1, transponder generated reports (speeding, status, hard_accel, ...)
+type Report struct {
+	ConfigId           float64        `firestore:"configId,omitempty"`
+	Duration           float64        `firestore:"duration,omitempty"`
+	EventStart         time.Time      `firestore:"eventStart,omitempty"`
+	InProgress         bool           `firestore:"inProgress,omitempty"`
+	LocationAccuracy   float64        `firestore:"locationAccuracy,omitempty"`
+	Heading            float64        `firestore:"heading,omitempty"`
+	Address            string         `firestore:"address,omitempty"`
+	DotOrientation     string         `firestore:"dotOrientation,omitempty"`
+	GeoTags            []string       `firestore:"geoTags,omitempty"`
+	LatLng             *latlng.LatLng `firestore:"latLng,omitempty"`
+	BatteryVoltage     float64        `firestore:"batteryVoltage,omitempty"`
+	CellSignalStrength float64        `firestore:"cellSignalStrength,omitempty"`
+	IsLowBattery       bool           `firestore:"isLowBatteryVoltage,omitempty"`
+	Odometer           float64        `firestore:"odometer,omitempty"`
+	Speed              float64        `firestore:"speed,omitempty"`
+	SpeedLimit         float64        `firestore:"speedLimit,omitempty"`
+	ReportTimestamp    time.Time      `firestore:"reportTimestamp,omitempty"`
+	Serial             float64        `firestore:"serial,omitempty"`
+	Type               string         `firestore:"type"`                              // this is the "dataType" field of a streaming packet
+	FirestoreCreation  time.Time      `firestore:"fsCreateTimestamp,serverTimestamp"` // if zero, Firestore sets this on their end
+}
+
+// Rewrite makes a report look like transponder just sent it at now, returns the ingest delay carried over
+func Rewrite(r *Report, transponder int, now time.Time) time.Duration {
+	// intentionally zero out eventStart, because we aren't synth'ing it
+	r.EventStart = time.Time{}
+
+	// set serial number to user-requested
+	r.Serial = float64(transponder)
+
+	// differential between this report's fsCreateTimestamp and reportTimestamp
+	// this gives us our "delay" between transponder making a report, it hitting cl api and then firestore
+	diff := r.FirestoreCreation.Sub(r.ReportTimestamp)
+	r.ReportTimestamp = now.Add(-diff)
+	return diff
+}
+
+func now() time.Time {
+	return time.Now().UTC()
+}
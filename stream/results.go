@@ -0,0 +1,289 @@
+package stream
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Results is everything a CI pipeline wants to know about one replay
+type Results struct {
+	Test        string
+	Tags        []string
+	Source      string // test db or archive we replayed from
+	Passed      bool
+	Started     time.Time
+	Finished    time.Time
+	DurationSec float64
+	Docs        int // reports in our playlist
+	Written     int
+	Failed      int
+	Verified    bool // false if verification was skipped
+	Lag         Lag
+	Issues      []Issue
+	Assertions  []AssertionResult
+	Error       string `json:",omitempty"` // why the replay couldn't run at all
+}
+
+// Lag holds the lag statistics of a replay, each nil when there's nothing to measure
+type Lag struct {
+	Ingest  *DelayStats `json:",omitempty"` // original ingest delay carried over into each reportTimestamp
+	Write   *DelayStats `json:",omitempty"` // how late each write went out compared to its schedule
+	Landing *DelayStats `json:",omitempty"` // how late each report showed up in the target, needs verification
+}
+
+// put together our results once replay, verification and assertions are all done
+func newResults(test string, tags []string, source string, started, finished time.Time, docs int, verified bool,
+	written []writtenReport, issues []Issue, assertions []AssertionResult) *Results {
+	r := &Results{
+		Test:        test,
+		Tags:        tags,
+		Source:      source,
+		Started:     started,
+		Finished:    finished,
+		DurationSec: finished.Sub(started).Seconds(),
+		Docs:        docs,
+		Verified:    verified,
+		Issues:      issues,
+		Assertions:  assertions,
+	}
+	var ingest, write, landing []float64
+	for _, w := range written {
+		if w.err != nil {
+			r.Failed++
+			continue
+		}
+		r.Written++
+		ingest = append(ingest, durationMs(w.writtenAt.Sub(w.expected.ReportTimestamp)))
+		write = append(write, durationMs(w.writtenAt.Sub(w.scheduled)))
+		if !w.landed.IsZero() {
+			landing = append(landing, durationMs(w.landed.Sub(w.scheduled)))
+		}
+	}
+	r.Lag = Lag{Ingest: NewDelayStats(ingest), Write: NewDelayStats(write), Landing: NewDelayStats(landing)}
+	r.Passed = r.Err() == nil
+	return r
+}
+
+// AssertFailed is the number of assertions that didn't pass
+func (r *Results) AssertFailed() int {
+	n := 0
+	for _, a := range r.Assertions {
+		if !a.Passed {
+			n++
+		}
+	}
+	return n
+}
+
+// Err explains why a replay can't be trusted, nil if it passed
+func (r *Results) Err() error {
+	if r.Error != "" {
+		return errors.New(r.Error)
+	}
+	if len(r.Issues) > 0 {
+		return fmt.Errorf("replay of %d reports had %d issues", r.Docs, len(r.Issues))
+	}
+	if n := r.AssertFailed(); n > 0 {
+		return fmt.Errorf("%d of %d assertions failed", n, len(r.Assertions))
+	}
+	return nil
+}
+
+// WriteJSON writes results as an indented JSON document
+func (r *Results) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// JUnit XML as understood by Jenkins, GitLab, CircleCI and friends
+// each replay is a testsuite, with a testcase for writing, one for verification and one per assertion
+// testcase names stay the same between runs so CI servers can track their history
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Errors     int             `xml:"errors,attr"`
+	Skipped    int             `xml:"skipped,attr"`
+	Time       string          `xml:"time,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// WriteJUnit writes a JUnit XML report holding a test suite for each replay
+func WriteJUnit(w io.Writer, results ...*Results) error {
+	doc := junitTestSuites{Name: "replaystream"}
+	var total float64
+	for _, r := range results {
+		suite := r.junitSuite()
+		doc.Suites = append(doc.Suites, suite)
+		doc.Tests += suite.Tests
+		doc.Failures += suite.Failures
+		doc.Errors += suite.Errors
+		total += r.DurationSec
+	}
+	doc.Time = junitSeconds(total)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// anything we'd rather not have in a JUnit classname
+var classChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func (r *Results) junitSuite() junitTestSuite {
+	class := "replay." + classChars.ReplaceAllString(r.Test, "_")
+	suite := junitTestSuite{
+		Name:      r.Test,
+		Time:      junitSeconds(r.DurationSec),
+		Timestamp: r.Started.UTC().Format("2006-01-02T15:04:05"),
+		Properties: []junitProperty{
+			{"tags", strings.Join(r.Tags, ",")},
+			{"source", r.Source},
+			{"docs", strconv.Itoa(r.Docs)},
+			{"written", strconv.Itoa(r.Written)},
+			{"failed", strconv.Itoa(r.Failed)},
+		},
+	}
+	for _, l := range []struct {
+		name  string
+		stats *DelayStats
+	}{{"ingestLag", r.Lag.Ingest}, {"writeLag", r.Lag.Write}, {"landingLag", r.Lag.Landing}} {
+		if d := l.stats; d != nil {
+			suite.Properties = append(suite.Properties,
+				junitProperty{l.name + "MedianMs", formatMs(d.MedianMs)},
+				junitProperty{l.name + "P95Ms", formatMs(d.P95Ms)},
+				junitProperty{l.name + "MaxMs", formatMs(d.MaxMs)})
+		}
+	}
+
+	// a replay that couldn't run at all is a single errored testcase
+	if r.Error != "" {
+		suite.Cases = []junitTestCase{{Name: "replay", Classname: class, Time: "0", Error: &junitFailure{Message: r.Error, Type: "error"}}}
+		suite.Tests, suite.Errors = 1, 1
+		return suite
+	}
+
+	// writing every report, fails on write errors
+	write := junitTestCase{Name: "write reports", Classname: class, Time: junitSeconds(r.DurationSec),
+		SystemOut: fmt.Sprintf("%d of %d reports written", r.Written, r.Docs)}
+	var verifyIssues []Issue
+	var failedWrites []string
+	for _, issue := range r.Issues {
+		if issue.Kind == IssueFailed {
+			failedWrites = append(failedWrites, issue.Path+": "+issue.Detail)
+		} else {
+			verifyIssues = append(verifyIssues, issue)
+		}
+	}
+	if len(failedWrites) > 0 {
+		write.Failure = &junitFailure{Message: fmt.Sprintf("%d writes failed", len(failedWrites)), Type: IssueFailed,
+			Text: strings.Join(failedWrites, "\n")}
+	}
+	suite.Cases = append(suite.Cases, write)
+
+	// reading them back
+	verify := junitTestCase{Name: "verify reports", Classname: class, Time: "0"}
+	switch {
+	case !r.Verified:
+		verify.Skipped = &junitSkipped{Message: "verification skipped"}
+	case len(verifyIssues) > 0:
+		counts := make(map[string]int)
+		var lines []string
+		for _, issue := range verifyIssues {
+			counts[issue.Kind]++
+			lines = append(lines, issue.Kind+" "+issue.Path+": "+issue.Detail)
+		}
+		var kinds []string
+		for _, kind := range IssueKinds[1:] {
+			if counts[kind] > 0 {
+				kinds = append(kinds, fmt.Sprintf("%d %s", counts[kind], kind))
+			}
+		}
+		verify.Failure = &junitFailure{Message: strings.Join(kinds, ", "), Type: "verification", Text: strings.Join(lines, "\n")}
+	}
+	suite.Cases = append(suite.Cases, verify)
+
+	// downstream assertions
+	for _, a := range r.Assertions {
+		what := a.Path
+		if len(a.Where) > 0 {
+			what += " where " + strings.Join(a.Where, ", ")
+		}
+		c := junitTestCase{Name: a.Name, Classname: class + ".assertion", Time: junitSeconds(a.WaitedSec),
+			SystemOut: fmt.Sprintf("%s: found %d of %d", what, a.Found, a.Want)}
+		if !a.Passed {
+			c.Failure = &junitFailure{Message: a.Error, Type: "assertion", Text: c.SystemOut}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	suite.Tests = len(suite.Cases)
+	for _, c := range suite.Cases {
+		if c.Failure != nil {
+			suite.Failures++
+		}
+		if c.Skipped != nil {
+			suite.Skipped++
+		}
+	}
+	return suite
+}
+
+func junitSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', 3, 64)
+}
+
+func formatMs(ms float64) string {
+	return strconv.FormatFloat(ms, 'f', -1, 64)
+}
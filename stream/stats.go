@@ -0,0 +1,41 @@
+package stream
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// DelayStats is a delay distribution in milliseconds
+type DelayStats struct {
+	MinMs    float64
+	MedianMs float64
+	P95Ms    float64
+	MaxMs    float64
+}
+
+// NewDelayStats returns min, median, p95 and max of some delays in milliseconds, nil if there are none
+// ms is sorted in place
+func NewDelayStats(ms []float64) *DelayStats {
+	if len(ms) == 0 {
+		return nil
+	}
+	sort.Float64s(ms)
+	return &DelayStats{MinMs: ms[0], MedianMs: percentile(ms, 50), P95Ms: percentile(ms, 95), MaxMs: ms[len(ms)-1]}
+}
+
+// nearest-rank percentile of an already sorted slice
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
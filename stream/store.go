@@ -0,0 +1,249 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by a Store for tests that don't exist
+var ErrNotFound = errors.New("not found")
+
+// Store is where tests are kept and where live vehicle reports are read from and written to
+// FirestoreStore is the real thing, MemoryStore and DirStore are for running without any database
+type Store interface {
+	// Test reads a test document, ErrNotFound if there's no such test
+	Test(ctx context.Context, name string) (*TestDoc, error)
+	// Tests calls fn with every test matching q in order, until fn returns false
+	Tests(ctx context.Context, q TestQuery, fn func(t *TestDoc) bool) error
+	// PutTest creates or overwrites a test document, its reports are added with AddTestReport
+	// an overwritten test loses its old reports
+	PutTest(ctx context.Context, t *TestDoc) error
+	// TestReports reads every report stored with a test, by vehicle then fsCreateTimestamp
+	TestReports(ctx context.Context, t *TestDoc) ([]VehicleReport, error)
+	// AddTestReport stores a report of one of the test's original vehicles with it, Data is written as is when set
+	AddTestReport(ctx context.Context, t *TestDoc, vr VehicleReport) error
+
+	// Reports reads a vehicle's reports ex: account/18/vehicle/83/report_data in reportTimestamp order
+	Reports(ctx context.Context, account, transponder int, q ReportQuery) ([]StoredReport, error)
+	// WriteReport adds a report to a vehicle, returns its path
+	WriteReport(ctx context.Context, account, transponder int, r Report) (string, error)
+	// ReadReports reads reports back by path, nil for the ones that don't exist
+	ReadReports(ctx context.Context, paths []string) ([]*StoredReport, error)
+}
+
+// TestDoc is a test document: Tests/{name}, what copy and record store
+type TestDoc struct {
+	Name         string
+	Description  string
+	Tag          []string
+	Account      int
+	Transponders []int
+	AllVehicles  bool
+	Transponder  int  // first (or only) transponder copied, kept for single vehicle tests
+	MultiVehicle bool // true if reports are stored per vehicle under Tests/{name}/vehicle/{transponderId}
+	Type         []string
+	IncStart     bool
+	IncEnd       bool
+	Stime        int64 // StartTime in milliseconds unix epoch
+	Etime        int64 // EndTime in milliseconds unix epoch
+	StartTime    time.Time
+	EndTime      time.Time
+	Source       string
+	Target       string
+	Stats        *TestStats `firestore:",omitempty"`       // summary of copied reports
+	Created      time.Time  `firestore:",serverTimestamp"` // set by the store when the test document is first written
+}
+
+// TestStats summarizes a test's reports, stored on its test document as "Stats"
+type TestStats struct {
+	Docs             int            // total number of reports in the test
+	DocsByCollection map[string]int // ex: report_data: 120
+	DocsByType       map[string]int // ex: status: 100, speeding: 20
+	FirstReport      time.Time      // earliest reportTimestamp
+	LastReport       time.Time      // latest reportTimestamp
+	DurationSec      float64        // LastReport - FirstReport
+	Distance         float64        // sum of each vehicle's odometer delta, in odometer units
+	MaxSpeed         float64
+	BoundingBox      *BoundingBox `firestore:",omitempty"` // nil if no reports carried a latLng
+	IngestDelay      *DelayStats  `firestore:",omitempty"` // fsCreateTimestamp - reportTimestamp
+}
+
+// BoundingBox covers every latLng of a test
+type BoundingBox struct {
+	MinLat float64
+	MinLng float64
+	MaxLat float64
+	MaxLng float64
+}
+
+// TestQuery picks tests out of a Store
+type TestQuery struct {
+	Tags     []string // tests carrying any of these
+	MatchAll bool     // tests carrying all of Tags instead
+	Prefix   string   // names starting with this
+	Sort     string   // name (default), start, end or created
+	Desc     bool
+	After    string // name of the last test of a previous page
+}
+
+// ReportQuery narrows down a vehicle's reports, zero values don't filter
+type ReportQuery struct {
+	Start    time.Time // reportTimestamp range
+	End      time.Time
+	IncStart bool // include reports exactly at Start (default is exclusive)
+	IncEnd   bool
+	Types    []string
+}
+
+// StoredReport is a report along with where a store keeps it
+type StoredReport struct {
+	Path    string    // ex: account/18/vehicle/83/report_data/{id}
+	Created time.Time // when the store got it
+	Report  Report
+	Data    map[string]interface{} // fields exactly as stored, nil when a store only kept the Report
+	Err     error                  `json:"-"` // set when Data isn't a readable Report
+}
+
+// StoredTest is a Source reading a test from a Store
+type StoredTest struct {
+	Store Store
+	Name  string
+}
+
+// Load reads the test document and every report of the test
+func (st StoredTest) Load(ctx context.Context) (*Test, error) {
+	td, err := st.Store.Test(ctx, st.Name)
+	if err != nil {
+		return nil, fmt.Errorf("reading test %s: %s", st.Name, err)
+	}
+	reports, err := st.Store.TestReports(ctx, td)
+	if err != nil {
+		return nil, fmt.Errorf("reading test %s: %s", st.Name, err)
+	}
+	t := &Test{Name: st.Name, Tags: td.Tag, Reports: reports}
+	if !td.MultiVehicle {
+		t.Vehicles = []int{td.Transponder}
+		return t, nil
+	}
+	seen := make(map[int]bool)
+	for _, r := range reports {
+		if !seen[r.Vehicle] {
+			seen[r.Vehicle] = true
+			t.Vehicles = append(t.Vehicles, r.Vehicle)
+		}
+	}
+	sort.Ints(t.Vehicles)
+	return t, nil
+}
+
+// path of a vehicle's report collection
+func reportsPath(account, transponder int) string {
+	return "account/" + strconv.Itoa(account) + "/vehicle/" + strconv.Itoa(transponder) + "/" + ReportCollection
+}
+
+// see if a report falls within our query, for stores doing their own filtering
+func (q ReportQuery) matches(r *Report) bool {
+	ts := r.ReportTimestamp
+	if !q.Start.IsZero() && (ts.Before(q.Start) || (!q.IncStart && ts.Equal(q.Start))) {
+		return false
+	}
+	if !q.End.IsZero() && (ts.After(q.End) || (!q.IncEnd && ts.Equal(q.End))) {
+		return false
+	}
+	if len(q.Types) == 0 {
+		return true
+	}
+	for _, t := range q.Types {
+		if r.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// see if a test matches our tags and prefix
+func (q TestQuery) matches(t *TestDoc) bool {
+	if q.Prefix != "" && !strings.HasPrefix(t.Name, q.Prefix) {
+		return false
+	}
+	if len(q.Tags) == 0 {
+		return true
+	}
+	have := make(map[string]bool, len(t.Tag))
+	for _, tag := range t.Tag {
+		have[tag] = true
+	}
+	n := 0
+	for _, tag := range q.Tags {
+		if have[tag] {
+			n++
+		}
+	}
+	if q.MatchAll {
+		return n == len(q.Tags)
+	}
+	return n > 0
+}
+
+// pick tests matching q out of all of them and hand them to fn in order, for stores doing their own querying
+func selectTests(tests []*TestDoc, q TestQuery, fn func(t *TestDoc) bool) error {
+	key := func(t *TestDoc) time.Time {
+		switch q.Sort {
+		case "start":
+			return t.StartTime
+		case "end":
+			return t.EndTime
+		case "created":
+			return t.Created
+		}
+		return time.Time{}
+	}
+	sort.SliceStable(tests, func(i, j int) bool {
+		a, b := tests[i], tests[j]
+		if q.Desc {
+			a, b = b, a
+		}
+		if ka, kb := key(a), key(b); !ka.Equal(kb) {
+			return ka.Before(kb)
+		}
+		return a.Name < b.Name
+	})
+	start := 0
+	if q.After != "" {
+		start = -1
+		for i, t := range tests {
+			if t.Name == q.After {
+				start = i + 1
+				break
+			}
+		}
+		if start < 0 {
+			return fmt.Errorf("no test %q to continue after", q.After)
+		}
+	}
+	for _, t := range tests[start:] {
+		if q.matches(t) && !fn(t) {
+			break
+		}
+	}
+	return nil
+}
+
+// order reports like Firestore hands them back to us
+func sortByReportTime(rs []StoredReport) {
+	sort.SliceStable(rs, func(i, j int) bool { return rs[i].Report.ReportTimestamp.Before(rs[j].Report.ReportTimestamp) })
+}
+
+func sortTestReports(rs []VehicleReport) {
+	sort.SliceStable(rs, func(i, j int) bool {
+		if rs[i].Vehicle != rs[j].Vehicle {
+			return rs[i].Vehicle < rs[j].Vehicle
+		}
+		return rs[i].Report.FirestoreCreation.Before(rs[j].Report.FirestoreCreation)
+	})
+}
@@ -0,0 +1,249 @@
+package stream
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// every store we can run without a database
+func testStores(t *testing.T) map[string]Store {
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"dir":    NewDirStore(t.TempDir()),
+	}
+}
+
+var t0 = time.Date(2021, 3, 5, 13, 40, 0, 0, time.UTC)
+
+func TestReportQueryMatches(t *testing.T) {
+	at := func(d time.Duration, typ string) *Report {
+		return &Report{ReportTimestamp: t0.Add(d), Type: typ}
+	}
+	tests := []struct {
+		name string
+		q    ReportQuery
+		r    *Report
+		want bool
+	}{
+		{"no filters", ReportQuery{}, at(0, "status"), true},
+		{"exclusive start", ReportQuery{Start: t0}, at(0, "status"), false},
+		{"inclusive start", ReportQuery{Start: t0, IncStart: true}, at(0, "status"), true},
+		{"before start", ReportQuery{Start: t0, IncStart: true}, at(-time.Millisecond, "status"), false},
+		{"exclusive end", ReportQuery{End: t0}, at(0, "status"), false},
+		{"inclusive end", ReportQuery{End: t0, IncEnd: true}, at(0, "status"), true},
+		{"after end", ReportQuery{End: t0, IncEnd: true}, at(time.Millisecond, "status"), false},
+		{"within range", ReportQuery{Start: t0, End: t0.Add(time.Minute)}, at(time.Second, "status"), true},
+		{"single instant", ReportQuery{Start: t0, End: t0, IncStart: true, IncEnd: true}, at(0, "status"), true},
+		{"type listed", ReportQuery{Types: []string{"speeding", "status"}}, at(0, "status"), true},
+		{"type not listed", ReportQuery{Types: []string{"speeding"}}, at(0, "status"), false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.q.matches(tc.r); got != tc.want {
+				t.Errorf("matches() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSelectTests(t *testing.T) {
+	all := func() []*TestDoc {
+		return []*TestDoc{
+			{Name: "b trip", Tag: []string{"e2e"}, StartTime: t0.Add(time.Hour), Created: t0},
+			{Name: "a trip", Tag: []string{"e2e", "smoke"}, StartTime: t0.Add(2 * time.Hour), Created: t0.Add(time.Minute)},
+			{Name: "c idle", Tag: []string{"smoke"}, StartTime: t0, Created: t0.Add(2 * time.Minute)},
+			{Name: "d trip", Tag: []string{"nightly"}, StartTime: t0.Add(3 * time.Hour), Created: t0.Add(3 * time.Minute)},
+		}
+	}
+	tests := []struct {
+		name    string
+		q       TestQuery
+		limit   int // stop after this many, 0 for all
+		want    []string
+		wantErr bool
+	}{
+		{name: "by name", q: TestQuery{}, want: []string{"a trip", "b trip", "c idle", "d trip"}},
+		{name: "by name desc", q: TestQuery{Desc: true}, want: []string{"d trip", "c idle", "b trip", "a trip"}},
+		{name: "by start", q: TestQuery{Sort: "start"}, want: []string{"c idle", "b trip", "a trip", "d trip"}},
+		{name: "by created desc", q: TestQuery{Sort: "created", Desc: true}, want: []string{"d trip", "c idle", "a trip", "b trip"}},
+		{name: "prefix", q: TestQuery{Prefix: "c"}, want: []string{"c idle"}},
+		{name: "any tag", q: TestQuery{Tags: []string{"smoke", "nightly"}}, want: []string{"a trip", "c idle", "d trip"}},
+		{name: "all tags", q: TestQuery{Tags: []string{"e2e", "smoke"}, MatchAll: true}, want: []string{"a trip"}},
+		{name: "first page", q: TestQuery{}, limit: 2, want: []string{"a trip", "b trip"}},
+		{name: "next page", q: TestQuery{After: "b trip"}, want: []string{"c idle", "d trip"}},
+		{name: "next page by start", q: TestQuery{Sort: "start", After: "b trip"}, want: []string{"a trip", "d trip"}},
+		{name: "next page with tags", q: TestQuery{Tags: []string{"e2e"}, After: "a trip"}, want: []string{"b trip"}},
+		{name: "unknown cursor", q: TestQuery{After: "nope"}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			err := selectTests(all(), tc.q, func(td *TestDoc) bool {
+				got = append(got, td.Name)
+				return tc.limit == 0 || len(got) < tc.limit
+			})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStoreTests(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if _, err := s.Test(ctx, "missing"); err != ErrNotFound {
+				t.Errorf("reading a missing test: got %v, want ErrNotFound", err)
+			}
+			td := &TestDoc{Name: "truckster 5 min trip", Tag: []string{"e2e"}, Account: 18, Transponder: 83,
+				StartTime: t0, EndTime: t0.Add(5 * time.Minute), Stats: &TestStats{Docs: 2}}
+			if err := s.PutTest(ctx, td); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.Test(ctx, td.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Name != td.Name || got.Account != 18 || !got.StartTime.Equal(t0) || got.Stats == nil || got.Stats.Docs != 2 {
+				t.Errorf("read back %+v", got)
+			}
+			if got.Created.IsZero() {
+				t.Error("store didn't set Created")
+			}
+			var names []string
+			err = s.Tests(ctx, TestQuery{Tags: []string{"e2e"}}, func(td *TestDoc) bool {
+				names = append(names, td.Name)
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(names, []string{td.Name}) {
+				t.Errorf("tests tagged e2e: %q", names)
+			}
+		})
+	}
+}
+
+func TestStoreTestReports(t *testing.T) {
+	// raw fields a Report doesn't know about, integers and timestamps have to come back as they were
+	data := map[string]interface{}{
+		"type":              "status",
+		"reportTimestamp":   t0,
+		"fsCreateTimestamp": t0.Add(2 * time.Second),
+		"speed":             int64(42),
+		"custom":            map[string]interface{}{"note": "kept", "list": []interface{}{true, 1.5}},
+	}
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			td := &TestDoc{Name: "multi", Tag: []string{"e2e"}, Account: 18, Transponders: []int{84, 83}, MultiVehicle: true}
+			if err := s.PutTest(ctx, td); err != nil {
+				t.Fatal(err)
+			}
+			reports := []VehicleReport{
+				{Vehicle: 84, Report: Report{Type: "status", FirestoreCreation: t0.Add(time.Second)}},
+				{Vehicle: 83, Report: Report{Type: "status", FirestoreCreation: t0.Add(2 * time.Second)}, Data: data},
+				{Vehicle: 83, Report: Report{Type: "speeding", FirestoreCreation: t0}},
+			}
+			for _, vr := range reports {
+				if err := s.AddTestReport(ctx, td, vr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := s.TestReports(ctx, td)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// by vehicle then fsCreateTimestamp
+			want := []string{"83 speeding", "83 status", "84 status"}
+			for i, vr := range got {
+				if i >= len(want) || want[i] != strconv.Itoa(vr.Vehicle)+" "+vr.Report.Type {
+					t.Fatalf("reports out of order: %+v", got)
+				}
+			}
+			if !reflect.DeepEqual(got[1].Data, data) {
+				t.Errorf("raw data changed on its way through:\n got %#v\nwant %#v", got[1].Data, data)
+			}
+			if got[0].Data != nil {
+				t.Errorf("report without raw data came back with %#v", got[0].Data)
+			}
+
+			loaded, err := StoredTest{Store: s, Name: "multi"}.Load(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(loaded.Vehicles, []int{83, 84}) || len(loaded.Reports) != 3 {
+				t.Errorf("loaded vehicles %v with %d reports", loaded.Vehicles, len(loaded.Reports))
+			}
+
+			// overwriting a test starts it out empty
+			if err := s.PutTest(ctx, td); err != nil {
+				t.Fatal(err)
+			}
+			got, err = s.TestReports(ctx, td)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 0 {
+				t.Errorf("overwritten test kept %d reports", len(got))
+			}
+		})
+	}
+}
+
+func TestStoreReports(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var paths []string
+			// written out of order, read back by reportTimestamp
+			for _, d := range []time.Duration{2 * time.Second, 0, time.Second} {
+				path, err := s.WriteReport(ctx, 18, 83, Report{Type: "status", ReportTimestamp: t0.Add(d)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				paths = append(paths, path)
+			}
+			if _, err := s.WriteReport(ctx, 18, 84, Report{Type: "speeding", ReportTimestamp: t0}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.Reports(ctx, 18, 83, ReportQuery{Start: t0, IncStart: true, End: t0.Add(time.Second), IncEnd: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 2 || !got[0].Report.ReportTimestamp.Equal(t0) || !got[1].Report.ReportTimestamp.Equal(t0.Add(time.Second)) {
+				t.Fatalf("reports in range: %+v", got)
+			}
+			if got[0].Report.FirestoreCreation.IsZero() || got[0].Created.IsZero() {
+				t.Error("store didn't set creation times")
+			}
+
+			read, err := s.ReadReports(ctx, append(paths, reportsPath(18, 83)+"/missing"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(read) != 4 || read[3] != nil {
+				t.Fatalf("read back %d reports, missing one %v", len(read), read[len(read)-1])
+			}
+			for i, sr := range read[:3] {
+				if sr == nil || sr.Path != paths[i] {
+					t.Errorf("report %d: got %+v, want %s", i, sr, paths[i])
+				}
+			}
+		})
+	}
+}
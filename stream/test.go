@@ -0,0 +1,86 @@
+package stream
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Test is everything a replay needs from a captured test
+type Test struct {
+	Name     string
+	Tags     []string
+	Vehicles []int // original transponder ids, ascending
+	Reports  []VehicleReport
+}
+
+// VehicleReport is a report along with the original vehicle it belongs to
+// Data holds the report's fields exactly as stored, nil for reports built in code
+type VehicleReport struct {
+	Vehicle int
+	Report  Report
+	Data    map[string]interface{}
+}
+
+// Source loads a test to replay
+type Source interface {
+	Load(ctx context.Context) (*Test, error)
+}
+
+// Load makes an in memory Test its own Source, handy for building tests in code
+func (t *Test) Load(ctx context.Context) (*Test, error) {
+	return t, nil
+}
+
+// Single vehicle tests keep their report collections directly on the test document:
+//
+//	Tests/{name}/report_data
+//
+// Multi vehicle tests (MultiVehicle: true) key report collections by the original vehicle:
+//
+//	Tests/{name}/vehicle/{transponderId}/report_data
+//
+// TestVehicle ties an original transponder id to the document its report collections hang off of.
+type TestVehicle struct {
+	Transponder int
+	Ref         *firestore.DocumentRef
+}
+
+// Reports returns the collection holding this vehicle's reports of the given type ex: report_data
+func (v TestVehicle) Reports(reportCollection string) *firestore.CollectionRef {
+	return v.Ref.Collection(reportCollection)
+}
+
+// TestVehicleRef is where a vehicle's report collections are stored within a test
+func TestVehicleRef(test *firestore.DocumentRef, transponder int, multi bool) *firestore.DocumentRef {
+	if !multi {
+		return test
+	}
+	return test.Collection("vehicle").Doc(strconv.Itoa(transponder))
+}
+
+// TestVehicles finds all vehicles stored in a test document, handles both single and multi vehicle layouts
+// vehicle documents without a numeric id aren't ours and are skipped
+func TestVehicles(ctx context.Context, test *firestore.DocumentSnapshot) ([]TestVehicle, error) {
+	data := test.Data()
+	if multi, _ := data["MultiVehicle"].(bool); !multi {
+		x, _ := data["Transponder"].(int64)
+		return []TestVehicle{{Transponder: int(x), Ref: test.Ref}}, nil
+	}
+	refs, err := test.Ref.Collection("vehicle").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var vehicles []TestVehicle
+	for _, ref := range refs {
+		x, err := strconv.Atoi(ref.ID)
+		if err != nil {
+			continue
+		}
+		vehicles = append(vehicles, TestVehicle{Transponder: x, Ref: ref})
+	}
+	sort.Slice(vehicles, func(i, j int) bool { return vehicles[i].Transponder < vehicles[j].Transponder })
+	return vehicles, nil
+}
@@ -0,0 +1,181 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// kinds of problems replay verification can find
+const (
+	IssueFailed    = "failed"    // the write itself returned an error
+	IssueMissing   = "missing"   // written, but not there when read back
+	IssueDuplicate = "duplicate" // a second copy of one of our reports
+	IssueMismatch  = "mismatch"  // there, but with different field values than we wrote
+	IssueTiming    = "timing"    // landed further off schedule than Options.Tolerance allows
+)
+
+// IssueKinds lists every Issue kind in the order we report them
+var IssueKinds = []string{IssueFailed, IssueMissing, IssueDuplicate, IssueMismatch, IssueTiming}
+
+// a single report replay wrote, kept around for verification
+type writtenReport struct {
+	path        string
+	account     int
+	transponder int
+	expected    Report    // exactly what we wrote
+	scheduled   time.Time // when the replay timeline says it should land
+	writtenAt   time.Time
+	landed      time.Time // when the target says it was created, set by verification
+	err         error     // from WriteReport
+}
+
+// Issue is a problem verification found with a single report
+type Issue struct {
+	Event  string // always "issue"
+	Kind   string // one of our Issue* constants
+	Path   string
+	Detail string
+}
+
+// read every written report back from the target and reconcile it with what we meant to write:
+// missing documents, duplicates, field mismatches and reports landing more than tolerance off schedule
+func verifyReplay(ctx context.Context, target Store, written []writtenReport, tolerance time.Duration) ([]Issue, error) {
+	var issues []Issue
+	add := func(kind, path, format string, a ...interface{}) {
+		issues = append(issues, Issue{Event: "issue", Kind: kind, Path: path, Detail: fmt.Sprintf(format, a...)})
+	}
+	// look up everything we wrote by path
+	var paths []string
+	var pending []*writtenReport
+	ours := make(map[string]bool)
+	for i := range written {
+		w := &written[i]
+		if w.err != nil {
+			add(IssueFailed, w.path, "%s", w.err)
+			continue
+		}
+		ours[w.path] = true
+		paths = append(paths, w.path)
+		pending = append(pending, w)
+	}
+	got, err := target.ReadReports(ctx, paths)
+	if err != nil {
+		return issues, err
+	}
+	for i, sr := range got {
+		w := pending[i]
+		if sr == nil {
+			add(IssueMissing, w.path, "not found in target")
+			continue
+		}
+		if sr.Err != nil {
+			add(IssueMismatch, w.path, "unreadable report: %s", sr.Err)
+			continue
+		}
+		if diff := reportDiff(&w.expected, &sr.Report); len(diff) > 0 {
+			add(IssueMismatch, w.path, "fields differ: %s", strings.Join(diff, ", "))
+		}
+		landed := sr.Created
+		if landed.IsZero() {
+			landed = w.writtenAt
+		}
+		w.landed = landed
+		if off := landed.Sub(w.scheduled); off > tolerance || off < -tolerance {
+			add(IssueTiming, w.path, "landed %s off schedule", off.Round(time.Millisecond))
+		}
+	}
+	dupes, err := findDuplicates(ctx, target, written, ours)
+	if err != nil {
+		return issues, err
+	}
+	return append(issues, dupes...), nil
+}
+
+// look through each target vehicle for copies of our reports we didn't write under those paths
+// only reports within our written reportTimestamp range are considered, so earlier replays don't count
+func findDuplicates(ctx context.Context, target Store, written []writtenReport, ours map[string]bool) ([]Issue, error) {
+	type window struct {
+		account, transponder int
+		from, to             time.Time
+		keys                 map[string]string // report key -> path of the document we wrote
+	}
+	windows := make(map[string]*window)
+	var order []string
+	for i := range written {
+		w := &written[i]
+		if w.err != nil {
+			continue
+		}
+		col := reportsPath(w.account, w.transponder)
+		win, ok := windows[col]
+		if !ok {
+			win = &window{account: w.account, transponder: w.transponder, from: w.expected.ReportTimestamp, to: w.expected.ReportTimestamp,
+				keys: make(map[string]string)}
+			windows[col] = win
+			order = append(order, col)
+		}
+		if w.expected.ReportTimestamp.Before(win.from) {
+			win.from = w.expected.ReportTimestamp
+		}
+		if w.expected.ReportTimestamp.After(win.to) {
+			win.to = w.expected.ReportTimestamp
+		}
+		win.keys[reportKey(&w.expected)] = w.path
+	}
+	sort.Strings(order)
+	var issues []Issue
+	for _, col := range order {
+		win := windows[col]
+		reports, err := target.Reports(ctx, win.account, win.transponder, ReportQuery{Start: win.from, End: win.to, IncStart: true, IncEnd: true})
+		if err != nil {
+			return issues, err
+		}
+		for _, sr := range reports {
+			if ours[sr.Path] || sr.Err != nil {
+				continue
+			}
+			if original, ok := win.keys[reportKey(&sr.Report)]; ok {
+				issues = append(issues, Issue{Event: "issue", Kind: IssueDuplicate, Path: sr.Path, Detail: "copy of " + original})
+			}
+		}
+	}
+	return issues, nil
+}
+
+// identifies a replayed report regardless of its document id
+func reportKey(r *Report) string {
+	return fmt.Sprintf("%s|%.0f|%d", r.Type, r.Serial, r.FirestoreCreation.Truncate(time.Microsecond).UnixNano())
+}
+
+// names of the fields that differ between two reports
+// Firestore stores timestamps with microsecond precision so that's as far as we compare them
+func reportDiff(want, got *Report) []string {
+	var diff []string
+	wv, gv := reflect.ValueOf(want).Elem(), reflect.ValueOf(got).Elem()
+	for i := 0; i < wv.NumField(); i++ {
+		a, b := wv.Field(i).Interface(), gv.Field(i).Interface()
+		var same bool
+		switch av := a.(type) {
+		case time.Time:
+			same = av.Truncate(time.Microsecond).Equal(b.(time.Time).Truncate(time.Microsecond))
+		case *latlng.LatLng:
+			bv := b.(*latlng.LatLng)
+			same = av.GetLatitude() == bv.GetLatitude() && av.GetLongitude() == bv.GetLongitude() && (av == nil) == (bv == nil)
+		case []string:
+			bv := b.([]string)
+			same = len(av) == len(bv) && (len(av) == 0 || reflect.DeepEqual(av, bv))
+		default:
+			same = a == b
+		}
+		if !same {
+			diff = append(diff, strings.Split(wv.Type().Field(i).Tag.Get("firestore"), ",")[0])
+		}
+	}
+	return diff
+}
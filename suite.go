@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"carmalink.com/replaystream/stream"
+	"github.com/jessevdk/go-flags"
+)
+
+// replay every test carrying our tag(s) onto the target, one after another or --parallel at a time,
+// verify each one, run our assertions against it and sum it all up in one report
+func suite(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsSuiteRun
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse suite run args")
+	}
+	if err := opts.validate(); err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	// every test gets the same replay options, only its name and target vehicles change
+	base := opts.replayOpts()
+	assertions, err := base.assertions()
+	if err == nil {
+		err = opts.checkAssertions(assertions)
+	}
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	sc, err := createFirestoreClient(ctx, fsClientConfig{c: opts.Source})
+	if err != nil {
+		return err
+	}
+	tc, err := createFirestoreClient(ctx, fsClientConfig{c: opts.Target, e: opts.EmulatorProjectId, l: true})
+	if err != nil {
+		return err
+	}
+	source, target := stream.NewFirestoreStore(sc), stream.NewFirestoreStore(tc)
+
+	tests, err := opts.tests(ctx, source)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s finding tests\n", red("ERROR"))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	if len(tests) == 0 {
+		err = fmt.Errorf("no tests found for tags: %s (%s)", strings.Join(opts.Tag, ", "), opts.Match)
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	fmt.Fprintf(msgOut, "running %s tests tagged %s (%s), %s at a time\n", blue(strconv.Itoa(len(tests))),
+		yellow(strings.Join(opts.Tag, ", ")), opts.Match, blue(strconv.Itoa(opts.Parallel)))
+
+	var rw *recordWriter
+	var outErr error // first failed record write, guarded by mu
+	if structuredOutput() {
+		rw = newRecordWriter(args.Output)
+	}
+	started := now()
+	pool := newVehiclePool(opts.Transponders)
+	results := make([]*replayResults, len(tests))
+	quiet := opts.Parallel > 1
+	var mu sync.Mutex // keeps each test's lines together
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				t := tests[i]
+				if !quiet {
+					fmt.Fprintf(msgOut, "\n%s %s (%d/%d)\n", blue("replaying"), green(t.Name), i+1, len(tests))
+				}
+				res := opts.replayTest(ctx, target, source, base, assertions, pool, t, quiet)
+				results[i] = res
+				mu.Lock()
+				if rw != nil {
+					if err := rw.write(newSuiteTest(res)); err != nil && outErr == nil {
+						outErr = err
+					}
+				} else {
+					printSuiteTest(res)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range tests {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	finished := now()
+
+	summary := suiteSummary{Event: "summary", Tags: opts.Tag, Match: opts.Match, Tests: len(results), Started: started, Finished: finished,
+		DurationSec: finished.Sub(started).Seconds()}
+	for _, r := range results {
+		if r.Passed {
+			summary.Passed++
+		} else {
+			summary.Failed++
+		}
+	}
+	if opts.Results != "" {
+		if err := writeSuiteResults(opts.Results, summary, results); err != nil {
+			fmt.Fprintf(msgOut, "%s writing results to %s\n", red("ERROR"), blue(opts.Results))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+	}
+	if opts.JUnit != "" {
+		if err := writeJUnit(opts.JUnit, results); err != nil {
+			fmt.Fprintf(msgOut, "%s writing JUnit report to %s\n", red("ERROR"), blue(opts.JUnit))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+	}
+	if rw != nil {
+		if outErr == nil {
+			if outErr = rw.write(summary); outErr == nil {
+				outErr = rw.close()
+			}
+		}
+		if outErr != nil {
+			fmt.Fprintf(msgOut, "%s writing %s output\n", red("ERROR"), args.Output)
+			fmt.Fprintln(msgOut, outErr)
+			return outErr
+		}
+	}
+	if summary.Failed > 0 {
+		err = fmt.Errorf("%d of %d tests failed", summary.Failed, summary.Tests)
+		fmt.Fprintf(msgOut, "\n%s %s\n", red("FAILED"), err)
+		return err
+	}
+	fmt.Fprintf(msgOut, "\n%s all %s tests passed in %s\n", green("success"), blue(strconv.Itoa(summary.Tests)), finished.Sub(started).Round(time.Second))
+	return nil
+}
+
+// replay a single test of our suite onto free target vehicles, a test that can't run is failed results
+func (o *optsSuiteRun) replayTest(ctx context.Context, target, source stream.Store, base optsReplay, assertions []stream.Assertion,
+	pool *vehiclePool, t *stream.TestDoc, quiet bool) *replayResults {
+	vehicles := newListRecord(t).Transponders
+	sort.Ints(vehicles)
+	if len(vehicles) > len(o.Transponders) {
+		err := fmt.Sprintf("test has %d vehicles, only %d --transponderId targets were given", len(vehicles), len(o.Transponders))
+		return &replayResults{Test: t.Name, Tags: t.Tag, Source: o.Source, Error: err}
+	}
+	targets := pool.acquire(len(vehicles))
+	defer pool.release(targets)
+	ro := base
+	ro.Name = t.Name
+	ro.Map = nil
+	for i, v := range vehicles {
+		ro.Map = append(ro.Map, strconv.Itoa(v)+":"+strconv.Itoa(targets[i]))
+	}
+	res, err := ro.run(ctx, target, source, assertions, nil, quiet)
+	if err != nil {
+		return &replayResults{Test: t.Name, Tags: t.Tag, Source: o.Source, Error: err.Error()}
+	}
+	return res
+}
+
+// every test carrying our tag(s), by name
+func (o *optsSuiteRun) tests(ctx context.Context, s stream.Store) ([]*stream.TestDoc, error) {
+	lo := optsList{Tag: o.Tag, Match: o.Match, Sort: "name"}
+	var tests []*stream.TestDoc
+	err := s.Tests(ctx, lo.testQuery(), func(t *stream.TestDoc) bool {
+		if lo.matchesTest(t) {
+			tests = append(tests, t)
+		}
+		return true
+	})
+	return tests, err
+}
+
+// hands out target transponders so tests running side by side never share one
+type vehiclePool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	free []int
+}
+
+func newVehiclePool(transponders []int) *vehiclePool {
+	vp := &vehiclePool{free: append([]int(nil), transponders...)}
+	vp.cond = sync.NewCond(&vp.mu)
+	return vp
+}
+
+// wait for n free transponders and take them, n must not be more than the pool holds
+func (vp *vehiclePool) acquire(n int) []int {
+	vp.mu.Lock()
+	defer vp.mu.Unlock()
+	for len(vp.free) < n {
+		vp.cond.Wait()
+	}
+	taken := append([]int(nil), vp.free[:n]...)
+	vp.free = vp.free[n:]
+	return taken
+}
+
+func (vp *vehiclePool) release(transponders []int) {
+	vp.mu.Lock()
+	vp.free = append(vp.free, transponders...)
+	vp.mu.Unlock()
+	vp.cond.Broadcast()
+}
+
+// emitted for every test a suite runs in structured output modes
+type suiteTest struct {
+	Event        string // always "test"
+	Test         string
+	Passed       bool
+	Docs         int
+	Written      int
+	Issues       int
+	Assertions   int
+	AssertFailed int
+	DurationSec  float64
+	Error        string `json:",omitempty"` // why the test failed
+}
+
+func newSuiteTest(r *replayResults) suiteTest {
+	s := suiteTest{Event: "test", Test: r.Test, Passed: r.Passed, Docs: r.Docs, Written: r.Written, Issues: len(r.Issues),
+		Assertions: len(r.Assertions), AssertFailed: r.AssertFailed(), DurationSec: r.DurationSec}
+	if err := r.Err(); err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+func (s suiteTest) csvHeader() []string {
+	return []string{"event", "test", "passed", "docs", "written", "issues", "assertions", "assertFailed", "durationSec", "error"}
+}
+
+func (s suiteTest) csvRow() []string {
+	return []string{s.Event, s.Test, strconv.FormatBool(s.Passed), strconv.Itoa(s.Docs), strconv.Itoa(s.Written), strconv.Itoa(s.Issues),
+		strconv.Itoa(s.Assertions), strconv.Itoa(s.AssertFailed), csvFloat(s.DurationSec), s.Error}
+}
+
+// final record emitted by a suite in structured output modes, also the top of --results
+type suiteSummary struct {
+	Event       string // always "summary"
+	Tags        []string
+	Match       string
+	Tests       int
+	Passed      int
+	Failed      int
+	Started     time.Time
+	Finished    time.Time
+	DurationSec float64
+}
+
+func (s suiteSummary) csvHeader() []string {
+	return []string{"event", "tags", "match", "tests", "passed", "failed", "started", "finished", "durationSec"}
+}
+
+func (s suiteSummary) csvRow() []string {
+	return []string{s.Event, strings.Join(s.Tags, ";"), s.Match, strconv.Itoa(s.Tests), strconv.Itoa(s.Passed), strconv.Itoa(s.Failed),
+		csvTime(s.Started), csvTime(s.Finished), csvFloat(s.DurationSec)}
+}
+
+// print a finished test for humans, with the details of anything that went wrong
+func printSuiteTest(r *replayResults) {
+	if r.Passed {
+		fmt.Fprintf(msgOut, "%s %s: %d reports, %d assertions in %.1fs\n", green("PASS"), blue(r.Test), r.Docs, len(r.Assertions), r.DurationSec)
+		return
+	}
+	fmt.Fprintf(msgOut, "%s %s: %s\n", red("FAIL"), blue(r.Test), r.Err())
+	printReplayIssues(r.Issues)
+	printAssertionResults(r.Assertions)
+}
+
+// write our suite summary along with every test's results as one JSON document
+func writeSuiteResults(file string, summary suiteSummary, results []*replayResults) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(struct {
+		suiteSummary
+		Results []*replayResults
+	}{summary, results})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Methods //
+
+func (o *optsSuiteRun) validate() error {
+	if !isEmulatorAddr(o.Target) {
+		return errors.New("suite run doesn't support anything beyond a local firestore emulator target")
+	}
+	if o.Parallel < 1 {
+		return errors.New("--parallel needs to be at least 1")
+	}
+	if o.Parallel > len(o.Transponders) {
+		return fmt.Errorf("--parallel %d needs at least as many --transponderId targets, got %d", o.Parallel, len(o.Transponders))
+	}
+	if o.Match == "any" && len(o.Tag) > maxTagFilters {
+		return fmt.Errorf("at most %d tags can be matched with --match any", maxTagFilters)
+	}
+	return nil
+}
+
+// tests replayed side by side share --accountId and never their transponders, so only assertions scoped to
+// {transponder} can tell which test triggered a document, anything else could pass on another test's documents
+func (o *optsSuiteRun) checkAssertions(as []stream.Assertion) error {
+	if o.Parallel < 2 {
+		return nil
+	}
+	for _, a := range as {
+		if !strings.Contains(a.Path, "{transponder}") {
+			return fmt.Errorf("assertion on %s could match documents of another test running alongside it, "+
+				"use a path below {transponder} ex: 'account/{account}/vehicle/{transponder}/alerts' or --parallel 1", a.Path)
+		}
+	}
+	return nil
+}
+
+// replay options shared by every test of our suite
+func (o *optsSuiteRun) replayOpts() optsReplay {
+	return optsReplay{
+		Account:           o.Account,
+		Target:            o.Target,
+		EmulatorProjectId: o.EmulatorProjectId,
+		Source:            o.Source,
+		SkipVerify:        o.SkipVerify,
+		Tolerance:         o.Tolerance,
+		Expect:            o.Expect,
+		Scenario:          o.Scenario,
+		AssertTimeout:     o.AssertTimeout,
+		TargetEmulator:    true,
+	}
+}
+
+// convert and set user-provided values into opts struct, run is a sub-command of suite
+func (o *optsSuiteRun) set(p *flags.Parser) (ok bool) {
+	cmd := p.Active.Active
+	if cmd == nil {
+		return false
+	}
+	o.Source, ok = cmd.FindOptionByLongName("source").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Tag, ok = cmd.FindOptionByLongName("tag").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.Match, ok = cmd.FindOptionByLongName("match").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Account, ok = cmd.FindOptionByLongName("accountId").Value().(int)
+	if !ok {
+		return false
+	}
+	o.Transponders, ok = cmd.FindOptionByLongName("transponderId").Value().([]int)
+	if !ok {
+		return false
+	}
+	o.Target, ok = cmd.FindOptionByLongName("target").Value().(string)
+	if !ok {
+		return false
+	}
+	o.EmulatorProjectId, ok = cmd.FindOptionByLongName("projectId").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Parallel, ok = cmd.FindOptionByLongName("parallel").Value().(int)
+	if !ok {
+		return false
+	}
+	o.SkipVerify, ok = cmd.FindOptionByLongName("skip-verify").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.Tolerance, ok = cmd.FindOptionByLongName("tolerance").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	o.Expect, ok = cmd.FindOptionByLongName("expect").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.Scenario, ok = cmd.FindOptionByLongName("scenario").Value().(string)
+	if !ok {
+		return false
+	}
+	o.AssertTimeout, ok = cmd.FindOptionByLongName("assertTimeout").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	o.JUnit, ok = cmd.FindOptionByLongName("junit").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Results, ok = cmd.FindOptionByLongName("results").Value().(string)
+	if !ok {
+		return false
+	}
+	return true
+}
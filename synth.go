@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+// mean earth radius in km, plenty accurate for the distances a vehicle covers between reports
+const earthRadiusKm = 6371.0088
+
+// a position along a route, Time is zero if unknown
+type trackPoint struct {
+	Lat  float64
+	Lng  float64
+	Time time.Time
+}
+
+// great circle distance between two points in km
+func distanceKm(a, b trackPoint) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLat, dLng := lat2-lat1, radians(b.Lng-a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// initial compass bearing from a to b in degrees, 0 is north and 90 east
+func bearing(a, b trackPoint) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLng := radians(b.Lng - a.Lng)
+	y := math.Sin(dLng) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLng)
+	return math.Mod(degrees(math.Atan2(y, x))+360, 360)
+}
+
+func radians(d float64) float64 { return d * math.Pi / 180 }
+func degrees(r float64) float64 { return r * 180 / math.Pi }
+
+// settings shared by everything building synthetic reports
+type synthOptions struct {
+	Type       string        // report type ex: status
+	Serial     int           // transponder the reports claim to come from
+	Interval   time.Duration // report cadence
+	SpeedLimit float64       // km/h, 0 leaves it unset
+	Odometer   float64       // km at the first report
+	Delay      time.Duration // simulated ingest delay, fsCreateTimestamp - reportTimestamp
+}
+
+// build a report at p, fsCreateTimestamp is set explicitly since replay paces itself on it
+func (o *synthOptions) report(p trackPoint, heading, speed, odometer float64) FirestoreTransponderReportV1 {
+	return FirestoreTransponderReportV1{
+		Type:              o.Type,
+		Serial:            float64(o.Serial),
+		LatLng:            &latlng.LatLng{Latitude: p.Lat, Longitude: p.Lng},
+		Heading:           heading,
+		Speed:             speed,
+		SpeedLimit:        o.SpeedLimit,
+		Odometer:          odometer,
+		ReportTimestamp:   p.Time,
+		FirestoreCreation: p.Time.Add(o.Delay),
+	}
+}
+
+// resample a timed route (every point has a Time, in order) into one report per interval
+// heading and speed come from the route segment each report lands on, the odometer accumulates distance travelled
+func sampleRoute(points []trackPoint, o *synthOptions) []FirestoreTransponderReportV1 {
+	if len(points) == 0 {
+		return nil
+	}
+	// cumulative distance at each point
+	dist := make([]float64, len(points))
+	for i := 1; i < len(points); i++ {
+		dist[i] = dist[i-1] + distanceKm(points[i-1], points[i])
+	}
+	var reports []FirestoreTransponderReportV1
+	var heading float64
+	seg := 0
+	start, end := points[0].Time, points[len(points)-1].Time
+	for t := start; ; t = t.Add(o.Interval) {
+		if t.After(end) { // always finish on the route's last point
+			t = end
+		}
+		for seg+1 < len(points)-1 && points[seg+1].Time.Before(t) {
+			seg++
+		}
+		p := points[seg]
+		var speed, d float64
+		if seg+1 < len(points) {
+			a, b := points[seg], points[seg+1]
+			segDist := dist[seg+1] - dist[seg]
+			frac := 1.0
+			if span := b.Time.Sub(a.Time); span > 0 {
+				frac = math.Min(1, math.Max(0, float64(t.Sub(a.Time))/float64(span)))
+				speed = segDist / span.Hours()
+			}
+			p = trackPoint{Lat: a.Lat + (b.Lat-a.Lat)*frac, Lng: a.Lng + (b.Lng-a.Lng)*frac}
+			d = dist[seg] + segDist*frac
+			if segDist > 0 { // keep our last heading while stopped
+				heading = bearing(a, b)
+			}
+		}
+		p.Time = t
+		reports = append(reports, o.report(p, heading, speed, o.Odometer+d))
+		if t.Equal(end) {
+			break
+		}
+	}
+	return reports
+}
+
+// write a synthetic single vehicle test: the test document, its reports under report_data, its stats and tag index counts
+// returns the number of reports written
+func saveSyntheticTest(ctx context.Context, c *firestore.Client, test *optsCopy, reports []FirestoreTransponderReportV1) (int, error) {
+	reportCollection := SupportedTransponderReports[0]
+	setSyntheticStats(test, reports)
+	ref := c.Collection("Tests").Doc(test.Name)
+	w := newBatcher(c)
+	err := w.set(ctx, ref, test)
+	if err != nil {
+		return 0, err
+	}
+	col := ref.Collection(reportCollection)
+	for _, r := range reports {
+		err = w.set(ctx, col.NewDoc(), r)
+		if err != nil {
+			return w.committed, err
+		}
+	}
+	err = w.flush(ctx)
+	if err != nil {
+		return w.committed, err
+	}
+	return len(reports), adjustTagIndex(ctx, c, test.Tag, 1)
+}
+
+// write a synthetic single vehicle test into a new archive file instead, see archive.go
+// returns the number of reports written
+func writeSyntheticArchive(file string, force bool, test *optsCopy, reports []FirestoreTransponderReportV1) (int, error) {
+	reportCollection := SupportedTransponderReports[0]
+	setSyntheticStats(test, reports)
+	f, err := createExportFile(file, force)
+	if err != nil {
+		return 0, err
+	}
+	aw, err := newArchiveWriter(f, archiveManifest{Test: test.Name, ExportedAt: now()})
+	if err == nil {
+		err = aw.writeTest(structToMap(test))
+	}
+	for i := 0; err == nil && i < len(reports); i++ {
+		var id string
+		if id, err = autoID(); err == nil {
+			err = aw.writeDoc(reportCollection+"/"+id, structToMap(reports[i]))
+		}
+	}
+	if err == nil {
+		err = aw.close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file) // don't leave a partial archive behind
+		return 0, err
+	}
+	return aw.docs, nil
+}
+
+func setSyntheticStats(test *optsCopy, reports []FirestoreTransponderReportV1) {
+	sb := newStatsBuilder()
+	for i := range reports {
+		sb.add(SupportedTransponderReports[0], test.Transponder, &reports[i])
+	}
+	stats := sb.result()
+	test.Stats = &stats
+}
+
+const autoIDChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// a random 20 character document id, like the ones CollectionRef.NewDoc hands out
+func autoID() (string, error) {
+	b := make([]byte, 20)
+	if _, err := crand.Read(b); err != nil {
+		return "", fmt.Errorf("generating document id: %s", err)
+	}
+	for i := range b {
+		b[i] = autoIDChars[int(b[i])%len(autoIDChars)]
+	}
+	return string(b), nil
+}
@@ -2,10 +2,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 
+	"cloud.google.com/go/firestore"
 	"github.com/jessevdk/go-flags"
+	"google.golang.org/api/iterator"
+)
+
+// Aggregated tag index, a single document holding a usage count for every tag:
+//
+//	Meta/tags { Counts: { e2e: 12, smoke_test: 3, ... } }
+//
+// kept up to date by every command that adds or removes tests or tags.
+const (
+	metaCollection = "Meta"
+	tagIndexDoc    = "tags"
 )
 
 func tags(ctx context.Context, p *flags.Parser) error {
@@ -14,43 +28,205 @@ func tags(ctx context.Context, p *flags.Parser) error {
 	// populate our opts
 	ok := opts.set(p)
 	if !ok {
-		fmt.Printf("%s cmd line args cannot be parsed!\n", red("ERROR"))
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse tags args")
 	}
 	// create our client based on usr provided opts
 	conf := fsClientConfig{c: opts.Source}
-	c := createFirestoreClient(ctx, conf)
+	c, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
 
 	// map to store result tags and frequency in
-	tagMap := make(map[string]int)
+	var tagMap map[string]int
+	if !opts.Scan && !opts.Rebuild {
+		tagMap, err = readTagIndex(ctx, c)
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s reading tag index\n", red("ERROR"))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+		if tagMap == nil {
+			fmt.Fprintf(msgOut, "%s no tag index found, scanning every test. Run with %s to create one\n", yellow("WARN"), blue("--rebuild"))
+		}
+	}
+	if tagMap == nil {
+		tagMap, err = scanTags(ctx, c)
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s querying collection\n", red("ERROR"))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+	}
+	if opts.Rebuild {
+		_, err = c.Collection(metaCollection).Doc(tagIndexDoc).Set(ctx, map[string]interface{}{"Counts": tagMap})
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s writing tag index\n", red("ERROR"))
+			fmt.Fprintln(msgOut, err)
+			return err
+		}
+		fmt.Fprintf(msgOut, "%s tag index rebuilt with %s tags\n", green("success"), blue(strconv.Itoa(len(tagMap))))
+	}
+	if structuredOutput() {
+		rw := newRecordWriter(args.Output)
+		for _, tc := range sortTags(tagMap, opts.Sort, opts.Results) {
+			if err := rw.write(tc); err != nil {
+				return err
+			}
+		}
+		return rw.close()
+	}
+	if len(tagMap) == 0 {
+		fmt.Fprintf(msgOut, "No results returned from Firestore\n")
+		return nil
+	}
+	// print out the tags we found and how many times they're used in test db
+	for _, tc := range sortTags(tagMap, opts.Sort, opts.Results) {
+		fmt.Fprintf(msgOut, "%s : %s\n", blue(tc.Tag), green(strconv.Itoa(tc.Count)))
+	}
+	return nil
+}
+
+type tagCount struct {
+	Tag   string
+	Count int
+}
+
+func (tc tagCount) csvHeader() []string { return []string{"tag", "count"} }
+func (tc tagCount) csvRow() []string    { return []string{tc.Tag, strconv.Itoa(tc.Count)} }
+
+// sort tags by count (most used first, ties by name) or name and keep the first n, n <= 0 keeps all
+func sortTags(tagMap map[string]int, by string, n int) []tagCount {
+	out := make([]tagCount, 0, len(tagMap))
+	for tag, count := range tagMap {
+		if count > 0 {
+			out = append(out, tagCount{tag, count})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if by == "count" && out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Tag < out[j].Tag
+	})
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
 
-	// query //
-	q := c.Collection("Tests").Select("Tag").Limit(opts.Results)
-	iter1, err := q.Documents(ctx).GetAll()
+// read our aggregated tag index, returns a nil map if no index exists yet
+func readTagIndex(ctx context.Context, c *firestore.Client) (map[string]int, error) {
+	snap, err := c.Collection(metaCollection).Doc(tagIndexDoc).Get(ctx)
+	if isNotFound(err) {
+		return nil, nil
+	}
 	if err != nil {
-		fmt.Printf("%s querying collection", red("ERROR"))
+		return nil, err
 	}
-	for _, doc := range iter1 {
-		data := doc.Data()
-		if data == nil {
-			fmt.Printf("No results returned from Firestore")
-			return nil
+	var idx struct{ Counts map[string]int }
+	err = snap.DataTo(&idx)
+	if err != nil {
+		return nil, err
+	}
+	if idx.Counts == nil {
+		idx.Counts = make(map[string]int)
+	}
+	return idx.Counts, nil
+}
+
+// count tags across every test document, streaming through the whole Tests collection
+func scanTags(ctx context.Context, c *firestore.Client) (map[string]int, error) {
+	return countTags(c.Collection("Tests").Select("Tag").Documents(ctx))
+}
+
+// count each tag once per test document handed back by iter
+func countTags(iter *firestore.DocumentIterator) (map[string]int, error) {
+	tagMap := make(map[string]int)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
 		}
 		// unpack result and potential array of interfaces (strings here)
-		tags, ok := data["Tag"].([]interface{})
-		if ok {
-			for _, tag := range tags {
-				tv := tag.(string)
+		tags, ok := doc.Data()["Tag"].([]interface{})
+		if !ok {
+			continue
+		}
+		seen := make(map[string]bool, len(tags))
+		for _, tag := range tags {
+			if tv, ok := tag.(string); ok && !seen[tv] {
+				seen[tv] = true
 				tagMap[tv]++
 			}
-		} else {
-			//fmt.Printf("document is missing tag field %v\n", data)
 		}
 	}
-	// print out the tags we found and how many times they're used in test db
-	for tag, count := range tagMap {
-		fmt.Printf("%s : %s\n", blue(tag), green(strconv.Itoa(count)))
+	return tagMap, nil
+}
+
+// add delta (+1/-1) to each tag's count in our tag index, repeated tags only count once
+// call it once the test documents are written (or deleted), see updateTagIndex
+func adjustTagIndex(ctx context.Context, c *firestore.Client, tags []string, delta int) error {
+	deltas := make(map[string]int, len(tags))
+	for _, tag := range tags {
+		deltas[tag] = delta
 	}
-	return nil
+	return updateTagIndex(ctx, c, deltas)
+}
+
+// swap a test's old tags for its new ones in our tag index, ex: when a test is overwritten
+// like adjustTagIndex, repeated tags only count once on either side
+func replaceTagIndex(ctx context.Context, c *firestore.Client, old, new []string) error {
+	deltas := make(map[string]int, len(old)+len(new))
+	for _, tag := range old {
+		deltas[tag] = -1
+	}
+	added := make(map[string]bool, len(new))
+	for _, tag := range new {
+		if !added[tag] {
+			added[tag] = true
+			deltas[tag]++
+		}
+	}
+	return updateTagIndex(ctx, c, deltas)
+}
+
+// apply per tag deltas to our tag index
+// an index that doesn't exist yet is seeded by scanning every test instead, which already includes the change
+// (incrementing a missing index would leave a partial one behind that under-counts every older test)
+func updateTagIndex(ctx context.Context, c *firestore.Client, deltas map[string]int) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	ref := c.Collection(metaCollection).Doc(tagIndexDoc)
+	return c.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		_, err := tx.Get(ref)
+		if isNotFound(err) {
+			counts, err := countTags(tx.Documents(c.Collection("Tests").Select("Tag")))
+			if err != nil {
+				return err
+			}
+			return tx.Set(ref, map[string]interface{}{"Counts": counts})
+		}
+		if err != nil {
+			return err
+		}
+		var updates []firestore.Update
+		for tag, delta := range deltas {
+			if delta != 0 {
+				updates = append(updates, firestore.Update{FieldPath: firestore.FieldPath{"Counts", tag}, Value: firestore.Increment(delta)})
+			}
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+		return tx.Update(ref, updates)
+	})
 }
 
 // Methods //
@@ -65,5 +241,17 @@ func (o *optsListTags) set(p *flags.Parser) (ok bool) {
 	if !ok {
 		return false
 	}
+	o.Sort, ok = p.Active.FindOptionByLongName("sort").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Scan, ok = p.Active.FindOptionByLongName("scan").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.Rebuild, ok = p.Active.FindOptionByLongName("rebuild").Value().(bool)
+	if !ok {
+		return false
+	}
 	return true
 }
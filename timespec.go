@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// layouts accepted for wall clock time strings without an explicit offset,
+// these are interpreted in the user-provided timezone (--timezone)
+var localTimeLayouts = [...]string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseTimeSpec converts a user-provided time string into a UTC time.Time. Supported forms:
+//
+//	1614951600000               milliseconds since unix epoch (original format)
+//	2021-03-05T13:40:00Z        RFC3339, an offset in the string wins over loc
+//	2021-03-05 06:40:00         local time in loc, seconds and time of day are optional
+//	now, now-30m, now+1h, -2h   relative to ref, days are allowed too ex: 'now-1d'
+func parseTimeSpec(s string, loc *time.Location, ref time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, errors.New("empty time value")
+	}
+	// epoch millis
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+	}
+	// relative to ref
+	if strings.HasPrefix(s, "now") || strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		rel := strings.TrimSpace(strings.TrimPrefix(s, "now"))
+		if rel == "" {
+			return ref.UTC(), nil
+		}
+		if rel[0] != '-' && rel[0] != '+' {
+			return time.Time{}, fmt.Errorf("relative time %q must look like 'now-30m' or '-2h'", s)
+		}
+		d, err := parseSpecDuration(rel[1:])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("relative time %q: %s", s, err)
+		}
+		if rel[0] == '-' {
+			d = -d
+		}
+		return ref.Add(d).UTC(), nil
+	}
+	// absolute timestamps
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UTC(), nil
+	}
+	for _, layout := range localTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q, use epoch millis, RFC3339, '2006-01-02 15:04:05' or a relative value like 'now-30m'", s)
+}
+
+// parseSpecDuration is time.ParseDuration with an added 'd' (24h) unit ex: '1d', '2d12h'
+func parseSpecDuration(s string) (time.Duration, error) {
+	var days time.Duration
+	if i := strings.Index(s, "d"); i != -1 {
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		s = s[i+1:]
+		if s == "" {
+			return days, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return days + d, nil
+}
+
+// millis converts a time.Time into milliseconds since unix epoch
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
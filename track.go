@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// turn a GPX, KML or GeoJSON route into a synthetic test, for routes we have no real transponder capture of
+func track(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsTrack
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse track args")
+	}
+	if isEmulatorAddr(opts.Target) && opts.EmulatorProjectId == "" {
+		err := errors.New("writing into an emulator needs its --projectId")
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	if opts.Interval <= 0 {
+		err := errors.New("--interval must be positive")
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+
+	points, err := readTrack(opts.File, opts.Format)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s reading track %s\n", red("ERROR"), blue(opts.File))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	points, err = opts.timeRoute(points, now())
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	so := synthOptions{
+		Type:       opts.Type,
+		Serial:     opts.Transponder,
+		Interval:   opts.Interval,
+		SpeedLimit: opts.SpeedLimit,
+		Odometer:   opts.Odometer,
+		Delay:      opts.Delay,
+	}
+	reports := sampleRoute(points, &so)
+
+	test := optsCopy{
+		Transponders: []int{opts.Transponder},
+		Transponder:  opts.Transponder,
+		Account:      opts.Account,
+		Name:         opts.Name,
+		Description:  opts.Description,
+		Tag:          opts.Tag,
+		Source:       filepath.Base(opts.File),
+		Target:       opts.Target,
+		StartTime:    points[0].Time,
+		EndTime:      points[len(points)-1].Time,
+	}
+	test.Stime = millis(test.StartTime)
+	test.Etime = millis(test.EndTime)
+
+	conf := targetClientConfig(opts.Target, opts.EmulatorProjectId)
+	c, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
+	err = ensureNoTest(ctx, c.Collection("Tests").Doc(opts.Name))
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	n, err := saveSyntheticTest(ctx, c, &test, reports)
+	if err != nil {
+		fmt.Fprintf(msgOut, "%s saving test %s, %s documents written so far\n", red("ERROR"), blue(opts.Name), blue(strconv.Itoa(n)))
+		fmt.Fprintln(msgOut, err)
+		return err
+	}
+	fmt.Fprintf(msgOut, "%s created %s with %s reports covering %s km\n", green("success"), blue(opts.Name),
+		blue(strconv.Itoa(n)), blue(strconv.FormatFloat(test.Stats.Distance, 'f', 2, 64)))
+	return nil
+}
+
+// give every point of a route a time
+// tracks with timestamps keep them (moved to --startTime if given), others are driven at --speed from --startTime or ref
+func (o *optsTrack) timeRoute(points []trackPoint, ref time.Time) ([]trackPoint, error) {
+	if len(points) == 0 {
+		return nil, errors.New("track holds no points")
+	}
+	var start time.Time
+	if o.Start != "" {
+		loc, err := time.LoadLocation(o.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %q: %s", o.Timezone, err)
+		}
+		start, err = parseTimeSpec(o.Start, loc, ref)
+		if err != nil {
+			return nil, fmt.Errorf("--startTime: %s", err)
+		}
+	}
+	timed := 0
+	for _, p := range points {
+		if !p.Time.IsZero() {
+			timed++
+		}
+	}
+	if timed == len(points) {
+		for i := 1; i < len(points); i++ {
+			if points[i].Time.Before(points[i-1].Time) {
+				return nil, fmt.Errorf("track timestamps go backwards at point %d", i+1)
+			}
+		}
+		if !start.IsZero() {
+			shift := start.Sub(points[0].Time)
+			for i := range points {
+				points[i].Time = points[i].Time.Add(shift)
+			}
+		}
+		return points, nil
+	}
+	if timed > 0 {
+		fmt.Fprintf(msgOut, "%s only %d of %d track points have a timestamp, ignoring them\n", yellow("WARN"), timed, len(points))
+	}
+	if o.Speed <= 0 {
+		return nil, errors.New("--speed must be positive for tracks without timestamps")
+	}
+	if start.IsZero() {
+		start = ref
+	}
+	t := start
+	for i := range points {
+		if i > 0 {
+			hours := distanceKm(points[i-1], points[i]) / o.Speed
+			t = t.Add(time.Duration(hours * float64(time.Hour)))
+		}
+		points[i].Time = t
+	}
+	return points, nil
+}
+
+// read every point of a track file, format is gpx, kml, geojson or auto to go by the file extension
+func readTrack(file, format string) ([]trackPoint, error) {
+	if format == "auto" {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".gpx":
+			format = "gpx"
+		case ".kml":
+			format = "kml"
+		case ".geojson", ".json":
+			format = "geojson"
+		default:
+			return nil, fmt.Errorf("can't tell the format of %s, use --format", file)
+		}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	switch format {
+	case "gpx":
+		return parseGPX(f)
+	case "kml":
+		return parseKML(f)
+	case "geojson":
+		return parseGeoJSON(f)
+	}
+	return nil, fmt.Errorf("unsupported track format %s", format)
+}
+
+// GPX track and route points, in document order: <trkpt lat="" lon=""><time>...</time></trkpt>
+func parseGPX(r io.Reader) ([]trackPoint, error) {
+	var points []trackPoint
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || (se.Name.Local != "trkpt" && se.Name.Local != "rtept") {
+			continue
+		}
+		var pt struct {
+			Lat  float64 `xml:"lat,attr"`
+			Lon  float64 `xml:"lon,attr"`
+			Time string  `xml:"time"`
+		}
+		err = d.DecodeElement(&pt, &se)
+		if err != nil {
+			return nil, err
+		}
+		p := trackPoint{Lat: pt.Lat, Lng: pt.Lon}
+		if pt.Time != "" {
+			p.Time, err = time.Parse(time.RFC3339, strings.TrimSpace(pt.Time))
+			if err != nil {
+				return nil, fmt.Errorf("point %d: %s", len(points)+1, err)
+			}
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// KML LineString coordinates ('lng,lat[,alt] ...') and gx:Track <when>/<gx:coord> pairs, in document order
+func parseKML(r io.Reader) ([]trackPoint, error) {
+	var points []trackPoint
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case "LineString":
+			var ls struct {
+				Coordinates string `xml:"coordinates"`
+			}
+			err = d.DecodeElement(&ls, &se)
+			if err != nil {
+				return nil, err
+			}
+			for _, tuple := range strings.Fields(ls.Coordinates) {
+				p, err := parseKMLCoord(strings.Split(tuple, ","))
+				if err != nil {
+					return nil, err
+				}
+				points = append(points, p)
+			}
+		case "Track":
+			var tr struct {
+				When  []string `xml:"when"`
+				Coord []string `xml:"coord"`
+			}
+			err = d.DecodeElement(&tr, &se)
+			if err != nil {
+				return nil, err
+			}
+			if len(tr.When) != 0 && len(tr.When) != len(tr.Coord) {
+				return nil, fmt.Errorf("gx:Track has %d <when> but %d <gx:coord> elements", len(tr.When), len(tr.Coord))
+			}
+			for i, coord := range tr.Coord {
+				p, err := parseKMLCoord(strings.Fields(coord))
+				if err != nil {
+					return nil, err
+				}
+				if len(tr.When) != 0 {
+					p.Time, err = time.Parse(time.RFC3339, strings.TrimSpace(tr.When[i]))
+					if err != nil {
+						return nil, err
+					}
+				}
+				points = append(points, p)
+			}
+		}
+	}
+	return points, nil
+}
+
+// lng, lat and an optional altitude we don't use
+func parseKMLCoord(parts []string) (trackPoint, error) {
+	if len(parts) < 2 {
+		return trackPoint{}, fmt.Errorf("invalid KML coordinate %q", strings.Join(parts, ","))
+	}
+	lng, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return trackPoint{}, err
+	}
+	lat, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return trackPoint{}, err
+	}
+	return trackPoint{Lat: lat, Lng: lng}, nil
+}
+
+// any GeoJSON object: FeatureCollection, Feature or a bare geometry
+type geoJSONObject struct {
+	Type        string          `json:"type"`
+	Features    []geoJSONObject `json:"features"`
+	Geometry    *geoJSONObject  `json:"geometry"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Properties  struct {
+		CoordTimes json.RawMessage `json:"coordTimes"` // per point times, as written by togeojson and friends
+	} `json:"properties"`
+}
+
+// every LineString and MultiLineString in a GeoJSON document, in document order
+// per point timestamps are read from a Feature's "coordTimes" property
+func parseGeoJSON(r io.Reader) ([]trackPoint, error) {
+	var obj geoJSONObject
+	err := json.NewDecoder(r).Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	return obj.points(nil)
+}
+
+func (g *geoJSONObject) points(times json.RawMessage) ([]trackPoint, error) {
+	switch g.Type {
+	case "FeatureCollection":
+		var points []trackPoint
+		for i := range g.Features {
+			ps, err := g.Features[i].points(nil)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, ps...)
+		}
+		return points, nil
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, nil
+		}
+		return g.Geometry.points(g.Properties.CoordTimes)
+	case "LineString":
+		var coords [][]float64
+		if err := json.Unmarshal(g.Coordinates, &coords); err != nil {
+			return nil, err
+		}
+		var ts []string
+		if len(times) != 0 {
+			if err := json.Unmarshal(times, &ts); err != nil {
+				return nil, fmt.Errorf("coordTimes: %s", err)
+			}
+		}
+		return geoJSONLine(coords, ts)
+	case "MultiLineString":
+		var lines [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &lines); err != nil {
+			return nil, err
+		}
+		var ts [][]string
+		if len(times) != 0 {
+			if err := json.Unmarshal(times, &ts); err != nil {
+				return nil, fmt.Errorf("coordTimes: %s", err)
+			}
+		}
+		var points []trackPoint
+		for i, line := range lines {
+			var lineTimes []string
+			if i < len(ts) {
+				lineTimes = ts[i]
+			}
+			ps, err := geoJSONLine(line, lineTimes)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, ps...)
+		}
+		return points, nil
+	}
+	return nil, nil // points, polygons and such aren't routes
+}
+
+// GeoJSON positions are [lng, lat(, alt)]
+func geoJSONLine(coords [][]float64, times []string) ([]trackPoint, error) {
+	if len(times) != 0 && len(times) != len(coords) {
+		return nil, fmt.Errorf("coordTimes has %d entries for %d coordinates", len(times), len(coords))
+	}
+	points := make([]trackPoint, 0, len(coords))
+	for i, c := range coords {
+		if len(c) < 2 {
+			return nil, fmt.Errorf("invalid GeoJSON position %v", c)
+		}
+		p := trackPoint{Lat: c[1], Lng: c[0]}
+		if len(times) != 0 {
+			t, err := time.Parse(time.RFC3339, times[i])
+			if err != nil {
+				return nil, err
+			}
+			p.Time = t
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// Methods //
+
+// convert and set user-provided values into opts struct
+func (o *optsTrack) set(p *flags.Parser) (ok bool) {
+	o.File, ok = p.Active.FindOptionByLongName("file").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Format, ok = p.Active.FindOptionByLongName("format").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Name, ok = p.Active.FindOptionByLongName("name").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Description, ok = p.Active.FindOptionByLongName("description").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Tag, ok = p.Active.FindOptionByLongName("tag").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.Target, ok = p.Active.FindOptionByLongName("target").Value().(string)
+	if !ok {
+		return false
+	}
+	o.EmulatorProjectId, ok = p.Active.FindOptionByLongName("projectId").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Account, ok = p.Active.FindOptionByLongName("accountId").Value().(int)
+	if !ok {
+		return false
+	}
+	o.Transponder, ok = p.Active.FindOptionByLongName("transponderId").Value().(int)
+	if !ok {
+		return false
+	}
+	o.Start, ok = p.Active.FindOptionByLongName("startTime").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Timezone, ok = p.Active.FindOptionByLongName("timezone").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Interval, ok = p.Active.FindOptionByLongName("interval").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	o.Speed, ok = p.Active.FindOptionByLongName("speed").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.SpeedLimit, ok = p.Active.FindOptionByLongName("speedLimit").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.Odometer, ok = p.Active.FindOptionByLongName("odometer").Value().(float64)
+	if !ok {
+		return false
+	}
+	o.Type, ok = p.Active.FindOptionByLongName("type").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Delay, ok = p.Active.FindOptionByLongName("delay").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	return true
+}
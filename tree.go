@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// Firestore commits at most 500 writes at a time
+const maxBatchWrites = 500
+
+// collection holding a multi vehicle test's vehicle documents: Tests/{name}/vehicle/{transponderId}
+const vehicleCollection = "vehicle"
+
+// batcher groups writes into WriteBatches, committing each time one fills up
+type batcher struct {
+	c *firestore.Client
+	b *firestore.WriteBatch
+	n int // writes in our current batch
+	// total writes committed so far
+	committed int
+}
+
+func newBatcher(c *firestore.Client) *batcher {
+	return &batcher{c: c, b: c.Batch()}
+}
+
+func (w *batcher) set(ctx context.Context, ref *firestore.DocumentRef, data interface{}) error {
+	w.b.Set(ref, data)
+	return w.added(ctx)
+}
+
+func (w *batcher) delete(ctx context.Context, ref *firestore.DocumentRef) error {
+	w.b.Delete(ref)
+	return w.added(ctx)
+}
+
+func (w *batcher) added(ctx context.Context) error {
+	w.n++
+	if w.n < maxBatchWrites {
+		return nil
+	}
+	return w.flush(ctx)
+}
+
+// commit any pending writes
+func (w *batcher) flush(ctx context.Context) error {
+	if w.n == 0 {
+		return nil
+	}
+	_, err := w.b.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	w.committed += w.n
+	w.b = w.c.Batch()
+	w.n = 0
+	return nil
+}
+
+// delete every document in every subcollection below a test document ref, and then ref itself
+// subcollections are discovered as we go, so collections we don't know about yet are covered too
+// shallow skips looking below report documents, see hasSubcollections
+// returns the number of documents deleted
+func deleteDocTree(ctx context.Context, c *firestore.Client, ref *firestore.DocumentRef, shallow bool) (int, error) {
+	w := newBatcher(c)
+	err := deleteBelow(ctx, w, ref, "", shallow)
+	if err != nil {
+		return w.committed, err
+	}
+	err = w.delete(ctx, ref)
+	if err != nil {
+		return w.committed, err
+	}
+	err = w.flush(ctx)
+	return w.committed, err
+}
+
+// rel is the path of ref relative to our test document, see hasSubcollections
+func deleteBelow(ctx context.Context, w *batcher, ref *firestore.DocumentRef, rel string, shallow bool) error {
+	if shallow && !hasSubcollections(rel) {
+		return nil
+	}
+	cols, err := ref.Collections(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	for _, col := range cols {
+		colRel := joinPath(rel, col.ID)
+		// DocumentRefs includes "missing" documents that only exist as parents of other collections
+		iter := col.DocumentRefs(ctx)
+		for {
+			child, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			err = deleteBelow(ctx, w, child, joinPath(colRel, child.ID), shallow)
+			if err != nil {
+				return err
+			}
+			err = w.delete(ctx, child)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// our own layout only keeps subcollections below a test document and its vehicle documents, everything else is a report
+// shallow walks trust that and don't spend a Collections call on every single report, rel is a path relative to the test document
+func hasSubcollections(rel string) bool {
+	if rel == "" {
+		return true
+	}
+	parts := strings.Split(rel, "/")
+	return len(parts) == 2 && parts[0] == vehicleCollection
+}
+
+// copy src and every subcollection below it onto dst, within the same or another Firestore db
+// transform (optional) may modify the data of src itself before it's written, shallow is as in deleteDocTree
+// returns the number of documents written
+func copyDocTree(ctx context.Context, src *firestore.DocumentRef, dc *firestore.Client, dst *firestore.DocumentRef, shallow bool,
+	transform func(map[string]interface{})) (int, error) {
+	w := newBatcher(dc)
+	snap, err := src.Get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	data := snap.Data()
+	if transform != nil {
+		transform(data)
+	}
+	err = w.set(ctx, dst, data)
+	if err != nil {
+		return w.committed, err
+	}
+	err = copyBelow(ctx, w, src, dst, shallow)
+	if err != nil {
+		return w.committed, err
+	}
+	err = w.flush(ctx)
+	return w.committed, err
+}
+
+func copyBelow(ctx context.Context, w *batcher, src, dst *firestore.DocumentRef, shallow bool) error {
+	return walkBelow(ctx, src, "", shallow, func(rel string, snap *firestore.DocumentSnapshot) error {
+		return w.set(ctx, relDoc(dst, rel), snap.Data())
+	})
+}
+
+// walkBelow calls fn for every existing document in every subcollection below a test document ref
+// parents are visited before their children, rel is the document path relative to ref ex: 'vehicle/83/report_data/abc'
+// shallow is as in deleteDocTree, its reports are streamed so large collections are never held in memory all at once
+func walkBelow(ctx context.Context, ref *firestore.DocumentRef, rel string, shallow bool, fn func(rel string, snap *firestore.DocumentSnapshot) error) error {
+	if shallow && !hasSubcollections(rel) {
+		return nil
+	}
+	cols, err := ref.Collections(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	for _, col := range cols {
+		colRel := joinPath(rel, col.ID)
+		if shallow && !(rel == "" && col.ID == vehicleCollection) {
+			err = walkDocs(ctx, col, colRel, fn)
+		} else {
+			err = walkRefs(ctx, col, colRel, shallow, fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// every document of a collection and everything below them, one at a time
+// DocumentRefs also finds "missing" documents, those only have subcollections to visit
+func walkRefs(ctx context.Context, col *firestore.CollectionRef, colRel string, shallow bool, fn func(rel string, snap *firestore.DocumentSnapshot) error) error {
+	iter := col.DocumentRefs(ctx)
+	for {
+		child, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		docRel := joinPath(colRel, child.ID)
+		snap, err := child.Get(ctx)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		if err == nil {
+			err = fn(docRel, snap)
+			if err != nil {
+				return err
+			}
+		}
+		err = walkBelow(ctx, child, docRel, shallow, fn)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// stream every document of a report collection to fn
+func walkDocs(ctx context.Context, col *firestore.CollectionRef, colRel string, fn func(rel string, snap *firestore.DocumentSnapshot) error) error {
+	iter := col.Documents(ctx)
+	defer iter.Stop()
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(joinPath(colRel, snap.Ref.ID), snap)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// document at a path relative to root ex: relDoc(Tests/abc, 'report_data/xyz') is Tests/abc/report_data/xyz
+func relDoc(root *firestore.DocumentRef, rel string) *firestore.DocumentRef {
+	parts := strings.Split(rel, "/")
+	ref := root
+	for i := 0; i+1 < len(parts); i += 2 {
+		ref = ref.Collection(parts[i]).Doc(parts[i+1])
+	}
+	return ref
+}
+
+func joinPath(base, id string) string {
+	if base == "" {
+		return id
+	}
+	return base + "/" + id
+}
@@ -1,7 +1,32 @@
 package main
 
-import "time"
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
 
 func now() time.Time {
 	return time.Now().UTC()
 }
+
+// true if a Firestore call failed because the document doesn't exist
+func isNotFound(err error) bool {
+	return status.Code(err) == codes.NotFound
+}
+
+// ask the user a yes/no question on stdin, anything but y/yes is a no
+func confirm(question string) bool {
+	fmt.Fprintf(msgOut, "%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"cloud.google.com/go/firestore"
+)
+
+// list every vehicle (transponder id) under a source account
+// vehicle documents may only exist as parents of report collections, DocumentRefs() still finds those
+func accountVehicles(ctx context.Context, c *firestore.Client, account int) ([]int, error) {
+	refs, err := c.Collection("account/" + strconv.Itoa(account) + "/vehicle").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, ref := range refs {
+		x, err := strconv.Atoi(ref.ID)
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s skipping non-numeric vehicle id %s\n", yellow("WARN"), blue(ref.ID))
+			continue
+		}
+		ids = append(ids, x)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
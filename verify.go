@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+
+	"carmalink.com/replaystream/stream"
+)
+
+// emitted for every problem verification finds in structured output modes
+type replayIssue stream.Issue
+
+func (i replayIssue) csvHeader() []string { return []string{"event", "kind", "path", "detail"} }
+func (i replayIssue) csvRow() []string    { return []string{i.Event, i.Kind, i.Path, i.Detail} }
+
+// list verification problems for humans, a few of each kind
+func printReplayIssues(issues []stream.Issue) {
+	const perKind = 5
+	shown := make(map[string]int)
+	counts := make(map[string]int)
+	for _, issue := range issues {
+		counts[issue.Kind]++
+		if shown[issue.Kind] < perKind {
+			shown[issue.Kind]++
+			fmt.Fprintf(msgOut, "%s %s %s\n", red(issue.Kind), blue(issue.Path), issue.Detail)
+		}
+	}
+	for _, kind := range stream.IssueKinds {
+		if counts[kind] > shown[kind] {
+			fmt.Fprintf(msgOut, "%s ... and %d more %s reports\n", yellow("WARN"), counts[kind]-shown[kind], kind)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"carmalink.com/replaystream/stream"
+	"cloud.google.com/go/firestore"
+	"github.com/jessevdk/go-flags"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// listen for reports landing in a target db (usually while a replay runs) and measure how late each one shows up
+// compared to its reportTimestamp, until interrupted, --for runs out or --count reports have been seen
+func watch(ctx context.Context, p *flags.Parser) error {
+	// collect args provided by user
+	var opts optsWatch
+	// populate our opts
+	ok := opts.set(p)
+	if !ok {
+		fmt.Fprintf(msgOut, "%s cmd line args cannot be parsed!\n", red("ERROR"))
+		return errors.New("unable to parse watch args")
+	}
+	if isEmulatorAddr(opts.Target) && opts.EmulatorProjectId == "" {
+		err := errors.New("watching an emulator needs its --projectId")
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	if len(opts.Type) > maxTypeFilters {
+		err := fmt.Errorf("at most %d --type filters can be used", maxTypeFilters)
+		fmt.Fprintf(msgOut, "%s %s\n", red("ERROR"), err)
+		return err
+	}
+	conf := targetClientConfig(opts.Target, opts.EmulatorProjectId)
+	c, err := createFirestoreClient(ctx, conf)
+	if err != nil {
+		return err
+	}
+
+	// stop cleanly on Ctrl-C so we still get our summary
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if opts.For > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.For)
+		defer cancel()
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var rw *recordWriter
+	if structuredOutput() {
+		rw = newRecordWriter(args.Output)
+	}
+	fmt.Fprintf(msgOut, "watching %s, press Ctrl-C to stop\n", blue(opts.describe()))
+	started := now()
+	var delays []float64
+	var seen int
+	iter := opts.query(c).Snapshots(ctx)
+	defer iter.Stop()
+	first := true
+	for opts.Count <= 0 || seen < opts.Count {
+		snap, err := iter.Next()
+		if err != nil {
+			if ctx.Err() != nil || status.Code(err) == codes.Canceled || status.Code(err) == codes.DeadlineExceeded {
+				break
+			}
+			fmt.Fprintf(msgOut, "%s listening for reports\n", red("ERROR"))
+			fmt.Fprintln(msgOut, err)
+			if len(opts.Type) > 0 && status.Code(err) == codes.FailedPrecondition {
+				fmt.Fprintf(msgOut, "%s --type filters need a collection group index exemption on %s: %s\n",
+					yellow("HINT"), blue(SupportedTransponderReports[0]), blue("type"))
+			}
+			return err
+		}
+		// our first snapshot holds everything already there when we started listening
+		skip := first && !opts.Existing
+		first = false
+		if skip {
+			continue
+		}
+		for _, change := range snap.Changes {
+			if change.Kind != firestore.DocumentAdded || !opts.matches(change.Doc.Ref) {
+				continue
+			}
+			arrived := now()
+			ev := watchEvent{Event: "report", Path: change.Doc.Ref.Path, ReceivedAt: arrived}
+			ev.Account, ev.Vehicle = pathVehicle(change.Doc.Ref)
+			ev.Type, _ = change.Doc.Data()["type"].(string)
+			if ts, ok := change.Doc.Data()["reportTimestamp"].(time.Time); ok {
+				ev.ReportTimestamp = ts
+				ev.DelayMs = float64(arrived.Sub(ts)) / float64(time.Millisecond)
+				delays = append(delays, ev.DelayMs)
+			}
+			seen++
+			if rw != nil {
+				if err := rw.write(ev); err != nil {
+					fmt.Fprintf(msgOut, "%s writing %s output\n", red("ERROR"), args.Output)
+					fmt.Fprintln(msgOut, err)
+					return err
+				}
+			} else {
+				fmt.Fprintf(msgOut, "%s  %-6d %-12s delay %s\n", arrived.Format(time.RFC3339Nano), ev.Vehicle, blue(ev.Type),
+					green(strconv.FormatFloat(ev.DelayMs, 'f', 0, 64)+"ms"))
+			}
+			if opts.Count > 0 && seen >= opts.Count {
+				break
+			}
+		}
+	}
+
+	summary := watchSummary{Event: "summary", Reports: seen, Started: started, Finished: now()}
+	summary.Delay = stream.NewDelayStats(delays)
+	if rw != nil {
+		err := rw.write(summary)
+		if err == nil {
+			err = rw.close()
+		}
+		if err != nil {
+			fmt.Fprintf(msgOut, "%s writing %s output\n", red("ERROR"), args.Output)
+			fmt.Fprintln(msgOut, err)
+		}
+		return err
+	}
+	fmt.Fprintf(msgOut, "%s %s reports seen\n", green("done"), blue(strconv.Itoa(seen)))
+	if d := summary.Delay; d != nil {
+		fmt.Fprintf(msgOut, "%s : min %.0fms / median %.0fms / p95 %.0fms / max %.0fms\n", blue("delay"), d.MinMs, d.MedianMs, d.P95Ms, d.MaxMs)
+	}
+	return nil
+}
+
+// emitted for every report watch sees in structured output modes
+type watchEvent struct {
+	Event           string // always "report"
+	Path            string
+	Account         int
+	Vehicle         int
+	Type            string
+	ReportTimestamp time.Time
+	ReceivedAt      time.Time
+	DelayMs         float64 // ReceivedAt - ReportTimestamp
+}
+
+func (e watchEvent) csvHeader() []string {
+	return []string{"event", "path", "account", "vehicle", "type", "reportTimestamp", "receivedAt", "delayMs"}
+}
+
+func (e watchEvent) csvRow() []string {
+	return []string{e.Event, e.Path, strconv.Itoa(e.Account), strconv.Itoa(e.Vehicle), e.Type,
+		csvTime(e.ReportTimestamp), csvTime(e.ReceivedAt), csvFloat(e.DelayMs)}
+}
+
+// final record emitted by watch in structured output modes
+type watchSummary struct {
+	Event    string // always "summary"
+	Reports  int
+	Started  time.Time
+	Finished time.Time
+	Delay    *delayStats `json:",omitempty"`
+}
+
+func (s watchSummary) csvHeader() []string {
+	return []string{"event", "reports", "started", "finished", "minMs", "medianMs", "p95Ms", "maxMs"}
+}
+
+func (s watchSummary) csvRow() []string {
+	row := []string{s.Event, strconv.Itoa(s.Reports), csvTime(s.Started), csvTime(s.Finished), "", "", "", ""}
+	if d := s.Delay; d != nil {
+		row[4], row[5], row[6], row[7] = csvFloat(d.MinMs), csvFloat(d.MedianMs), csvFloat(d.P95Ms), csvFloat(d.MaxMs)
+	}
+	return row
+}
+
+// account and vehicle ids of a report at account/{accountId}/vehicle/{transponderId}/report_data/{id}, 0 if not found
+func pathVehicle(ref *firestore.DocumentRef) (account, vehicle int) {
+	if v := ref.Parent.Parent; v != nil {
+		vehicle, _ = strconv.Atoi(v.ID)
+		if a := v.Parent.Parent; a != nil {
+			account, _ = strconv.Atoi(a.ID)
+		}
+	}
+	return account, vehicle
+}
+
+// Methods //
+
+// a single vehicle's report collection when we can, every report collection in the db otherwise
+func (o *optsWatch) query(c *firestore.Client) firestore.Query {
+	reportCollection := SupportedTransponderReports[0]
+	var q firestore.Query
+	if o.Account != 0 && len(o.Vehicle) == 1 {
+		q = c.Collection("account/" + strconv.Itoa(o.Account) + "/vehicle/" + strconv.Itoa(o.Vehicle[0]) + "/" + reportCollection).Query
+	} else {
+		q = c.CollectionGroup(reportCollection).Query
+	}
+	switch len(o.Type) {
+	case 0: // all types
+	case 1:
+		q = q.Where("type", "==", o.Type[0])
+	default:
+		q = q.Where("type", "in", o.Type)
+	}
+	return q
+}
+
+// account and vehicle filters a collection group query can't do for us
+func (o *optsWatch) matches(ref *firestore.DocumentRef) bool {
+	account, vehicle := pathVehicle(ref)
+	if o.Account != 0 && account != o.Account {
+		return false
+	}
+	if len(o.Vehicle) == 0 {
+		return true
+	}
+	for _, x := range o.Vehicle {
+		if x == vehicle {
+			return true
+		}
+	}
+	return false
+}
+
+// what we're watching, for humans
+func (o *optsWatch) describe() string {
+	s := SupportedTransponderReports[0]
+	if o.Account != 0 {
+		s += " of account " + strconv.Itoa(o.Account)
+	}
+	if len(o.Vehicle) > 0 {
+		xs := make([]string, len(o.Vehicle))
+		for i, x := range o.Vehicle {
+			xs[i] = strconv.Itoa(x)
+		}
+		s += " vehicle " + strings.Join(xs, ", ")
+	}
+	if len(o.Type) > 0 {
+		s += " type " + strings.Join(o.Type, ", ")
+	}
+	return s
+}
+
+// convert and set user-provided values into opts struct
+func (o *optsWatch) set(p *flags.Parser) (ok bool) {
+	o.Target, ok = p.Active.FindOptionByLongName("target").Value().(string)
+	if !ok {
+		return false
+	}
+	o.EmulatorProjectId, ok = p.Active.FindOptionByLongName("projectId").Value().(string)
+	if !ok {
+		return false
+	}
+	o.Account, ok = p.Active.FindOptionByLongName("accountId").Value().(int)
+	if !ok {
+		return false
+	}
+	o.Vehicle, ok = p.Active.FindOptionByLongName("transponderId").Value().([]int)
+	if !ok {
+		return false
+	}
+	o.Type, ok = p.Active.FindOptionByLongName("type").Value().([]string)
+	if !ok {
+		return false
+	}
+	o.Existing, ok = p.Active.FindOptionByLongName("existing").Value().(bool)
+	if !ok {
+		return false
+	}
+	o.For, ok = p.Active.FindOptionByLongName("for").Value().(time.Duration)
+	if !ok {
+		return false
+	}
+	o.Count, ok = p.Active.FindOptionByLongName("count").Value().(int)
+	if !ok {
+		return false
+	}
+	return true
+}